@@ -0,0 +1,449 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"leveldblab/db"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var BackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Quản lý các bản backup",
+}
+
+var BackupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Liệt kê các bản backup",
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog := openCatalog(cmd)
+		manifests, err := catalog.List()
+		if err != nil {
+			log.Fatalf("error while list backups: %s", err.Error())
+		}
+		for _, manifest := range manifests {
+			fmt.Printf("%s\t%s\t%s\t%d keys\t%d bytes\tseq %d\t%s\t%s\n", manifest.ID, manifest.Engine, manifest.Mode,
+				manifest.KeyCount, manifest.Size, manifest.Seq, verifyStatus(manifest.Verification), manifest.Source)
+		}
+	},
+}
+
+var BackupShowCmd = &cobra.Command{
+	Use:   "show <backup-id>",
+	Short: "Xem manifest của một bản backup",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog := openCatalog(cmd)
+		manifest, err := catalog.Get(args[0])
+		if err != nil {
+			log.Fatalf("error while get backup %s: %s", args[0], err.Error())
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(manifest)
+		if manifest.Verification != nil {
+			encoder.Encode(manifest.Verification)
+		}
+	},
+}
+
+var BackupVerifyCmd = &cobra.Command{
+	Use:   "verify [backup-id...]",
+	Short: "Kiểm tra toàn vẹn các bản backup (checksum, đọc toàn bộ key, số key)",
+	Run: func(cmd *cobra.Command, args []string) {
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			log.Fatalf("Cannot find config all")
+		}
+		catalog := openCatalog(cmd)
+		if all {
+			manifests, err := catalog.List()
+			if err != nil {
+				log.Fatalf("error while list backups: %s", err.Error())
+			}
+			args = nil
+			for _, manifest := range manifests {
+				args = append(args, manifest.ID)
+			}
+		}
+
+		failed := 0
+		for _, id := range args {
+			result, err := catalog.Verify(id, db.VerifyOptions{})
+			if err != nil {
+				log.Fatalf("error while verify backup %s: %s", id, err.Error())
+			}
+			fmt.Printf("%s\t%s\t%d keys\n", id, verifyStatus(result), result.KeyCount)
+			for _, message := range result.Errors {
+				fmt.Printf("\t%s\n", message)
+			}
+			if !result.OK {
+				failed++
+			}
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d backups failed verification", failed, len(args))
+		}
+	},
+}
+
+func verifyStatus(result *db.VerifyResult) string {
+	switch {
+	case result == nil:
+		return "unverified"
+	case result.OK:
+		return "ok"
+	}
+	return "FAILED"
+}
+
+var BackupDeleteCmd = &cobra.Command{
+	Use:   "delete <backup-id>",
+	Short: "Xóa một bản backup",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog := openCatalog(cmd)
+		if err := catalog.Delete(args[0]); err != nil {
+			log.Fatalf("error while delete backup %s: %s", args[0], err.Error())
+		}
+		log.Printf("Deleted backup %s", args[0])
+	},
+}
+
+var BackupPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Xóa các bản backup theo chính sách lưu giữ",
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog := openCatalog(cmd)
+		policy := db.RetentionPolicy{}
+		var err error
+		if policy.KeepLast, err = cmd.Flags().GetInt("keep-last"); err != nil {
+			log.Fatalf("Cannot find config keep-last")
+		}
+		if policy.KeepHourly, err = cmd.Flags().GetInt("keep-hourly"); err != nil {
+			log.Fatalf("Cannot find config keep-hourly")
+		}
+		if policy.KeepDaily, err = cmd.Flags().GetInt("keep-daily"); err != nil {
+			log.Fatalf("Cannot find config keep-daily")
+		}
+		if policy.KeepWeekly, err = cmd.Flags().GetInt("keep-weekly"); err != nil {
+			log.Fatalf("Cannot find config keep-weekly")
+		}
+		if policy.MaxTotalSize, err = cmd.Flags().GetInt64("max-size"); err != nil {
+			log.Fatalf("Cannot find config max-size")
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			log.Fatalf("Cannot find config dry-run")
+		}
+
+		if dryRun {
+			prune, err := catalog.PrunePlan(policy)
+			if err != nil {
+				log.Fatalf("error while plan prune: %s", err.Error())
+			}
+			for _, manifest := range prune {
+				fmt.Printf("would delete %s\t%s\n", manifest.ID, manifest.Source)
+			}
+			return
+		}
+
+		deleted, err := catalog.Prune(policy)
+		for _, id := range deleted {
+			fmt.Printf("deleted %s\n", id)
+		}
+		if err != nil {
+			log.Fatalf("error while prune: %s", err.Error())
+		}
+	},
+}
+
+var BackupRestoreCmd = &cobra.Command{
+	Use:   "restore <backup-id> <target-path>",
+	Short: "Khôi phục một bản backup vào thư mục mainDB (engine phải dừng)",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		seq, err := cmd.Flags().GetUint64("seq")
+		if err != nil {
+			log.Fatalf("Cannot find config seq")
+		}
+		catalog := openCatalog(cmd)
+		if err := catalog.RestoreToSequence(args[0], args[1], seq); err != nil {
+			log.Fatalf("error while restore backup %s: %s", args[0], err.Error())
+		}
+	},
+}
+
+var BackupRecoverCmd = &cobra.Command{
+	Use:   "recover <target-path>",
+	Short: "Khôi phục về một thời điểm (hoặc sequence) vào thư mục mới từ backup gần nhất và change log",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		source, err := cmd.Flags().GetString("source")
+		if err != nil {
+			log.Fatalf("Cannot find config source")
+		}
+		changeLog, err := cmd.Flags().GetString("change-log")
+		if err != nil {
+			log.Fatalf("Cannot find config change-log")
+		}
+		at, err := cmd.Flags().GetString("time")
+		if err != nil {
+			log.Fatalf("Cannot find config time")
+		}
+		ago, err := cmd.Flags().GetDuration("ago")
+		if err != nil {
+			log.Fatalf("Cannot find config ago")
+		}
+		seq, err := cmd.Flags().GetUint64("seq")
+		if err != nil {
+			log.Fatalf("Cannot find config seq")
+		}
+
+		target := db.RecoveryTarget{Seq: seq}
+		switch {
+		case at != "":
+			if target.Time, err = time.Parse(time.RFC3339, at); err != nil {
+				log.Fatalf("error while parse time %s: %s", at, err.Error())
+			}
+		case ago > 0:
+			target.Time = time.Now().Add(-ago)
+		}
+		if changeLog == "" {
+			changeLog = filepath.Join(filepath.Dir(source), "changelog")
+		}
+
+		catalog := openCatalog(cmd)
+		report, err := catalog.Recover(source, changeLog, args[0], target)
+		if err != nil {
+			log.Fatalf("error while recover %s: %s", source, err.Error())
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	},
+}
+
+var BackupChecksumCmd = &cobra.Command{
+	Use:   "checksum <db-path>",
+	Short: "Đếm key và tính checksum của một LevelDB để so sánh với báo cáo recover",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		count, sum, err := db.Checksum(args[0])
+		if err != nil {
+			log.Fatalf("error while checksum %s: %s", args[0], err.Error())
+		}
+		fmt.Printf("%d keys\t%s\n", count, sum)
+	},
+}
+
+var BackupPushCmd = &cobra.Command{
+	Use:   "push <backup-id> <target>",
+	Short: "Đẩy một bản backup lên target (thư mục khác hoặc s3://bucket/prefix?endpoint=...), chạy lại để tiếp tục",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog := openCatalog(cmd)
+		if err := catalog.Push(openTarget(args[1]), args[0]); err != nil {
+			log.Fatalf("error while push backup %s to %s: %s", args[0], args[1], err.Error())
+		}
+	},
+}
+
+var BackupPullCmd = &cobra.Command{
+	Use:   "pull <backup-id> <target>",
+	Short: "Tải một bản backup (kèm các bản gốc nếu là incremental) từ target về catalog",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog := openCatalog(cmd)
+		if err := catalog.Pull(openTarget(args[1]), args[0]); err != nil {
+			log.Fatalf("error while pull backup %s from %s: %s", args[0], args[1], err.Error())
+		}
+	},
+}
+
+var BackupRemoteCmd = &cobra.Command{
+	Use:   "remote <target>",
+	Short: "Liệt kê các bản backup trên target",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manifests, err := db.ListTarget(openTarget(args[0]))
+		if err != nil {
+			log.Fatalf("error while list backups of %s: %s", args[0], err.Error())
+		}
+		for _, manifest := range manifests {
+			fmt.Printf("%s\t%s\t%s\t%d keys\t%d bytes\tseq %d\t%s\n", manifest.ID, manifest.Engine, manifest.Mode,
+				manifest.KeyCount, manifest.Size, manifest.Seq, manifest.Source)
+		}
+	},
+}
+
+// backupRunner is an engine that runs backups on demand
+type backupRunner interface {
+	Backup(ctx context.Context) (*db.BackupManifest, error)
+	BackupProgress() *db.BackupProgress
+}
+
+var BackupRunCmd = &cobra.Command{
+	Use:   "run <db-path>",
+	Short: "Chạy backup ngay, hiển thị tiến độ, Ctrl+C để hủy",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		engine, err := cmd.Flags().GetString("engine")
+		if err != nil {
+			log.Fatalf("Cannot find config engine")
+		}
+		mode, err := cmd.Flags().GetString("mode")
+		if err != nil {
+			log.Fatalf("Cannot find config mode")
+		}
+		interval, err := cmd.Flags().GetDuration("progress")
+		if err != nil {
+			log.Fatalf("Cannot find config progress")
+		}
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			log.Fatalf("Cannot find config timeout")
+		}
+		copyWorkers, err := cmd.Flags().GetInt("copy-workers")
+		if err != nil {
+			log.Fatalf("Cannot find config copy-workers")
+		}
+		catalog := openCatalog(cmd)
+		store, err := db.NewStoreWithOptions(engine, args[0], &db.Options{
+			BackupMode:  mode,
+			BackupRoot:  catalog.Root(),
+			Archive:     archiveOptions(cmd),
+			CopyWorkers: copyWorkers,
+			Schedule:    &db.BackupSchedule{Manual: true},
+		})
+		if err != nil {
+			log.Fatalf("error while open %s engine at %s: %s", engine, args[0], err.Error())
+		}
+		defer store.Close()
+		runner, ok := store.(backupRunner)
+		if !ok {
+			log.Fatalf("engine %s does not run backups", engine)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		go func() {
+			for range ticker.C {
+				if progress := runner.BackupProgress(); progress != nil {
+					printProgress(progress)
+				}
+			}
+		}()
+
+		manifest, err := runner.Backup(ctx)
+		if err != nil {
+			log.Printf("error while backup %s: %s", args[0], err.Error())
+			return
+		}
+		if manifest == nil {
+			fmt.Println("no change since the last backup")
+			return
+		}
+		fmt.Printf("%s\t%s\t%d keys\t%d bytes\n", manifest.ID, manifest.Mode, manifest.KeyCount, manifest.Size)
+	},
+}
+
+func printProgress(progress *db.BackupProgress) {
+	remaining := "?"
+	if d := progress.Remaining(); d >= 0 {
+		remaining = d.Round(time.Second).String()
+	}
+	fmt.Printf("%s\t%s\t%d/%d files\t%d/%d records\t%d/%d bytes\tETA %s\n", progress.ID, progress.Mode,
+		progress.Files, progress.FilesTotal, progress.Records, progress.RecordsTotal,
+		progress.Bytes, progress.BytesTotal, remaining)
+}
+
+func openTarget(spec string) db.BackupTarget {
+	target, err := db.ParseBackupTarget(spec)
+	if err != nil {
+		log.Fatalf("error while open backup target %s: %s", spec, err.Error())
+	}
+	return target
+}
+
+func openCatalog(cmd *cobra.Command) *db.BackupCatalog {
+	root, err := cmd.Flags().GetString("root")
+	if err != nil {
+		log.Fatalf("Cannot find config root")
+	}
+	catalog, err := db.NewBackupCatalog(root)
+	if err != nil {
+		log.Fatalf("error while open backup catalog %s: %s", root, err.Error())
+	}
+	catalog.SetArchive(archiveOptions(cmd))
+	return catalog
+}
+
+// archiveOptions reads the archive key flags, nil when none is set
+func archiveOptions(cmd *cobra.Command) *db.ArchiveOptions {
+	keyFile, err := cmd.Flags().GetString("key-file")
+	if err != nil {
+		log.Fatalf("Cannot find config key-file")
+	}
+	passphrase, err := cmd.Flags().GetString("passphrase")
+	if err != nil {
+		log.Fatalf("Cannot find config passphrase")
+	}
+	if keyFile == "" && passphrase == "" {
+		return nil
+	}
+	return &db.ArchiveOptions{KeyFile: keyFile, Passphrase: passphrase}
+}
+
+func init() {
+	BackupCmd.PersistentFlags().String("root", db.DefaultBackupRoot, "backup catalog root")
+	BackupCmd.PersistentFlags().String("key-file", "", "key file of encrypted backup archives")
+	BackupCmd.PersistentFlags().String("passphrase", "", "passphrase of encrypted backup archives")
+	BackupCmd.AddCommand(BackupListCmd)
+	BackupCmd.AddCommand(BackupShowCmd)
+	BackupCmd.AddCommand(BackupDeleteCmd)
+	BackupVerifyCmd.Flags().Bool("all", false, "verify every backup of the catalog")
+	BackupCmd.AddCommand(BackupVerifyCmd)
+
+	BackupPruneCmd.Flags().Int("keep-last", 0, "keep the N newest backups")
+	BackupPruneCmd.Flags().Int("keep-hourly", 0, "keep one backup for each of the N latest hours")
+	BackupPruneCmd.Flags().Int("keep-daily", 0, "keep one backup for each of the N latest days")
+	BackupPruneCmd.Flags().Int("keep-weekly", 0, "keep one backup for each of the N latest weeks")
+	BackupPruneCmd.Flags().Int64("max-size", 0, "maximum total size in bytes of the backups of a source")
+	BackupPruneCmd.Flags().Bool("dry-run", false, "only print the backups to delete")
+	BackupCmd.AddCommand(BackupPruneCmd)
+	BackupRestoreCmd.Flags().Uint64("seq", 0, "replay incremental backups up to this change sequence, 0 replays all")
+	BackupCmd.AddCommand(BackupRestoreCmd)
+
+	BackupRecoverCmd.Flags().String("source", "data/usecase1/main", "mainDB path of the engine")
+	BackupRecoverCmd.Flags().String("change-log", "", "change log folder, <source>/../changelog if empty")
+	BackupRecoverCmd.Flags().String("time", "", "recover up to this RFC3339 time")
+	BackupRecoverCmd.Flags().Duration("ago", 0, "recover up to this long ago, e.g. 5m")
+	BackupRecoverCmd.Flags().Uint64("seq", 0, "recover up to this change sequence")
+	BackupCmd.AddCommand(BackupRecoverCmd)
+	BackupCmd.AddCommand(BackupChecksumCmd)
+	BackupCmd.AddCommand(BackupPushCmd)
+	BackupCmd.AddCommand(BackupPullCmd)
+	BackupCmd.AddCommand(BackupRemoteCmd)
+	BackupRunCmd.Flags().String("engine", db.EngineMainTemp, "engine of the DB: maintemp or repo")
+	BackupRunCmd.Flags().String("mode", db.BackupCopy, "backup mode: copy, checkpoint, snapshot, dump or incremental")
+	BackupRunCmd.Flags().Duration("progress", time.Second, "interval between progress lines")
+	BackupRunCmd.Flags().Int("copy-workers", db.DefaultCopyWorkers, "number of files a copy backup copies at once")
+	BackupRunCmd.Flags().Duration("timeout", 0, "cancel the backup after this long, 0 waits until done")
+	BackupCmd.AddCommand(BackupRunCmd)
+	RootCmd.AddCommand(BackupCmd)
+}
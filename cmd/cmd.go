@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"leveldblab/config"
+	"leveldblab/db"
 	"leveldblab/usecase/usecase1"
 	"leveldblab/usecase/usecase2"
 	"leveldblab/usecase/usecase3"
@@ -34,7 +36,106 @@ var Usecase1Cmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("Cannot find config duration")
 		}
-		usecase1.LevelDBMainTempTesting(read, write, duration)
+		versioned, err := cmd.Flags().GetBool("versioned")
+		if err != nil {
+			log.Fatalf("Cannot find config versioned")
+		}
+		backupMode, err := cmd.Flags().GetString("backup-mode")
+		if err != nil {
+			log.Fatalf("Cannot find config backup-mode")
+		}
+		backupRoot, err := cmd.Flags().GetString("backup-root")
+		if err != nil {
+			log.Fatalf("Cannot find config backup-root")
+		}
+		changeLog, err := cmd.Flags().GetBool("change-log")
+		if err != nil {
+			log.Fatalf("Cannot find config change-log")
+		}
+		verify, err := cmd.Flags().GetBool("verify")
+		if err != nil {
+			log.Fatalf("Cannot find config verify")
+		}
+		archive, err := cmd.Flags().GetBool("archive")
+		if err != nil {
+			log.Fatalf("Cannot find config archive")
+		}
+		keyFile, err := cmd.Flags().GetString("key-file")
+		if err != nil {
+			log.Fatalf("Cannot find config key-file")
+		}
+		passphrase, err := cmd.Flags().GetString("passphrase")
+		if err != nil {
+			log.Fatalf("Cannot find config passphrase")
+		}
+		targets, err := cmd.Flags().GetStringSlice("target")
+		if err != nil {
+			log.Fatalf("Cannot find config target")
+		}
+		schedule, err := backupSchedule(cmd)
+		if err != nil {
+			log.Fatalf("Cannot find config backup schedule: %s", err.Error())
+		}
+		backupRate, err := rateLimit(cmd, "backup")
+		if err != nil {
+			log.Fatalf("Cannot find config backup rate: %s", err.Error())
+		}
+		mergeRate, err := rateLimit(cmd, "merge")
+		if err != nil {
+			log.Fatalf("Cannot find config merge rate: %s", err.Error())
+		}
+		copyWorkers, err := cmd.Flags().GetInt("copy-workers")
+		if err != nil {
+			log.Fatalf("Cannot find config copy-workers")
+		}
+		compareThrottle, err := cmd.Flags().GetBool("compare-throttle")
+		if err != nil {
+			log.Fatalf("Cannot find config compare-throttle")
+		}
+		keepLast, err := cmd.Flags().GetInt("keep-last")
+		if err != nil {
+			log.Fatalf("Cannot find config keep-last")
+		}
+		shards, err := cmd.Flags().GetInt("shards")
+		if err != nil {
+			log.Fatalf("Cannot find config shards")
+		}
+		reshard, err := cmd.Flags().GetBool("reshard")
+		if err != nil {
+			log.Fatalf("Cannot find config reshard")
+		}
+		groupCommit, err := groupCommit(cmd)
+		if err != nil {
+			log.Fatalf("Cannot find config group commit: %s", err.Error())
+		}
+		opts := &db.Options{
+			Versioned:     versioned,
+			BackupMode:    backupMode,
+			BackupRoot:    backupRoot,
+			ChangeLog:     changeLog,
+			VerifyBackups: verify,
+			Schedule:      schedule,
+			CopyWorkers:   copyWorkers,
+			BackupRate:    backupRate,
+			MergeRate:     mergeRate,
+			GroupCommit:   groupCommit,
+			Shards:        shards,
+			Reshard:       reshard,
+		}
+		if archive || keyFile != "" || passphrase != "" {
+			opts.Archive = &db.ArchiveOptions{KeyFile: keyFile, Passphrase: passphrase}
+		}
+		for _, spec := range targets {
+			target, err := db.ParseBackupTarget(spec)
+			if err != nil {
+				log.Fatalf("error while open backup target %s: %s", spec, err.Error())
+			}
+			opts.Targets = append(opts.Targets, target)
+		}
+		if keepLast > 0 {
+			opts.Retention = &db.RetentionPolicy{KeepLast: keepLast}
+		}
+		usecase1.LevelDBMainTempTesting(read, write, duration, opts, compareThrottle)
 	},
 }
 
@@ -82,6 +183,31 @@ func init() {
 	Usecase1Cmd.Flags().Int("write", 10, "write")
 	Usecase1Cmd.Flags().Int("read", 10, "read")
 	Usecase1Cmd.Flags().Duration("duration", 10*time.Second, "duration")
+	Usecase1Cmd.Flags().Bool("versioned", false, "store versions with values")
+	Usecase1Cmd.Flags().String("backup-mode", db.BackupCopy, "backup mode: copy, checkpoint, snapshot, dump or incremental")
+	Usecase1Cmd.Flags().Bool("change-log", false, "record every write in a change log, always on with incremental backups")
+	Usecase1Cmd.Flags().String("backup-root", db.DefaultBackupRoot, "backup catalog root")
+	Usecase1Cmd.Flags().Bool("verify", false, "verify each backup against the mainDB it was taken from")
+	Usecase1Cmd.Flags().Bool("archive", false, "write backups as tar.gz archives")
+	Usecase1Cmd.Flags().String("key-file", "", "encrypt backup archives with the 32 byte key of this file")
+	Usecase1Cmd.Flags().String("passphrase", "", "encrypt backup archives with a key derived from this passphrase")
+	Usecase1Cmd.Flags().StringSlice("target", nil, "upload each backup to this folder or s3://bucket/prefix?endpoint=URL target")
+	Usecase1Cmd.Flags().Duration("backup-interval", config.BackupInterval, "time between backups")
+	Usecase1Cmd.Flags().String("backup-cron", config.BackupCron, "cron schedule of backups, replaces --backup-interval")
+	Usecase1Cmd.Flags().Duration("backup-jitter", config.BackupJitter, "random delay added to each backup")
+	Usecase1Cmd.Flags().Int64("backup-min-writes", config.BackupMinWrites, "skip a backup until this many writes happened")
+	Usecase1Cmd.Flags().Int("copy-workers", db.DefaultCopyWorkers, "number of files a copy backup copies at once")
+	Usecase1Cmd.Flags().Int64("backup-bytes-per-sec", 0, "limit backup I/O to this many bytes per second, 0 is unlimited")
+	Usecase1Cmd.Flags().Int64("backup-ops-per-sec", 0, "limit backup I/O to this many operations per second, 0 is unlimited")
+	Usecase1Cmd.Flags().Int64("merge-bytes-per-sec", 0, "limit merge I/O to this many bytes per second, 0 is unlimited")
+	Usecase1Cmd.Flags().Int64("merge-ops-per-sec", 0, "limit merge I/O to this many operations per second, 0 is unlimited")
+	Usecase1Cmd.Flags().Bool("compare-throttle", false, "run half of the duration without the backup and merge limits, then report latency of both halves")
+	Usecase1Cmd.Flags().Int("keep-last", 0, "keep the N newest backups, 0 keeps all")
+	Usecase1Cmd.Flags().Int("group-commit-ops", db.DefaultGroupCommitOps, "write up to this many Put/Delete calls together, 1 writes each call on its own")
+	Usecase1Cmd.Flags().Int("group-commit-bytes", db.DefaultGroupCommitBytes, "write up to this many bytes of Put/Delete calls together")
+	Usecase1Cmd.Flags().Duration("group-commit-delay", 0, "how long a group waits for more Put/Delete calls, 0 only takes the waiting ones")
+	Usecase1Cmd.Flags().Int("shards", 0, "hash keys across this many maintemp shards backed up one at a time, 0 runs a single engine")
+	Usecase1Cmd.Flags().Bool("reshard", false, "move the keys of the shards when --shards changes instead of failing")
 	RootCmd.AddCommand(Usecase1Cmd)
 
 	Usecase2Cmd.Flags().Int("write", 10, "write")
@@ -94,3 +220,57 @@ func init() {
 	Usecase3Cmd.Flags().Duration("duration", 10*time.Second, "duration")
 	RootCmd.AddCommand(Usecase3Cmd)
 }
+
+// backupSchedule reads the schedule flags, nil keeps the config defaults
+func backupSchedule(cmd *cobra.Command) (*db.BackupSchedule, error) {
+	flags := cmd.Flags()
+	if !flags.Changed("backup-interval") && !flags.Changed("backup-cron") &&
+		!flags.Changed("backup-jitter") && !flags.Changed("backup-min-writes") {
+		return nil, nil
+	}
+
+	schedule := &db.BackupSchedule{}
+	var err error
+	if schedule.Interval, err = flags.GetDuration("backup-interval"); err != nil {
+		return nil, err
+	}
+	if schedule.Cron, err = flags.GetString("backup-cron"); err != nil {
+		return nil, err
+	}
+	if schedule.Jitter, err = flags.GetDuration("backup-jitter"); err != nil {
+		return nil, err
+	}
+	if schedule.MinWrites, err = flags.GetInt64("backup-min-writes"); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// rateLimit reads the --<name>-bytes-per-sec and --<name>-ops-per-sec flags
+func rateLimit(cmd *cobra.Command, name string) (db.RateLimit, error) {
+	var limit db.RateLimit
+	var err error
+	if limit.BytesPerSec, err = cmd.Flags().GetInt64(name + "-bytes-per-sec"); err != nil {
+		return limit, err
+	}
+	if limit.OpsPerSec, err = cmd.Flags().GetInt64(name + "-ops-per-sec"); err != nil {
+		return limit, err
+	}
+	return limit, nil
+}
+
+// groupCommit reads the --group-commit-* flags
+func groupCommit(cmd *cobra.Command) (db.GroupCommit, error) {
+	var g db.GroupCommit
+	var err error
+	if g.MaxOps, err = cmd.Flags().GetInt("group-commit-ops"); err != nil {
+		return g, err
+	}
+	if g.MaxBytes, err = cmd.Flags().GetInt("group-commit-bytes"); err != nil {
+		return g, err
+	}
+	if g.MaxDelay, err = cmd.Flags().GetDuration("group-commit-delay"); err != nil {
+		return g, err
+	}
+	return g, nil
+}
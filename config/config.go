@@ -4,11 +4,18 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 var (
 	EnableBackup  = true
 	EnableWriting = true
+
+	// default backup schedule of the engines, see db.BackupSchedule
+	BackupInterval  = 30 * time.Second
+	BackupCron      = ""
+	BackupJitter    time.Duration
+	BackupMinWrites int64
 )
 
 func init() {
@@ -31,4 +38,36 @@ func init() {
 
 		EnableWriting = enableWriting
 	}
+
+	envBackupInterval := os.Getenv("BackupInterval")
+	if envBackupInterval != "" {
+		backupInterval, err := time.ParseDuration(envBackupInterval)
+		if err != nil {
+			log.Fatalf("BackupInterval err parse duration: %s", err.Error())
+		}
+
+		BackupInterval = backupInterval
+	}
+
+	BackupCron = os.Getenv("BackupCron")
+
+	envBackupJitter := os.Getenv("BackupJitter")
+	if envBackupJitter != "" {
+		backupJitter, err := time.ParseDuration(envBackupJitter)
+		if err != nil {
+			log.Fatalf("BackupJitter err parse duration: %s", err.Error())
+		}
+
+		BackupJitter = backupJitter
+	}
+
+	envBackupMinWrites := os.Getenv("BackupMinWrites")
+	if envBackupMinWrites != "" {
+		backupMinWrites, err := strconv.ParseInt(envBackupMinWrites, 10, 64)
+		if err != nil {
+			log.Fatalf("BackupMinWrites err parse int: %s", err.Error())
+		}
+
+		BackupMinWrites = backupMinWrites
+	}
 }
@@ -0,0 +1,627 @@
+package db
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Backup formats, recorded in BackupManifest.Format. Plain backups leave it
+// empty
+const (
+	// FormatArchive is a tar stream compressed with gzip
+	FormatArchive = "tar.gz"
+	// FormatEncryptedArchive is a FormatArchive encrypted with AES-256-GCM
+	FormatEncryptedArchive = "tar.gz+aes-256-gcm"
+)
+
+const (
+	archiveFileName          = "backup.tar.gz"
+	encryptedArchiveFileName = "backup.tar.gz.enc"
+
+	// archiveChunkSize is the plaintext sealed per GCM chunk
+	archiveChunkSize = 64 << 10
+	// archiveFinalChunk flags the last chunk in its length so a truncated
+	// archive fails authentication
+	archiveFinalChunk = 1 << 31
+
+	// kdfKeyFile archives were sealed with the raw key of the key file, they
+	// are still read. New ones derive a key per archive with kdfKeyFileHKDF
+	kdfKeyFile     = 0
+	kdfPassphrase  = 1
+	kdfKeyFileHKDF = 2
+	kdfSaltSize    = 16
+)
+
+// archiveKeyInfo binds the keys derived from a key file to their use
+var archiveKeyInfo = []byte("leveldblab archive key")
+
+// archiveKDFIterations is the PBKDF2-SHA256 cost of a passphrase-derived key
+var archiveKDFIterations = 600000
+
+// encryptedMagic starts an encrypted archive, followed by the kdf byte, the
+// random salt, the uint32 kdf iterations and the 4 byte nonce prefix. The salt
+// gives every archive its own key, derived from the passphrase with PBKDF2 or
+// from the key file with HKDF, so chunk nonces never repeat under a key. Chunks follow
+// as uint32 ciphertext length (archiveFinalChunk set on the last one) |
+// ciphertext, their nonce is the prefix and the uint64 chunk index and the
+// header and length are authenticated with them.
+var encryptedMagic = []byte("LVLENC01")
+
+var (
+	ErrArchiveKeyRequired = errors.New("db: backup archive is encrypted, a key file or passphrase is needed")
+	ErrArchiveAuth        = errors.New("db: backup archive failed authentication, wrong key or tampered archive")
+)
+
+// ArchiveOptions writes backups as a tar.gz archive, encrypted with
+// AES-256-GCM when KeyFile or Passphrase is set. The catalog also uses the key
+// to read encrypted archives back.
+type ArchiveOptions struct {
+	// KeyFile holds a 32 byte key, raw or hex encoded
+	KeyFile string
+	// Passphrase derives the key with PBKDF2-SHA256 and a salt per archive
+	Passphrase string
+}
+
+func (o *ArchiveOptions) encrypted() bool {
+	return o != nil && (o.KeyFile != "" || o.Passphrase != "")
+}
+
+func (o *ArchiveOptions) format() string {
+	if o.encrypted() {
+		return FormatEncryptedArchive
+	}
+	return FormatArchive
+}
+
+func (o *ArchiveOptions) fileName() string {
+	if o.encrypted() {
+		return encryptedArchiveFileName
+	}
+	return archiveFileName
+}
+
+// key returns the AES-256 key of an archive sealed with kdf, iterations are
+// only used with a passphrase
+func (o *ArchiveOptions) key(kdf byte, salt []byte, iterations int) ([]byte, error) {
+	if kdf == kdfPassphrase {
+		return pbkdf2SHA256([]byte(o.Passphrase), salt, iterations, 32), nil
+	}
+	key, err := o.fileKey()
+	if err != nil || kdf == kdfKeyFile {
+		return key, err
+	}
+	return hkdfSHA256(key, salt, archiveKeyInfo, 32), nil
+}
+
+// fileKey reads the key of KeyFile
+func (o *ArchiveOptions) fileKey() ([]byte, error) {
+	data, err := os.ReadFile(o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file %s: want 32 bytes, raw or hex encoded", o.KeyFile)
+	}
+	return key, nil
+}
+
+// hkdfSHA256 derives a key from secret as in RFC 5869
+func hkdfSHA256(secret, salt, info []byte, keyLen int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	var key, t []byte
+	for block := byte(1); len(key) < keyLen; block++ {
+		expand.Reset()
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{block})
+		t = expand.Sum(nil)
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// pbkdf2SHA256 derives a key from password as in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// createArchive writes the archive file at path, fn fills its tar stream
+func createArchive(path string, o *ArchiveOptions, fn func(tw *tar.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	var w io.Writer = bw
+	var ew *encryptWriter
+	if o.encrypted() {
+		if ew, err = newEncryptWriter(bw, o); err != nil {
+			return err
+		}
+		w = ew
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := fn(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// tarDir adds every file under src but LOCK to tw
+func tarDir(ctx context.Context, tw *tar.Writer, src string, p *backupProgress) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() == "LOCK" {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		header := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		// a table file never grows once written, only the copied size is read
+		_, err = io.Copy(tw, &progressReader{ctx: ctx, r: io.LimitReader(f, info.Size()), progress: p})
+		return err
+	})
+}
+
+// extractArchive writes the files of the archive at path under dst
+func extractArchive(path string, o *ArchiveOptions, dst string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	magic, _ := br.Peek(len(encryptedMagic))
+	if bytes.Equal(magic, encryptedMagic) {
+		if !o.encrypted() {
+			return ErrArchiveKeyRequired
+		}
+		if r, err = newDecryptReader(br, o); err != nil {
+			return err
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return archiveError(err)
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archiveError(err)
+		}
+		name := filepath.FromSlash(header.Name)
+		if header.Typeflag != tar.TypeReg || !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: unexpected archive entry %s", ErrBackupCorrupted, header.Name)
+		}
+		if err := extractFile(tr, filepath.Join(dst, name)); err != nil {
+			return archiveError(err)
+		}
+	}
+	// read up to the end so the last chunk and the gzip trailer are checked
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return archiveError(err)
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// archiveError reports a damaged archive as ErrBackupCorrupted
+func archiveError(err error) error {
+	if errors.Is(err, ErrArchiveAuth) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrBackupCorrupted, err)
+	}
+	return err
+}
+
+// encryptWriter seals what is written in archiveChunkSize GCM chunks
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	index  uint64
+	buf    []byte
+}
+
+func newEncryptWriter(w io.Writer, o *ArchiveOptions) (*encryptWriter, error) {
+	header := make([]byte, 0, len(encryptedMagic)+1+kdfSaltSize+4+4)
+	header = append(header, encryptedMagic...)
+	kdf := byte(kdfKeyFileHKDF)
+	if o.KeyFile == "" {
+		kdf = kdfPassphrase
+	}
+	header = append(header, kdf)
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, uint32(archiveKDFIterations))
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+
+	key, err := o.key(kdf, salt, archiveKDFIterations)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  append(prefix, make([]byte, 8)...),
+		buf:    make([]byte, 0, archiveChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals the buffered data as the final chunk
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	length := uint32(len(e.buf) + e.aead.Overhead())
+	if final {
+		length |= archiveFinalChunk
+	}
+	binary.BigEndian.PutUint64(e.nonce[4:], e.index)
+	e.index++
+
+	ad := binary.BigEndian.AppendUint32(append([]byte(nil), e.header...), length)
+	out := binary.BigEndian.AppendUint32(nil, length)
+	out = e.aead.Seal(out, e.nonce, e.buf, ad)
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+// decryptReader opens the chunks of an encryptWriter
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	index  uint64
+	buf    []byte
+	final  bool
+}
+
+func newDecryptReader(r io.Reader, o *ArchiveOptions) (*decryptReader, error) {
+	header := make([]byte, len(encryptedMagic)+1+kdfSaltSize+4+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrArchiveAuth, err.Error())
+	}
+	n := len(encryptedMagic)
+	kdf := header[n]
+	salt := header[n+1 : n+1+kdfSaltSize]
+	iterations := binary.BigEndian.Uint32(header[n+1+kdfSaltSize:])
+	prefix := header[n+1+kdfSaltSize+4:]
+	if kdf == kdfPassphrase && o.KeyFile != "" {
+		return nil, fmt.Errorf("%w: archive is encrypted with a passphrase", ErrArchiveAuth)
+	}
+	if kdf != kdfPassphrase && o.KeyFile == "" {
+		return nil, fmt.Errorf("%w: archive is encrypted with a key file", ErrArchiveAuth)
+	}
+
+	key, err := o.key(kdf, salt, int(iterations))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  append(append([]byte(nil), prefix...), make([]byte, 8)...),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			// nothing may follow the final chunk
+			if n, _ := d.r.Read(make([]byte, 1)); n > 0 {
+				return 0, fmt.Errorf("%w: data after the final chunk", ErrArchiveAuth)
+			}
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(d.r, lengthBuf[:]); err != nil {
+		return fmt.Errorf("%w: truncated archive", ErrArchiveAuth)
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	size := length &^ archiveFinalChunk
+	if size < uint32(d.aead.Overhead()) || size > archiveChunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("%w: bad chunk length", ErrArchiveAuth)
+	}
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(d.r, chunk); err != nil {
+		return fmt.Errorf("%w: truncated archive", ErrArchiveAuth)
+	}
+
+	binary.BigEndian.PutUint64(d.nonce[4:], d.index)
+	d.index++
+	ad := binary.BigEndian.AppendUint32(append([]byte(nil), d.header...), length)
+	plain, err := d.aead.Open(chunk[:0], d.nonce, chunk, ad)
+	if err != nil {
+		return ErrArchiveAuth
+	}
+	d.buf = plain
+	d.final = length&archiveFinalChunk != 0
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetArchive makes the catalog write new backups as archives, with o's key
+// for encrypted ones, and read encrypted archives with that key. A nil o
+// writes plain backup folders.
+func (c *BackupCatalog) SetArchive(o *ArchiveOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.archive = o
+}
+
+func (c *BackupCatalog) archiveOptions() *ArchiveOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.archive
+}
+
+// withData calls fn with the folder holding the plain data of the backup,
+// an archive is extracted next to the manifest for the time of the call
+func (c *BackupCatalog) withData(manifest *BackupManifest, fn func(dataPath string) error) error {
+	if manifest.Format == "" {
+		return fn(c.DataPath(manifest.ID))
+	}
+
+	o := c.archiveOptions()
+	name := archiveFileName
+	if manifest.Format == FormatEncryptedArchive {
+		name = encryptedArchiveFileName
+	}
+	extracted := filepath.Join(c.root, manifest.ID, "extract.tmp")
+	if err := os.RemoveAll(extracted); err != nil {
+		return err
+	}
+	defer os.RemoveAll(extracted)
+	if err := extractArchive(filepath.Join(c.DataPath(manifest.ID), name), o, extracted); err != nil {
+		return err
+	}
+	return fn(extracted)
+}
+
+// stagingPath is a scratch folder for data written before it is archived
+func (b *pendingBackup) stagingPath() string {
+	return filepath.Join(b.catalog.root, b.manifest.ID, "staging.tmp")
+}
+
+// writeClosed backs up the closed DB folder src into b, straight into an
+// archive when the catalog writes archives
+func (b *pendingBackup) writeClosed(src string) error {
+	files, bytes, err := dirSize(src)
+	if err != nil {
+		return err
+	}
+	b.progress.total(files, 0, bytes)
+
+	o := b.catalog.archiveOptions()
+	if o == nil {
+		return backupClosed(b.context(), b.manifest.Mode, src, b.dataPath(), b.catalog.getCopyWorkers(), b.progress)
+	}
+	return b.archiveDir(o, src, b.progress)
+}
+
+// writeOnline writes snap into b and returns the number of keys written. A
+// dump is streamed into the archive, a snapshot is staged first
+func (b *pendingBackup) writeOnline(snap *leveldb.Snapshot) (int, error) {
+	ctx := b.context()
+	size, err := sizeSnapshot(ctx, snap)
+	if err != nil {
+		return 0, err
+	}
+	b.progress.total(0, size.keys, size.bytes)
+
+	o := b.catalog.archiveOptions()
+	if o == nil {
+		return backupOnline(ctx, b.manifest.Mode, snap, b.dataPath(), b.progress)
+	}
+
+	if b.manifest.Mode == BackupDump {
+		count := 0
+		b.manifest.Format = o.format()
+		err = createArchive(filepath.Join(b.dataPath(), o.fileName()), o, func(tw *tar.Writer) error {
+			if err := tw.WriteHeader(&tar.Header{Name: dumpFileName, Mode: 0644, Size: size.dump, ModTime: time.Now()}); err != nil {
+				return err
+			}
+			count, err = writeDump(ctx, snap, tw, b.progress)
+			return err
+		})
+		return count, err
+	}
+
+	defer os.RemoveAll(b.stagingPath())
+	count, err := backupOnline(ctx, b.manifest.Mode, snap, b.stagingPath(), b.progress)
+	if err != nil {
+		return count, err
+	}
+	return count, b.archiveDir(o, b.stagingPath(), b.progress.paced())
+}
+
+// writeChanges copies the changes in [from, to] into b
+func (b *pendingBackup) writeChanges(changes *changeLog, from, to uint64) (int64, error) {
+	ctx := b.context()
+	b.progress.total(0, int64(to-from+1), 0)
+
+	o := b.catalog.archiveOptions()
+	if o == nil {
+		return writeChanges(ctx, changes, from, to, filepath.Join(b.dataPath(), changesFileName), b.progress)
+	}
+
+	defer os.RemoveAll(b.stagingPath())
+	count, err := writeChanges(ctx, changes, from, to, filepath.Join(b.stagingPath(), changesFileName), b.progress)
+	if err != nil {
+		return count, err
+	}
+	return count, b.archiveDir(o, b.stagingPath(), b.progress.paced())
+}
+
+// archiveDir archives the files under src into b, counting them into p and
+// pacing them to its rate limit
+func (b *pendingBackup) archiveDir(o *ArchiveOptions, src string, p *backupProgress) error {
+	b.manifest.Format = o.format()
+	return createArchive(filepath.Join(b.dataPath(), o.fileName()), o, func(tw *tar.Writer) error {
+		return tarDir(b.context(), tw, src, p)
+	})
+}
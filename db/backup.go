@@ -0,0 +1,218 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Backup modes
+const (
+	// BackupCopy closes mainDB, copies its folder and reopens it. Writes go to
+	// tempDB meanwhile and are merged back afterwards
+	BackupCopy = "copy"
+	// BackupCheckpoint works like BackupCopy but hard-links the table files
+	// instead of copying them
+	BackupCheckpoint = "checkpoint"
+	// BackupSnapshot streams a snapshot of mainDB into a fresh LevelDB while
+	// mainDB stays open for reads and writes
+	BackupSnapshot = "snapshot"
+	// BackupDump streams a snapshot of mainDB into a sorted dump file
+	BackupDump = "dump"
+	// BackupIncremental stores the change log records written since the
+	// previous backup, the first backup of a chain is a BackupSnapshot
+	BackupIncremental = "incremental"
+)
+
+// snapshotBatchSize bounds the bytes written per batch when streaming a snapshot
+const snapshotBatchSize = 4 << 20
+
+// dumpMagic starts every dump file, records follow as
+// uvarint key length | key | uvarint value length | value
+var dumpMagic = []byte("LVLDUMP1")
+
+// dumpFileName is the dump file in the data folder of a BackupDump backup
+const dumpFileName = "backup.dump"
+
+var errBadDump = errors.New("db: not a dump file")
+
+func validBackupMode(mode string) bool {
+	switch mode {
+	case BackupCopy, BackupCheckpoint, BackupSnapshot, BackupDump, BackupIncremental:
+		return true
+	}
+	return false
+}
+
+// isOnlineBackup reports whether mode backs up mainDB without closing it
+func isOnlineBackup(mode string) bool {
+	return mode == BackupSnapshot || mode == BackupDump || mode == BackupIncremental
+}
+
+// backupClosed backs up the closed DB folder src into dst according to mode,
+// copying workers files at a time and counting them into p. It stops once ctx
+// is done
+func backupClosed(ctx context.Context, mode, src, dst string, workers int, p *backupProgress) error {
+	if mode == BackupCheckpoint {
+		return checkpoint(ctx, src, dst, p)
+	}
+	return copyDir(ctx, src, dst, workers, p)
+}
+
+// backupOnline writes snap into dst according to mode and returns the number
+// of keys written, counting them into p and pacing them to its rate limit. It
+// stops once ctx is done
+func backupOnline(ctx context.Context, mode string, snap *leveldb.Snapshot, dst string, p *backupProgress) (int, error) {
+	if mode == BackupDump {
+		return dumpSnapshot(ctx, snap, filepath.Join(dst, dumpFileName), p)
+	}
+	return copySnapshot(ctx, snap, dst, p)
+}
+
+// copySnapshot writes every key of snap into a new LevelDB at dst
+func copySnapshot(ctx context.Context, snap *leveldb.Snapshot, dst string, p *backupProgress) (int, error) {
+	backupDB, err := leveldb.OpenFile(dst, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+
+	count := 0
+	batch := &leveldb.Batch{}
+	size := 0
+	for iter.Next() {
+		if err := p.wait(ctx, len(iter.Key())+len(iter.Value())); err != nil {
+			backupDB.Close()
+			return count, err
+		}
+		batch.Put(iter.Key(), iter.Value())
+		size += len(iter.Key()) + len(iter.Value())
+		count++
+		p.addRecord(len(iter.Key()) + len(iter.Value()))
+		if size >= snapshotBatchSize {
+			if err := backupDB.Write(batch, nil); err != nil {
+				backupDB.Close()
+				return count, err
+			}
+			batch.Reset()
+			size = 0
+		}
+	}
+	if err := iter.Error(); err != nil {
+		backupDB.Close()
+		return count, err
+	}
+	if err := backupDB.Write(batch, nil); err != nil {
+		backupDB.Close()
+		return count, err
+	}
+	return count, backupDB.Close()
+}
+
+// dumpSnapshot writes every key of snap in order into the file dst
+func dumpSnapshot(ctx context.Context, snap *leveldb.Snapshot, dst string, p *backupProgress) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	count, err := writeDump(ctx, snap, w, p)
+	if err != nil {
+		return count, err
+	}
+	if err := w.Flush(); err != nil {
+		return count, err
+	}
+	if err := f.Sync(); err != nil {
+		return count, err
+	}
+	return count, f.Close()
+}
+
+// writeDump writes every key of snap in order to w in the dump format
+func writeDump(ctx context.Context, snap *leveldb.Snapshot, w io.Writer, p *backupProgress) (int, error) {
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+
+	if _, err := w.Write(dumpMagic); err != nil {
+		return 0, err
+	}
+	count := 0
+	buf := make([]byte, binary.MaxVarintLen64)
+	for iter.Next() {
+		if err := p.wait(ctx, len(iter.Key())+len(iter.Value())); err != nil {
+			return count, err
+		}
+		for _, field := range [][]byte{iter.Key(), iter.Value()} {
+			n := binary.PutUvarint(buf, uint64(len(field)))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return count, err
+			}
+			if _, err := w.Write(field); err != nil {
+				return count, err
+			}
+		}
+		count++
+		p.addRecord(len(iter.Key()) + len(iter.Value()))
+	}
+	return count, iter.Error()
+}
+
+// readDump calls fn for every record of the dump file src, in key order
+func readDump(src string, fn func(key, value []byte) error) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(dumpMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(dumpMagic) {
+		return errBadDump
+	}
+
+	readField := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return field, nil
+	}
+	for {
+		key, err := readField()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := readField()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// DefaultBackupRoot is the catalog root used when Options.BackupRoot is empty
+const DefaultBackupRoot = "./backup"
+
+const (
+	backupIDLayout   = "20060102T150405.000000000Z"
+	manifestFileName = "manifest.json"
+	backupDataDir    = "data"
+)
+
+var ErrBackupNotFound = errors.New("db: backup not found")
+
+// BackupManifest describes the content of a backup
+type BackupManifest struct {
+	ID        string       `json:"id"`
+	Source    string       `json:"source"`
+	Engine    string       `json:"engine"`
+	Mode      string       `json:"mode"`
+	StartTime time.Time    `json:"start_time"`
+	EndTime   time.Time    `json:"end_time"`
+	KeyCount  int64        `json:"key_count"`
+	Size      int64        `json:"size"`
+	Files     []BackupFile `json:"files"`
+
+	// Seq is the last change log sequence held by the backup, zero when the
+	// engine has no change log
+	Seq uint64 `json:"seq,omitempty"`
+	// Parent, FromSeq and Changes describe a BackupIncremental backup: the
+	// changes [FromSeq, Seq] logged after backup Parent
+	Parent  string `json:"parent,omitempty"`
+	FromSeq uint64 `json:"from_seq,omitempty"`
+	Changes int64  `json:"changes,omitempty"`
+
+	// Format is FormatArchive or FormatEncryptedArchive for an archived
+	// backup, empty for a plain folder
+	Format string `json:"format,omitempty"`
+
+	// Verification is the last VerifyResult, nil if never verified. It is
+	// kept in its own file so the manifest never changes once written
+	Verification *VerifyResult `json:"-"`
+}
+
+// BackupFile is a file of a backup, Path is relative to the backup data folder
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupCatalog keeps backups under a root folder, one folder per backup named
+// by its ID holding the manifest and the data folder. IDs are UTC timestamps
+// so they sort in creation order.
+type BackupCatalog struct {
+	root string
+
+	mu      sync.Mutex
+	lastID  time.Time
+	archive *ArchiveOptions
+	targets []BackupTarget
+	// copyWorkers is read through getCopyWorkers
+	copyWorkers int
+	// mergePolicies combine the merge operands of replayed changes
+	mergePolicies MergePolicies
+}
+
+func NewBackupCatalog(root string) (*BackupCatalog, error) {
+	if root == "" {
+		root = DefaultBackupRoot
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &BackupCatalog{root: root}, nil
+}
+
+func (c *BackupCatalog) Root() string {
+	return c.root
+}
+
+// DataPath returns the folder holding the data of backup id
+func (c *BackupCatalog) DataPath(id string) string {
+	return filepath.Join(c.root, id, backupDataDir)
+}
+
+// List returns the manifest of every complete backup, oldest first
+func (c *BackupCatalog) List() ([]*BackupManifest, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*BackupManifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifest, err := c.Get(entry.Name())
+		if err == ErrBackupNotFound {
+			// incomplete or not a backup
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].ID < manifests[j].ID })
+	return manifests, nil
+}
+
+// Get returns the manifest of backup id
+func (c *BackupCatalog) Get(id string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(c.root, id, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Verification, err = c.VerifyResult(id); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Delete removes backup id
+func (c *BackupCatalog) Delete(id string) error {
+	if _, err := c.Get(id); err != nil {
+		return err
+	}
+	// the manifest goes first so a half deleted backup is no longer listed
+	if err := os.Remove(filepath.Join(c.root, id, manifestFileName)); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(c.root, id))
+}
+
+// pendingBackup is a backup being written, it is listed once committed
+type pendingBackup struct {
+	catalog  *BackupCatalog
+	manifest *BackupManifest
+	progress *backupProgress
+	// run is the engine backup b belongs to, nil outside an engine
+	run *backupRun
+}
+
+// begin reserves a new backup ID and creates its folder
+func (c *BackupCatalog) begin(source, engine, mode string) (*pendingBackup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UTC()
+	if !now.After(c.lastID) {
+		now = c.lastID.Add(time.Nanosecond)
+	}
+	for {
+		err := os.Mkdir(filepath.Join(c.root, now.Format(backupIDLayout)), 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		// taken by another process sharing the root
+		now = now.Add(time.Nanosecond)
+	}
+	c.lastID = now
+
+	return &pendingBackup{
+		catalog: c,
+		manifest: &BackupManifest{
+			ID:        now.Format(backupIDLayout),
+			Source:    source,
+			Engine:    engine,
+			Mode:      mode,
+			StartTime: time.Now(),
+		},
+		progress: &backupProgress{},
+	}, nil
+}
+
+func (b *pendingBackup) dataPath() string {
+	return b.catalog.DataPath(b.manifest.ID)
+}
+
+// commit writes the manifest of the backup. A negative keyCount is counted by
+// opening the backup data
+func (b *pendingBackup) commit(keyCount int64) (*BackupManifest, error) {
+	manifest := b.manifest
+	manifest.EndTime = time.Now()
+
+	if keyCount < 0 {
+		err := b.catalog.withData(manifest, func(dataPath string) error {
+			count, err := countBackupKeys(dataPath, manifest.Mode)
+			keyCount = count
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	manifest.KeyCount = keyCount
+
+	files, err := hashFiles(b.dataPath())
+	if err != nil {
+		return nil, err
+	}
+	manifest.Files = files
+	manifest.Size = 0
+	for _, file := range files {
+		manifest.Size += file.Size
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	folder := filepath.Join(b.catalog.root, manifest.ID)
+	tmp := filepath.Join(folder, manifestFileName+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(folder, manifestFileName)); err != nil {
+		return nil, err
+	}
+	if err := syncDir(folder); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// context is done once the backup is cancelled
+func (b *pendingBackup) context() context.Context {
+	if b.run == nil {
+		return context.Background()
+	}
+	return b.run.ctx
+}
+
+// abort removes the partial backup
+func (b *pendingBackup) abort() error {
+	return os.RemoveAll(filepath.Join(b.catalog.root, b.manifest.ID))
+}
+
+// countBackupKeys counts the keys of the backup data at dataPath
+func countBackupKeys(dataPath, mode string) (int64, error) {
+	var count int64
+	if mode == BackupIncremental {
+		return 0, nil
+	}
+	if mode == BackupDump {
+		err := readDump(filepath.Join(dataPath, dumpFileName), func(key, value []byte) error {
+			count++
+			return nil
+		})
+		return count, err
+	}
+
+	backupDB, err := leveldb.OpenFile(dataPath, &opt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer backupDB.Close()
+
+	iter := backupDB.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		count++
+	}
+	return count, iter.Error()
+}
+
+// writeFileSync writes data to a new file at path and syncs it
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hashFiles lists the files under root with their size and SHA-256
+func hashFiles(root string) ([]BackupFile, error) {
+	var files []BackupFile
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if info.Name() == "LOCK" {
+			// created by opening the backup, not part of the data
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, BackupFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   info.Size(),
+			SHA256: sum,
+		})
+		return nil
+	})
+	return files, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
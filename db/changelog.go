@@ -0,0 +1,468 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// changeLogSegmentSize is the size after which the change log starts a new
+// segment file
+const changeLogSegmentSize = 64 << 20
+
+// changeLogHeaderSize is the length and checksum before each record payload
+const changeLogHeaderSize = 8
+
+// changeLogAbortedFileName lists, one sequence per line, the changes whose
+// write failed once recorded. They are replayed as empty batches so the
+// sequences stay contiguous
+const changeLogAbortedFileName = "aborted"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errBadChange = errors.New("db: corrupted change log record")
+
+// change is a mutation recorded in the change log, a Put or Delete is recorded
+// as a batch of one record
+type change struct {
+	seq   uint64
+	time  time.Time
+	batch *leveldb.Batch
+}
+
+// changeLog is an append-only log of every mutation of an engine. Records are
+// numbered by a sequence that keeps growing across restarts and written to
+// segment files named by their first sequence. A record is
+// uint32 payload length | uint32 CRC-32C of payload | payload, the payload is
+// uvarint seq | varint unix nanos | leveldb batch.
+//
+// A record is flushed to the segment file once appended and synced to disk
+// when syncEvery is set, otherwise when the segment is full, on sync and on
+// close.
+type changeLog struct {
+	dir       string
+	syncEvery bool
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	lastSeq uint64
+}
+
+func openChangeLog(dir string, syncEvery bool) (*changeLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &changeLog{dir: dir, syncEvery: syncEvery}
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return l, l.rotate(1)
+	}
+
+	// find the last sequence and drop a record torn by a crash
+	last := segments[len(segments)-1]
+	var valid int64
+	l.lastSeq = last - 1
+	err = readChangeFile(l.segmentPath(last), func(c *change, end int64) error {
+		l.lastSeq = c.seq
+		valid = end
+		return nil
+	})
+	if err != nil && err != errBadChange && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(l.segmentPath(last), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), valid
+	return l, nil
+}
+
+func (l *changeLog) segmentPath(first uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d.log", first))
+}
+
+// segments returns the first sequence of every segment, in order
+func (l *changeLog) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		var first uint64
+		if _, err := fmt.Sscanf(entry.Name(), "%020d.log", &first); err != nil || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// rotate starts a new segment whose first record is first
+func (l *changeLog) rotate(first uint64) error {
+	if l.f != nil {
+		if err := l.w.Flush(); err != nil {
+			return err
+		}
+		if err := l.f.Sync(); err != nil {
+			return err
+		}
+		if err := l.f.Close(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(l.segmentPath(first), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), 0
+	return nil
+}
+
+// append records batch and returns its sequence
+func (l *changeLog) append(batch *leveldb.Batch) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size >= changeLogSegmentSize {
+		if err := l.rotate(l.lastSeq + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := l.lastSeq + 1
+	record := encodeChange(&change{seq: seq, time: time.Now(), batch: batch})
+	if _, err := l.w.Write(record); err != nil {
+		return 0, err
+	}
+	if err := l.w.Flush(); err != nil {
+		return 0, err
+	}
+	if l.syncEvery {
+		if err := l.f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	l.size += int64(len(record))
+	l.lastSeq = seq
+	return seq, nil
+}
+
+// abortOnError records the change seq as aborted when err, the error of its
+// write, is not nil. It returns err
+func (l *changeLog) abortOnError(seq uint64, err error) error {
+	if err == nil {
+		return nil
+	}
+	if abortErr := l.abort(seq); abortErr != nil {
+		log.Printf("[catch me] error while record aborted change %d in %s: %s", seq, l.dir, abortErr.Error())
+	}
+	return err
+}
+
+// abort records the change seq as not applied
+func (l *changeLog) abort(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(l.dir, changeLogAbortedFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatUint(seq, 10) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readAborted returns the aborted changes of the change log at dir, a line
+// torn by a crash is ignored
+func readAborted(dir string) (map[uint64]bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, changeLogAbortedFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	aborted := map[uint64]bool{}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if seq, err := strconv.ParseUint(line, 10, 64); err == nil {
+			aborted[seq] = true
+		}
+	}
+	return aborted, nil
+}
+
+// sync writes the recorded changes through to disk
+func (l *changeLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *changeLog) appendPut(key, value []byte) (uint64, error) {
+	batch := &leveldb.Batch{}
+	batch.Put(key, value)
+	return l.append(batch)
+}
+
+func (l *changeLog) appendDelete(key []byte) (uint64, error) {
+	batch := &leveldb.Batch{}
+	batch.Delete(key)
+	return l.append(batch)
+}
+
+// last returns the sequence of the last recorded change
+func (l *changeLog) last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSeq
+}
+
+// first returns the sequence of the oldest change still in the log
+func (l *changeLog) first() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments, err := l.segments()
+	if err != nil || len(segments) == 0 {
+		return l.lastSeq + 1
+	}
+	return segments[0]
+}
+
+// replay calls fn for every change with a sequence in [from, to], in order. A
+// zero to replays up to the last change
+func (l *changeLog) replay(from, to uint64, fn func(c *change) error) error {
+	l.mu.Lock()
+	err := l.w.Flush()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return replayChangeDir(l.dir, from, to, fn)
+}
+
+// replayChangeDir reads the change log at dir like changeLog.replay without
+// opening it for writing, so it can follow the log of a running engine. An
+// aborted change is replayed with an empty batch
+func replayChangeDir(dir string, from, to uint64, fn func(c *change) error) error {
+	l := &changeLog{dir: dir}
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	aborted, err := readAborted(dir)
+	if err != nil {
+		return err
+	}
+	errStop := errors.New("stop")
+	for i, first := range segments {
+		if to != 0 && first > to {
+			break
+		}
+		if i+1 < len(segments) && segments[i+1] <= from {
+			continue
+		}
+
+		err := readChangeFile(l.segmentPath(first), func(c *change, end int64) error {
+			if to != 0 && c.seq > to {
+				return errStop
+			}
+			if c.seq < from {
+				return nil
+			}
+			if aborted[c.seq] {
+				c.batch = &leveldb.Batch{}
+			}
+			return fn(c)
+		})
+		if err == errStop {
+			return nil
+		}
+		// the last segment may end with a record being written
+		if err == io.ErrUnexpectedEOF && i == len(segments)-1 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate removes the segments holding only changes before seq
+func (l *changeLog) truncate(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for ; removed+1 < len(segments) && segments[removed+1] <= seq; removed++ {
+		if err := os.Remove(l.segmentPath(segments[removed])); err != nil {
+			return err
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+
+	// drop the aborted changes of the removed segments
+	aborted, err := readAborted(l.dir)
+	if err != nil || len(aborted) == 0 {
+		return err
+	}
+	var kept []uint64
+	for abortedSeq := range aborted {
+		if abortedSeq >= segments[removed] {
+			kept = append(kept, abortedSeq)
+		}
+	}
+	if len(kept) == len(aborted) {
+		return nil
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+	var data []byte
+	for _, abortedSeq := range kept {
+		data = append(strconv.AppendUint(data, abortedSeq, 10), '\n')
+	}
+	path := filepath.Join(l.dir, changeLogAbortedFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (l *changeLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+func encodeChange(c *change) []byte {
+	data := c.batch.Dump()
+	record := make([]byte, changeLogHeaderSize+2*binary.MaxVarintLen64+len(data))
+	n := changeLogHeaderSize
+	n += binary.PutUvarint(record[n:], c.seq)
+	n += binary.PutVarint(record[n:], c.time.UnixNano())
+	n += copy(record[n:], data)
+
+	binary.LittleEndian.PutUint32(record[0:], uint32(n-changeLogHeaderSize))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(record[changeLogHeaderSize:n], crcTable))
+	return record[:n]
+}
+
+func decodeChange(payload []byte) (*change, error) {
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, errBadChange
+	}
+	nanos, m := binary.Varint(payload[n:])
+	if m <= 0 {
+		return nil, errBadChange
+	}
+
+	batch := &leveldb.Batch{}
+	if err := batch.Load(payload[n+m:]); err != nil {
+		return nil, errBadChange
+	}
+	return &change{seq: seq, time: time.Unix(0, nanos), batch: batch}, nil
+}
+
+// readChangeFile calls fn for every record of the change file at path with the
+// offset where the record ends. It returns io.ErrUnexpectedEOF on a truncated
+// record and errBadChange on a checksum mismatch
+func readChangeFile(path string, fn func(c *change, end int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readChanges(f, fn)
+}
+
+func readChanges(r io.Reader, fn func(c *change, end int64) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, changeLogHeaderSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return io.ErrUnexpectedEOF
+		}
+		length := binary.LittleEndian.Uint32(header[0:])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			return errBadChange
+		}
+
+		c, err := decodeChange(payload)
+		if err != nil {
+			return err
+		}
+		offset += changeLogHeaderSize + int64(length)
+		if err := fn(c, offset); err != nil {
+			return err
+		}
+	}
+}
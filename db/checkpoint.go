@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkpoint creates dst as a checkpoint of the closed LevelDB folder src.
+// Table files are immutable once written so they are hard-linked, consecutive
+// checkpoints then share every table that was not compacted away in between.
+// MANIFEST, CURRENT and the journal keep changing and are copied. Linking
+// falls back to copying, e.g. when dst is on another filesystem.
+func checkpoint(ctx context.Context, src, dst string, p *backupProgress) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	linked, copied := 0, 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == "LOCK" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		srcFile := filepath.Join(src, name)
+		dstFile := filepath.Join(dst, name)
+		if isTableFile(name) {
+			if err := os.Link(srcFile, dstFile); err == nil {
+				if info, err := entry.Info(); err == nil {
+					p.addBytes(int(info.Size()))
+				}
+				p.addFile()
+				linked++
+				continue
+			}
+		}
+		if err := copyFile(ctx, srcFile, dstFile, p); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	// a read-only open needs the lock file to exist
+	if err := os.WriteFile(filepath.Join(dst, "LOCK"), nil, 0644); err != nil {
+		return err
+	}
+	if err := syncDir(dst); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	log.Printf("Checkpoint %s: %d files linked, %d files copied", dst, linked, copied)
+	return nil
+}
+
+func isTableFile(name string) bool {
+	return strings.HasSuffix(name, ".ldb") || strings.HasSuffix(name, ".sst")
+}
+
+// copyFile copies src to dst and syncs it, counting the bytes into p. It stops
+// once ctx is done
+func copyFile(ctx context.Context, src, dst string, p *backupProgress) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &progressReader{ctx: ctx, r: in, progress: p}); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
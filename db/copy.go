@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultCopyWorkers is the number of files a copy backup copies at once when
+// Options.CopyWorkers is zero
+const DefaultCopyWorkers = 4
+
+// SetCopyWorkers sets the number of files copied at once by copy backups,
+// DefaultCopyWorkers if n is zero
+func (c *BackupCatalog) SetCopyWorkers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copyWorkers = n
+}
+
+func (c *BackupCatalog) getCopyWorkers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.copyWorkers <= 0 {
+		return DefaultCopyWorkers
+	}
+	return c.copyWorkers
+}
+
+// copyDir copies the folder src into dst, workers files at a time, counting
+// them into p and pacing them to its rate limit. Every file and folder written
+// is synced before copyDir returns, so a backup committed afterwards survives
+// a crash. It stops at the first error or once ctx is done
+func copyDir(ctx context.Context, src, dst string, workers int, p *backupProgress) error {
+	var dirs, files []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, rel)
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		case info.Mode().IsRegular():
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan string)
+	// the first error is the one that stopped the other workers
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				if err := copyFile(copyCtx, filepath.Join(src, rel), filepath.Join(dst, rel), p); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for _, rel := range files {
+		select {
+		case jobs <- rel:
+		case <-copyCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// deepest first, then the entry of dst in its parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := syncDir(filepath.Join(dst, dirs[i])); err != nil {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncDir flushes the entries of the folder dir to disk
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// DefaultGroupCommitOps, DefaultGroupCommitBytes and DefaultGroupCommitDelay
+// bound a group commit when the fields of GroupCommit are zero
+const (
+	DefaultGroupCommitOps   = 256
+	DefaultGroupCommitBytes = 1 << 20
+	DefaultGroupCommitDelay = time.Millisecond
+)
+
+// GroupCommit bounds the Put and Delete calls the LevelDBManager coalesces
+// into one write. While a group is written the next calls join the next
+// group, written once the first is done and every Put and Delete call in
+// progress joined it, or once it is full or waited MaxDelay. A call is
+// answered once the write of its group is done
+type GroupCommit struct {
+	// MaxOps and MaxBytes, of keys and values, close a group once reached.
+	// MaxOps 1 writes every call on its own
+	MaxOps   int
+	MaxBytes int
+	// MaxDelay is how long a group waits for more calls,
+	// DefaultGroupCommitDelay if zero
+	MaxDelay time.Duration
+}
+
+func (g GroupCommit) maxOps() int {
+	if g.MaxOps <= 0 {
+		return DefaultGroupCommitOps
+	}
+	return g.MaxOps
+}
+
+func (g GroupCommit) maxBytes() int {
+	if g.MaxBytes <= 0 {
+		return DefaultGroupCommitBytes
+	}
+	return g.MaxBytes
+}
+
+func (g GroupCommit) maxDelay() time.Duration {
+	if g.MaxDelay <= 0 {
+		return DefaultGroupCommitDelay
+	}
+	return g.MaxDelay
+}
+
+// GroupCommitStats counts the writes of the Put and Delete calls, Ops/Groups
+// is the mean size of a group
+type GroupCommitStats struct {
+	Groups int64
+	Ops    int64
+}
+
+// writeGroup is the Put and Delete requests coalesced into one write
+type writeGroup struct {
+	requests []Message
+	bytes    int
+	full     bool
+	timer    *time.Timer
+}
+
+// committer groups the Put and Delete requests of the message loop, only the
+// loop uses it but for stats
+type committer struct {
+	limits GroupCommit
+	group  *writeGroup
+	// writing is closed once the last group written is done
+	writing chan struct{}
+	// callers counts the Put and Delete calls in progress, the ones just
+	// answered included: a caller writing in a loop sends its next call
+	// right after
+	callers int64
+	stats   GroupCommitStats
+}
+
+func newCommitter(limits GroupCommit) *committer {
+	writing := make(chan struct{})
+	close(writing)
+	return &committer{limits: limits, writing: writing}
+}
+
+// add puts request into the open group
+func (c *committer) add(request Message) {
+	if c.group == nil {
+		c.group = &writeGroup{}
+	}
+	group := c.group
+	group.requests = append(group.requests, request)
+	group.bytes += len(request.key) + len(request.value)
+	group.full = len(group.requests) >= c.limits.maxOps() || group.bytes >= c.limits.maxBytes()
+	if group.timer == nil && !group.full {
+		group.timer = time.NewTimer(c.limits.maxDelay())
+	}
+}
+
+// enter and exit bracket a Put or Delete call
+func (c *committer) enter() {
+	atomic.AddInt64(&c.callers, 1)
+}
+
+func (c *committer) exit() {
+	atomic.AddInt64(&c.callers, -1)
+}
+
+// receive returns the next message of the loop. While a group is open it
+// returns false once the group is to be written: it is full, the write before
+// it is done and no other call is in progress, or the delay of the group is
+// over
+func (c *committer) receive(msgQueue <-chan Message) (Message, bool) {
+	if c.group == nil {
+		return <-msgQueue, true
+	}
+	if c.group.full {
+		return Message{}, false
+	}
+	// the calls already waiting join the group first
+	select {
+	case msg := <-msgQueue:
+		return msg, true
+	default:
+	}
+	writing := c.writing
+	if int64(len(c.group.requests)) < atomic.LoadInt64(&c.callers) {
+		writing = nil
+	}
+	select {
+	case msg := <-msgQueue:
+		return msg, true
+	case <-writing:
+	case <-c.group.timer.C:
+	}
+	return Message{}, false
+}
+
+// commit writes the open group to db in the background, then answers its
+// requests with answer
+func (c *committer) commit(db *levelDBWrapper, answer func(request Message, err error)) {
+	group := c.group
+	if group == nil {
+		return
+	}
+	c.group = nil
+	if group.timer != nil {
+		group.timer.Stop()
+	}
+	atomic.AddInt64(&c.stats.Groups, 1)
+	atomic.AddInt64(&c.stats.Ops, int64(len(group.requests)))
+
+	writing := make(chan struct{})
+	c.writing = writing
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		defer close(writing)
+		err := db.writeGroup(group.requests)
+		for _, request := range group.requests {
+			answer(request, err)
+		}
+	}()
+}
+
+func (c *committer) getStats() GroupCommitStats {
+	return GroupCommitStats{
+		Groups: atomic.LoadInt64(&c.stats.Groups),
+		Ops:    atomic.LoadInt64(&c.stats.Ops),
+	}
+}
+
+// writeGroup applies the Put and Delete requests with one write
+func (dw *levelDBWrapper) writeGroup(requests []Message) error {
+	dw.writeMu.RLock()
+	defer dw.writeMu.RUnlock()
+
+	batch := &leveldb.Batch{}
+	keys := make([][]byte, 0, len(requests))
+	for _, request := range requests {
+		key := []byte(request.key)
+		keys = append(keys, key)
+		if request.action == MsgPut {
+			batch.Put(key, dw.putValue(request.value))
+		} else if value := dw.deleteValue(); value != nil {
+			batch.Put(key, value)
+		} else {
+			batch.Delete(key)
+		}
+	}
+	if err := dw.db.Write(batch, wo); err != nil {
+		return err
+	}
+	return dw.dropPending(keys...)
+}
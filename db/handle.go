@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ReadWaitStats counts the reads that waited for mainDB to be reopened by a
+// backup and how long they waited
+type ReadWaitStats struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean is the average wait of a read that waited
+func (s ReadWaitStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+func (s ReadWaitStats) add(o ReadWaitStats) ReadWaitStats {
+	s.Count += o.Count
+	s.Total += o.Total
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	return s
+}
+
+// dbHandle hands a DB out to the readers while a backup may close and reopen
+// it. A reader holds a reference from acquire to release, an iterator until it
+// is released. suspend waits for the references to be released before the DB
+// is closed and acquire waits for the DB to be set again, so a read never sees
+// a closed DB. The zero value has no DB yet
+type dbHandle struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	db   *leveldb.DB
+	refs int
+	// shut is set once the DB is closed for good
+	shut  bool
+	waits ReadWaitStats
+}
+
+func (h *dbHandle) lock() {
+	h.mu.Lock()
+	if h.cond == nil {
+		h.cond = sync.NewCond(&h.mu)
+	}
+}
+
+// set hands db out to the readers, the waiting ones included
+func (h *dbHandle) set(db *leveldb.DB) {
+	h.lock()
+	h.db = db
+	h.shut = false
+	h.cond.Broadcast()
+	h.mu.Unlock()
+}
+
+// acquire returns the DB and keeps it open until release. It waits while the
+// DB is suspended, leveldb.ErrClosed once it is shut
+func (h *dbHandle) acquire() (*leveldb.DB, error) {
+	h.lock()
+	defer h.mu.Unlock()
+
+	var start time.Time
+	for h.db == nil && !h.shut {
+		if start.IsZero() {
+			start = time.Now()
+		}
+		h.cond.Wait()
+	}
+	if !start.IsZero() {
+		wait := time.Since(start)
+		h.waits.Count++
+		h.waits.Total += wait
+		if wait > h.waits.Max {
+			h.waits.Max = wait
+		}
+	}
+	if h.db == nil {
+		return nil, leveldb.ErrClosed
+	}
+	h.refs++
+	return h.db, nil
+}
+
+func (h *dbHandle) release() {
+	h.lock()
+	if h.refs--; h.refs == 0 {
+		h.cond.Broadcast()
+	}
+	h.mu.Unlock()
+}
+
+// suspend takes the DB away from the readers once the ones holding it are
+// done, new readers wait until it is set again. If ctx is done first the
+// readers get the DB back and suspend returns the error of ctx
+func (h *dbHandle) suspend(ctx context.Context) (*leveldb.DB, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.lock()
+			h.cond.Broadcast()
+			h.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	h.lock()
+	defer h.mu.Unlock()
+	db := h.db
+	h.db = nil
+	for h.refs > 0 && ctx.Err() == nil {
+		h.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		h.db = db
+		h.cond.Broadcast()
+		return nil, err
+	}
+	return db, nil
+}
+
+// ErrReadDrain fails a closed backup whose reads and iterators still hold
+// mainDB after StateTimeouts.ReadDrain, e.g. a leaked iterator
+var ErrReadDrain = errors.New("db: readers still hold mainDB")
+
+// drain is suspend waiting at most timeout for the readers, ErrReadDrain once
+// it is over
+func (h *dbHandle) drain(ctx context.Context, timeout time.Duration) (*leveldb.DB, error) {
+	drainCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	db, err := h.suspend(drainCtx)
+	if err != nil && ctx.Err() == nil {
+		return nil, ErrReadDrain
+	}
+	return db, err
+}
+
+// close takes the DB away for good, the waiting readers fail with
+// leveldb.ErrClosed. It doesn't wait for the references: a read racing the
+// close of the engine fails like one coming after it
+func (h *dbHandle) close() *leveldb.DB {
+	h.lock()
+	defer h.mu.Unlock()
+	db := h.db
+	h.db = nil
+	h.shut = true
+	h.cond.Broadcast()
+	return db
+}
+
+// newIterator iterates over slice of the DB, which stays open until the
+// iterator is released
+func (h *dbHandle) newIterator(slice *util.Range) iterator.Iterator {
+	db, err := h.acquire()
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	iter := db.NewIterator(slice, nil)
+	iter.SetReleaser(releaseFunc(h.release))
+	return iter
+}
+
+// readWaits returns the waits of the readers so far
+func (h *dbHandle) readWaits() ReadWaitStats {
+	h.lock()
+	defer h.mu.Unlock()
+	return h.waits
+}
+
+// releaseFunc is a util.Releaser calling itself
+type releaseFunc func()
+
+func (f releaseFunc) Release() {
+	f()
+}
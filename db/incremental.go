@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// changesFileName holds the changes of a BackupIncremental backup, in the
+// change log record format
+const changesFileName = "changes.log"
+
+var ErrSeqNotCovered = errors.New("db: sequence not covered by the backup chain")
+
+// incrementalParent returns the newest backup of source the changes up to seq
+// can be chained to, nil when a full backup is needed
+func incrementalParent(catalog *BackupCatalog, changes *changeLog, source string, seq uint64) (*BackupManifest, error) {
+	manifests, err := catalog.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(manifests) - 1; i >= 0; i-- {
+		manifest := manifests[i]
+		if manifest.Source != source {
+			continue
+		}
+		// a backup older than the change log start or recorded without a
+		// sequence can't be chained
+		if manifest.Seq == 0 || manifest.Seq > seq || changes.first() > manifest.Seq+1 {
+			return nil, nil
+		}
+		return manifest, nil
+	}
+	return nil, nil
+}
+
+// backupIncremental stores the changes of source logged up to seq as an
+// increment of its newest backup. It returns false when there is no backup to
+// chain to and a full backup must be taken instead. The manifest is nil when
+// no change was logged since the previous backup. The backup is tracked by run
+func backupIncremental(run *backupRun, catalog *BackupCatalog, changes *changeLog, source, engine string, seq uint64) (*BackupManifest, bool, error) {
+	parent, err := incrementalParent(catalog, changes, source, seq)
+	if err != nil || parent == nil {
+		return nil, false, err
+	}
+	if parent.Seq == seq {
+		log.Printf("No change since backup %s, skip incremental backup", parent.ID)
+		return nil, true, nil
+	}
+
+	b, err := catalog.begin(source, engine, BackupIncremental)
+	if err != nil {
+		return nil, true, err
+	}
+	run.track(b)
+	b.manifest.Parent = parent.ID
+	b.manifest.FromSeq = parent.Seq + 1
+	b.manifest.Seq = seq
+
+	count, err := b.writeChanges(changes, b.manifest.FromSeq, seq)
+	if err != nil {
+		b.abort()
+		return nil, true, err
+	}
+	b.manifest.Changes = count
+	manifest, err := b.commit(0)
+	if err != nil {
+		b.abort()
+		return nil, true, err
+	}
+	log.Printf("Incremental backup %s of %d changes [%d, %d]", manifest.ID, count, manifest.FromSeq, seq)
+	return manifest, true, nil
+}
+
+// writeChanges copies the changes in [from, to] into a new file at dst
+func writeChanges(ctx context.Context, changes *changeLog, from, to uint64, dst string, p *backupProgress) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	next := from
+	err = changes.replay(from, to, func(c *change) error {
+		record := encodeChange(c)
+		if err := p.wait(ctx, len(record)); err != nil {
+			return err
+		}
+		if c.seq != next {
+			return fmt.Errorf("change log misses sequence %d", next)
+		}
+		next++
+		count++
+		p.addRecord(len(record))
+		_, err := f.Write(record)
+		return err
+	})
+	if err == nil && next != to+1 {
+		err = fmt.Errorf("change log misses sequence %d", next)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
+
+// truncateChangeLog drops the changes no backup of source can be chained to
+// anymore, the oldest backup keeps the changes logged after it
+func truncateChangeLog(catalog *BackupCatalog, changes *changeLog, source string) {
+	manifests, err := catalog.List()
+	if err != nil {
+		log.Printf("[catch me] error while list backups in %s: %s", catalog.Root(), err.Error())
+		return
+	}
+
+	for _, manifest := range manifests {
+		if manifest.Source != source || manifest.Seq == 0 {
+			continue
+		}
+		if err := changes.truncate(manifest.Seq + 1); err != nil {
+			log.Printf("[catch me] error while truncate change log %s: %s", changes.dir, err.Error())
+		}
+		return
+	}
+}
+
+// chain returns the backups to restore for manifest, the full backup first
+func (c *BackupCatalog) chain(manifest *BackupManifest) ([]*BackupManifest, error) {
+	chain := []*BackupManifest{manifest}
+	for manifest.Mode == BackupIncremental {
+		parent, err := c.Get(manifest.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("parent %s of backup %s: %w", manifest.Parent, manifest.ID, err)
+		}
+		chain = append([]*BackupManifest{parent}, chain...)
+		manifest = parent
+	}
+	return chain, nil
+}
+
+// replayChanges applies the changes of the incremental backups up to seq, a
+// zero seq applies all of them, to the LevelDB at dst
+func (c *BackupCatalog) replayChanges(increments []*BackupManifest, seq uint64, dst string) error {
+	restoreDB, err := leveldb.OpenFile(dst, nil)
+	if err != nil {
+		return err
+	}
+	policies := c.getMergePolicies()
+
+	errStop := errors.New("stop")
+	for _, manifest := range increments {
+		if seq != 0 && manifest.FromSeq > seq {
+			break
+		}
+		err = c.withData(manifest, func(dataPath string) error {
+			return readChangeFile(filepath.Join(dataPath, changesFileName), func(ch *change, end int64) error {
+				if seq != 0 && ch.seq > seq {
+					return errStop
+				}
+				return replayChange(restoreDB, ch.batch, policies)
+			})
+		})
+		if err == errStop {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := restoreDB.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// afterBackup uploads backup id to the targets, then prunes the catalog and
+// the change log once a backup of source is committed. id is empty when no
+// backup was written, changes is nil when the engine has no change log
+func afterBackup(catalog *BackupCatalog, policy *RetentionPolicy, changes *changeLog, source, id string) {
+	if id != "" {
+		catalog.replicate(id)
+	}
+	applyRetention(catalog, policy)
+	if changes != nil {
+		truncateChangeLog(catalog, changes, source)
+	}
+}
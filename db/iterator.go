@@ -0,0 +1,292 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	dirSOI = iota // before the first key
+	dirEOI        // after the last key
+	dirForward
+	dirBackward
+)
+
+// overlayIterator iterates over tempDB and mainDB in key order. When a key
+// exists in both, its tempDB record and mainDB value are resolved by the
+// policy of the key, by default the tempDB record shadows the mainDB value and
+// a tempDB tombstone hides the key.
+type overlayIterator struct {
+	util.BasicReleaser
+
+	temp     iterator.Iterator // yields tempDB records
+	main     iterator.Iterator
+	policies MergePolicies
+	// versioned is set when main yields versioned values
+	versioned bool
+
+	dir   int
+	key   []byte
+	value []byte
+	err   error
+}
+
+// newOverlayIterator iterates over slice of tempDB and mainDB. The tempDB
+// iterator must be created before the mainDB one so that a record moved by a
+// concurrent merge is seen by at least one of them.
+func newOverlayIterator(temp, main iterator.Iterator, policies MergePolicies, versioned bool) iterator.Iterator {
+	return &overlayIterator{
+		temp:      temp,
+		main:      main,
+		policies:  policies,
+		versioned: versioned,
+		dir:       dirSOI,
+	}
+}
+
+func (i *overlayIterator) First() bool {
+	if i.Released() {
+		i.err = iterator.ErrIterReleased
+		return false
+	}
+
+	i.temp.First()
+	i.main.First()
+	i.dir = dirForward
+	return i.findNext()
+}
+
+func (i *overlayIterator) Last() bool {
+	if i.Released() {
+		i.err = iterator.ErrIterReleased
+		return false
+	}
+
+	i.temp.Last()
+	i.main.Last()
+	i.dir = dirBackward
+	return i.findPrev()
+}
+
+func (i *overlayIterator) Seek(key []byte) bool {
+	if i.Released() {
+		i.err = iterator.ErrIterReleased
+		return false
+	}
+
+	i.temp.Seek(key)
+	i.main.Seek(key)
+	i.dir = dirForward
+	return i.findNext()
+}
+
+func (i *overlayIterator) Next() bool {
+	if i.Released() {
+		i.err = iterator.ErrIterReleased
+		return false
+	}
+
+	switch i.dir {
+	case dirEOI:
+		return false
+	case dirSOI:
+		return i.First()
+	case dirBackward:
+		// move both children past the current key
+		key := i.key
+		i.temp.Seek(key)
+		i.main.Seek(key)
+		i.dir = dirForward
+	}
+
+	i.skipForward(i.temp, i.key)
+	i.skipForward(i.main, i.key)
+	return i.findNext()
+}
+
+func (i *overlayIterator) Prev() bool {
+	if i.Released() {
+		i.err = iterator.ErrIterReleased
+		return false
+	}
+
+	switch i.dir {
+	case dirSOI:
+		return false
+	case dirEOI:
+		return i.Last()
+	case dirForward:
+		// move both children before the current key
+		key := i.key
+		i.seekBefore(i.temp, key)
+		i.seekBefore(i.main, key)
+		i.dir = dirBackward
+		return i.findPrev()
+	}
+
+	i.skipBackward(i.temp, i.key)
+	i.skipBackward(i.main, i.key)
+	return i.findPrev()
+}
+
+func (i *overlayIterator) skipForward(iter iterator.Iterator, key []byte) {
+	if iter.Valid() && bytes.Equal(iter.Key(), key) {
+		iter.Next()
+	}
+}
+
+func (i *overlayIterator) skipBackward(iter iterator.Iterator, key []byte) {
+	if iter.Valid() && bytes.Equal(iter.Key(), key) {
+		iter.Prev()
+	}
+}
+
+func (i *overlayIterator) seekBefore(iter iterator.Iterator, key []byte) {
+	if iter.Seek(key) {
+		iter.Prev()
+	} else {
+		iter.Last()
+	}
+}
+
+// findNext positions the iterator on the smallest visible key at or after the
+// children positions
+func (i *overlayIterator) findNext() bool {
+	for {
+		key, ok := i.pick(-1)
+		if !ok {
+			return i.done(dirEOI)
+		}
+		// children may reuse the key buffer once moved
+		key = append(i.key[:0], key...)
+		if i.visit(key) {
+			return true
+		}
+		if i.err != nil {
+			return i.done(dirEOI)
+		}
+		i.skipForward(i.temp, key)
+		i.skipForward(i.main, key)
+	}
+}
+
+// findPrev positions the iterator on the greatest visible key at or before
+// the children positions
+func (i *overlayIterator) findPrev() bool {
+	for {
+		key, ok := i.pick(1)
+		if !ok {
+			return i.done(dirSOI)
+		}
+		// children may reuse the key buffer once moved
+		key = append(i.key[:0], key...)
+		if i.visit(key) {
+			return true
+		}
+		if i.err != nil {
+			return i.done(dirSOI)
+		}
+		i.skipBackward(i.temp, key)
+		i.skipBackward(i.main, key)
+	}
+}
+
+// pick returns the smallest (order -1) or greatest (order 1) key the children
+// are positioned on
+func (i *overlayIterator) pick(order int) ([]byte, bool) {
+	tempOK, mainOK := i.temp.Valid(), i.main.Valid()
+	switch {
+	case tempOK && mainOK:
+		if bytes.Compare(i.temp.Key(), i.main.Key())*order >= 0 {
+			return i.temp.Key(), true
+		}
+		return i.main.Key(), true
+	case tempOK:
+		return i.temp.Key(), true
+	case mainOK:
+		return i.main.Key(), true
+	}
+	return nil, false
+}
+
+// visit resolves key between the children positioned on it, it returns false
+// when the key resolves to a tombstone
+func (i *overlayIterator) visit(key []byte) bool {
+	var temp *record
+	var main *envelope
+	if i.temp.Valid() && bytes.Equal(i.temp.Key(), key) {
+		r := decodeRecord(i.temp.Value())
+		temp = &r
+	}
+	if i.main.Valid() && bytes.Equal(i.main.Key(), key) {
+		e := decodeEnvelope(i.main.Value(), i.versioned)
+		main = &e
+	}
+
+	value, err := i.policies.resolve(key, temp, main)
+	if err == leveldb.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		i.err = err
+		return false
+	}
+	return i.set(key, value)
+}
+
+func (i *overlayIterator) set(key, value []byte) bool {
+	i.key = key
+	i.value = value
+	return true
+}
+
+func (i *overlayIterator) done(dir int) bool {
+	i.dir = dir
+	i.key = nil
+	i.value = nil
+	if i.err == nil {
+		if err := i.temp.Error(); err != nil {
+			i.err = err
+		} else if err := i.main.Error(); err != nil {
+			i.err = err
+		}
+	}
+	return false
+}
+
+func (i *overlayIterator) Valid() bool {
+	return (i.dir == dirForward || i.dir == dirBackward) && !i.Released()
+}
+
+func (i *overlayIterator) Key() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.key
+}
+
+func (i *overlayIterator) Value() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.value
+}
+
+func (i *overlayIterator) Error() error {
+	return i.err
+}
+
+func (i *overlayIterator) Release() {
+	if i.Released() {
+		return
+	}
+
+	i.temp.Release()
+	i.main.Release()
+	i.key = nil
+	i.value = nil
+	i.BasicReleaser.Release()
+}
@@ -1,14 +1,14 @@
 package db
 
 import (
-	"fmt"
-	"leveldblab/config"
+	"context"
+	"errors"
 	"log"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	cp "github.com/otiai10/copy"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -17,50 +17,134 @@ import (
 var (
 	requestKey      = "REQ"
 	batchRequestKey = "BATCHREQ"
-	dbRootFolder    = ""
-	dbFilePath      = ""
 )
 
 type DBRepo struct {
+	rootFolder string
+	dbFilePath string
+
 	mainDB *leveldb.DB
 	tempDB *leveldb.DB
-
-	onMerging bool
-	onBackUp  bool
+	// mainReaders hands mainDB out to the readers, a backup closes it once
+	// they are done and they wait for the reopen
+	mainReaders dbHandle
+
+	// state routes the writes: to tempDB while backing up, to mainDB
+	// otherwise. mainDB is closed and reopened under the Mutex while backing up
+	state    *stateMachine
+	timeouts StateTimeouts
+
+	// versioned wraps mainDB values in an envelope carrying their version
+	versioned  bool
+	backupMode string
+	catalog    *BackupCatalog
+	retention  *RetentionPolicy
+	// mainWriteMu is held shared by mainDB writes and exclusively by the merge,
+	// tempWriteMu likewise for tempDB. Both are held exclusively to combine a
+	// merge operand into a value
+	mainWriteMu sync.RWMutex
+	tempWriteMu sync.RWMutex
+	policies    MergePolicies
+
+	// changes is nil without Options.ChangeLog. logMu is held shared while a
+	// change is logged and applied, exclusively to read the sequence a backup
+	// starts at
+	changes *changeLog
+	logMu   sync.RWMutex
+	verify  bool
+
+	schedule *scheduler
+	backups  backupControl
+	// mergeRate paces the merges of tempDB into mainDB
+	mergeRate *throttle
+	lastMerge atomic.Pointer[MergeReport]
+
+	quit chan struct{}
+	done chan struct{}
 
 	sync.Mutex
 }
 
 func NewDBRepository(rootFolder, dbFolder string) *DBRepo {
-	dbRootFolder = rootFolder
-	dbFilePath = path.Join(dbRootFolder, dbFolder)
+	return NewDBRepositoryWithOptions(rootFolder, dbFolder, nil)
+}
+
+func NewDBRepositoryWithOptions(rootFolder, dbFolder string, o *Options) *DBRepo {
+	dbFilePath := path.Join(rootFolder, dbFolder)
 	log.Printf("NewDBRepository db path: %s", dbFilePath)
+	if !validBackupMode(o.GetBackupMode()) {
+		log.Fatalf("Unknown backup mode %s", o.GetBackupMode())
+	}
+	schedule, err := newScheduler(o.GetSchedule())
+	if err != nil {
+		log.Fatalf("Invalid backup schedule: %s", err.Error())
+	}
+	catalog, err := NewBackupCatalog(o.GetBackupRoot())
+	if err != nil {
+		log.Fatalf("Error create backup catalog %s: %s", o.GetBackupRoot(), err.Error())
+	}
+	catalog.SetArchive(o.GetArchive())
+	catalog.SetTargets(o.GetTargets())
+	catalog.SetCopyWorkers(o.GetCopyWorkers())
+	catalog.SetMergePolicies(o.GetMergePolicies())
+	var changes *changeLog
+	if o.GetChangeLog() {
+		if changes, err = openChangeLog(rootFolder+"/changelog", o.GetChangeLogSync()); err != nil {
+			log.Fatalf("Error open change log %s: %s", rootFolder+"/changelog", err.Error())
+		}
+	}
 
-	dbRepo := &DBRepo{}
-	dbRepo.openMainDB()
+	dbRepo := &DBRepo{
+		rootFolder: rootFolder,
+		dbFilePath: dbFilePath,
+		versioned:  o.GetVersioned(),
+		backupMode: o.GetBackupMode(),
+		catalog:    catalog,
+		retention:  o.GetRetention(),
+		changes:    changes,
+		verify:     o.GetVerifyBackups(),
+		schedule:   schedule,
+		backups:    backupControl{limit: newThrottle(o.GetBackupRate())},
+		mergeRate:  newThrottle(o.GetMergeRate()),
+		policies:   o.GetMergePolicies(),
+		state:      newStateMachine(),
+		timeouts:   o.GetTimeouts(),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err := dbRepo.openMainDB(); err != nil {
+		log.Fatalf("Error load db folder %s: %v", dbFilePath, err)
+	}
 	dbRepo.openTempDB()
 	dbRepo.mergeTempDB()
 
-	if config.EnableBackup {
-		go func() {
-			for {
-				ticker := time.NewTicker(30 * time.Second)
-				<-ticker.C
-
-				if err := dbRepo.backupMainDB(); err != nil {
-					log.Printf("error while backupMainDB: %s", err.Error())
-					continue
-				}
-
-				// backup done => merge data
-				dbRepo.onMerging = true
-				hasError := dbRepo.mergeTempDB()
-				if !hasError {
-					dbRepo.onMerging = false
-				}
+	go func() {
+		defer close(dbRepo.done)
+		for {
+			// no backup while tempDB holds records missing from mainDB
+			if dbRepo.state.get() == StateDegraded && !retryMerge(dbRepo.quit, dbRepo.timeouts.mergeRetry(), dbRepo.mergeTempDB) {
+				return
 			}
-		}()
-	}
+			if !dbRepo.schedule.wait(dbRepo.quit) {
+				return
+			}
+			dbRepo.schedule.started()
+			run := dbRepo.backups.start(dbRepo.timeouts.Backup)
+			manifest, err := dbRepo.backupMainDB(run)
+			switch {
+			case errors.Is(err, context.Canceled):
+				log.Printf("backupMainDB cancelled")
+			case errors.Is(err, context.DeadlineExceeded):
+				log.Printf("error while backupMainDB: timed out after %s", dbRepo.timeouts.Backup)
+			case err != nil:
+				log.Printf("error while backupMainDB: %s", err.Error())
+			}
+
+			// backup done => merge data, a failed backup may have left writes in tempDB too
+			dbRepo.mergeTempDB()
+			dbRepo.backups.finish(run, manifest, err)
+		}
+	}()
 
 	return dbRepo
 }
@@ -70,17 +154,43 @@ func (p *DBRepo) openMainDB() error {
 		return nil
 	}
 
-	dbFile, err := leveldb.OpenFile(dbFilePath, nil)
+	dbFile, err := leveldb.OpenFile(p.dbFilePath, nil)
 	if err != nil {
-		log.Fatalf("Error load db folder %s: %v", dbFilePath, err)
 		return err
 	}
 	p.mainDB = dbFile
+	p.mainReaders.set(dbFile)
 	return nil
 }
 
-func (p *DBRepo) closeMainDB() error {
+// reopenMainDB opens mainDB again after a backup closed it, retrying after a
+// delay doubled after each failure. It gives up once the repo is closed
+func (p *DBRepo) reopenMainDB() error {
+	retry := p.timeouts.mergeRetry()
+	for {
+		err := p.openMainDB()
+		if err == nil {
+			return nil
+		}
+		log.Printf("error while openMainDB: %s", err.Error())
+		select {
+		case <-p.quit:
+			return err
+		case <-time.After(retry):
+		}
+		retry = nextMergeRetry(retry)
+	}
+}
+
+// closeMainDB closes mainDB once the reads and iterators holding it are done,
+// it fails without closing mainDB once ctx is done or they are not done after
+// StateTimeouts.ReadDrain
+func (p *DBRepo) closeMainDB(ctx context.Context) error {
+	if _, err := p.mainReaders.drain(ctx, p.timeouts.readDrain()); err != nil {
+		return err
+	}
 	if err := p.mainDB.Close(); err != nil {
+		p.mainReaders.set(p.mainDB)
 		return err
 	}
 	p.mainDB = nil
@@ -93,9 +203,9 @@ func (p *DBRepo) openTempDB() {
 		return
 	}
 
-	dbFile, err := leveldb.OpenFile(dbRootFolder+"/temp", nil)
+	dbFile, err := openTempDB(p.rootFolder + "/temp")
 	if err != nil {
-		log.Fatalf("Error load db folder %s: %s", dbFilePath, err.Error())
+		log.Fatalf("Error load db folder %s: %s", p.dbFilePath, err.Error())
 	}
 	p.tempDB = dbFile
 }
@@ -113,137 +223,536 @@ func (p *DBRepo) openTempDB() {
 // 	return nil
 // }
 
-func (p *DBRepo) backupMainDB() error {
+// backupMainDB backs up mainDB as tracked by run, the manifest is nil when an
+// incremental backup finds no change
+func (p *DBRepo) backupMainDB(run *backupRun) (*BackupManifest, error) {
 	start := time.Now()
 	defer func(start time.Time) {
 		log.Printf("Backup done after %dms\n", time.Since(start).Milliseconds())
 	}(start)
 
+	if isOnlineBackup(p.backupMode) {
+		return p.backupSnapshot(run)
+	}
+
+	b, err := p.catalog.begin(p.dbFilePath, EngineRepo, p.backupMode)
+	if err != nil {
+		return nil, err
+	}
+	run.track(b)
+	snap, err := p.backupClosed(b)
+	if err != nil {
+		b.abort()
+		return nil, err
+	}
+	if snap != nil {
+		defer snap.Release()
+	}
+
+	if _, err := b.commit(-1); err != nil {
+		log.Printf("error while write manifest: %s", err.Error())
+		b.abort()
+		return nil, err
+	}
+	if snap != nil {
+		verifyBackup(p.catalog, b.manifest.ID, snap)
+	}
+	afterBackup(p.catalog, p.retention, p.changes, p.dbFilePath, b.manifest.ID)
+	return b.manifest, nil
+}
+
+// backupClosed closes mainDB, writes it into b and reopens it, also when the
+// backup fails. With Options.VerifyBackups it returns a snapshot of the backed
+// up state
+func (p *DBRepo) backupClosed(b *pendingBackup) (*leveldb.Snapshot, error) {
 	p.Lock()
 	defer p.Unlock()
 
-	p.onBackUp = true
-	backupName := fmt.Sprintf("./backup-%d/%s", time.Now().Nanosecond(), dbFilePath)
+	// writes logged from now on go to tempDB, the state stays backing up until
+	// the merge starts
+	p.logMu.Lock()
+	b.manifest.Seq = p.lastSeq()
+	err := p.state.transition(StateBackingUp, nil)
+	p.logMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	log.Println("Start backup, sleep for 1s before close DB", backupName)
-	time.Sleep(1 * time.Second)
-	if err := p.closeMainDB(); err != nil {
+	log.Println("Start backup", b.manifest.ID)
+	if err := p.closeMainDB(b.context()); err != nil {
 		log.Printf("error while closeMainDB: %s", err.Error())
-		return err
+		return nil, err
 	}
 	// if err := p.mainDB.SetReadOnly(); err != nil {
 	// 	log.Printf("error while SetReadOnly: %s", err.Error())
 	// 	return err
 	// }
-	if err := cp.Copy(dbFilePath, backupName); err != nil {
+	err = b.writeClosed(p.dbFilePath)
+	if err != nil && !errors.Is(err, context.Canceled) {
 		log.Printf("error while Copy: %s", err.Error())
-		return err
 	}
-	if err := p.openMainDB(); err != nil {
-		log.Printf("error while openMainDB: %s", err.Error())
-		return err
+	// the readers wait for mainDB, the merge can't start without it
+	if err := p.reopenMainDB(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	p.onBackUp = false
-	return nil
+	var snap *leveldb.Snapshot
+	if p.verify {
+		if snap, err = p.mainDB.GetSnapshot(); err != nil {
+			log.Printf("error while snapshot mainDB: %s", err.Error())
+		}
+	}
+	return snap, nil
 }
 
-func (p *DBRepo) mergeTempDB() bool {
-	start := time.Now()
-	iter := p.tempDB.NewIterator(util.BytesPrefix([]byte("")), nil)
-	defer iter.Release()
-	hasError := false
-	count := 0
-	for iter.Next() {
-		count++
-		key := iter.Key()
-		value := iter.Value()
-
-		// TODO: check on state version before overwrite data
-		if err := p.mainDB.Put(key, value, wo); err != nil {
-			hasError = true
-			continue
-		} else {
-			if err := p.tempDB.Delete(key, wo); err != nil {
-				continue
+// backupSnapshot backs up a snapshot of mainDB, reads and writes keep going to
+// mainDB meanwhile
+func (p *DBRepo) backupSnapshot(run *backupRun) (*BackupManifest, error) {
+	p.logMu.Lock()
+	seq := p.lastSeq()
+	snap, err := p.mainDB.GetSnapshot()
+	p.logMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	mode := p.backupMode
+	if mode == BackupIncremental {
+		manifest, done, err := backupIncremental(run, p.catalog, p.changes, p.dbFilePath, EngineRepo, seq)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			id := ""
+			if manifest != nil {
+				id = manifest.ID
+				if p.verify {
+					verifyBackup(p.catalog, id, nil)
+				}
 			}
+			afterBackup(p.catalog, p.retention, p.changes, p.dbFilePath, id)
+			return manifest, nil
+		}
+		// nothing to chain to yet
+		mode = BackupSnapshot
+	}
+
+	b, err := p.catalog.begin(p.dbFilePath, EngineRepo, mode)
+	if err != nil {
+		return nil, err
+	}
+	run.track(b)
+	b.manifest.Seq = seq
+	log.Printf("Start %s backup %s", mode, b.manifest.ID)
+	count, err := b.writeOnline(snap)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("error while backup snapshot: %s", err.Error())
 		}
+		b.abort()
+		return nil, err
+	}
+	log.Printf("Backup %s of %d keys", b.manifest.ID, count)
+
+	if _, err := b.commit(int64(count)); err != nil {
+		log.Printf("error while write manifest: %s", err.Error())
+		b.abort()
+		return nil, err
 	}
+	if p.verify {
+		verifyBackup(p.catalog, b.manifest.ID, snap)
+	}
+	afterBackup(p.catalog, p.retention, p.changes, p.dbFilePath, b.manifest.ID)
+	return b.manifest, nil
+}
+
+// lastSeq returns the sequence of the last logged change, zero without change
+// log. It syncs the log first, the changes held by a backup must outlive a crash
+func (p *DBRepo) lastSeq() uint64 {
+	if p.changes == nil {
+		return 0
+	}
+	if err := p.changes.sync(); err != nil {
+		log.Printf("error while sync change log: %s", err.Error())
+	}
+	return p.changes.last()
+}
+
+// TriggerBackup starts a backup now, or after the running backup and merge
+func (p *DBRepo) TriggerBackup() {
+	p.schedule.triggerNow()
+}
+
+// SetBackupRate limits the I/O of backups, the running one included
+func (p *DBRepo) SetBackupRate(limit RateLimit) {
+	p.backups.limit.set(limit)
+}
+
+// SetMergeRate limits the I/O of merges, the running one included
+func (p *DBRepo) SetMergeRate(limit RateLimit) {
+	p.mergeRate.set(limit)
+}
+
+// Backup starts a backup like TriggerBackup and waits for it and the merge
+// after it. Once ctx is done the backup stops, what it wrote is removed and
+// writes go back to mainDB. The manifest is nil when an incremental backup
+// finds no change
+func (p *DBRepo) Backup(ctx context.Context) (*BackupManifest, error) {
+	return p.backups.wait(ctx, p.TriggerBackup)
+}
+
+// BackupProgress returns the progress of the running backup, nil if there is
+// none
+func (p *DBRepo) BackupProgress() *BackupProgress {
+	return p.backups.progress()
+}
 
-	log.Printf("Merged tempDB %d records. Status: %t. Duration: %dms", count, !hasError, time.Since(start).Milliseconds())
-	return hasError
+// CancelBackup stops the running backup like a cancelled Backup context, it
+// reports whether a backup was running
+func (p *DBRepo) CancelBackup() bool {
+	return p.backups.cancel()
 }
 
-// Get find a key in DB
+// mergeTempDB merges tempDB into mainDB, the repo goes back to normal or, if
+// the merge fails, degraded
+func (p *DBRepo) mergeTempDB() error {
+	if err := p.state.transition(StateMerging, nil); err != nil {
+		log.Printf("error while mergeTempDB: %s", err.Error())
+		return err
+	}
+
+	start := time.Now()
+	ctx, cancel := quitContext(p.quit, p.timeouts.Merge)
+	report, err := mergeTemp(ctx, p.mainDB, p.tempDB, &p.mainWriteMu, p.versioned, p.policies, p.mergeRate, path.Join(p.rootFolder, mergeStateFileName))
+	cancel()
+	hasError := err != nil
+	if hasError {
+		log.Printf("error while mergeTempDB: %s", err.Error())
+	}
+	if report.Failed > 0 {
+		log.Printf("error while mergeTempDB: %d keys left in tempDB, e.g. %q", report.Failed, report.FailedKeys)
+	}
+	p.lastMerge.Store(report)
+
+	log.Printf("Merged tempDB %d records. Status: %t. Duration: %dms", report.Moved, !hasError, time.Since(start).Milliseconds())
+	if hasError {
+		p.state.transition(StateDegraded, err)
+		return err
+	}
+	return p.state.transition(StateNormal, nil)
+}
+
+// State returns the state of the repo
+func (p *DBRepo) State() EngineStatus {
+	return p.state.status()
+}
+
+// WaitState waits until the repo is in one of states, it fails once ctx is
+// done or the repo is closed
+func (p *DBRepo) WaitState(ctx context.Context, states ...EngineState) (EngineState, error) {
+	return p.state.wait(ctx, states...)
+}
+
+// SubscribeState returns the next state transitions, up to buffer of them are
+// kept while the reader lags behind, and a func to stop receiving them
+func (p *DBRepo) SubscribeState(buffer int) (<-chan StateTransition, func()) {
+	return p.state.subscribe(buffer)
+}
+
+// LastMerge returns the report of the last merge of tempDB into mainDB
+func (p *DBRepo) LastMerge() *MergeReport {
+	return p.lastMerge.Load()
+}
+
+// Get find a key in DB, a key written during the backup window is resolved by
+// its MergePolicy. While a backup has mainDB closed it waits for the reopen
 func (p *DBRepo) Get(key string) ([]byte, error) {
-	value, err := p.tempDB.Get([]byte(key), nil)
-	if err != nil && err != leveldb.ErrNotFound {
+	mainDB, err := p.acquireMainDB()
+	if err != nil {
 		return nil, err
 	}
+	defer p.mainReaders.release()
 
-	if p.onBackUp {
-		p.Lock()
-		defer p.Unlock()
+	temp, err := readRecord(p.tempDB, []byte(key))
+	if err != nil {
+		return nil, err
 	}
-	if len(value) > 0 {
-		mainValue, err := p.mainDB.Get([]byte(key), nil)
-		if err != nil && err != leveldb.ErrNotFound {
-			return nil, err
-		}
-		if len(mainValue) == 0 {
-			log.Printf("Found %s on temp", key)
-			return value, nil
-		}
-
-		// TODO: compare version of state to decide which one is the latest state
-		return mainValue, err
+	main, err := readEnvelope(mainDB, []byte(key), p.versioned)
+	if err != nil {
+		return nil, err
 	}
 
-	return p.mainDB.Get([]byte(key), nil)
+	return p.policies.resolve([]byte(key), temp, main)
+}
+
+// acquireMainDB returns mainDB, kept open until mainReaders is released. While
+// a backup has mainDB closed it waits for the reopen
+func (p *DBRepo) acquireMainDB() (*leveldb.DB, error) {
+	if p.state.get() == StateClosed {
+		return nil, leveldb.ErrClosed
+	}
+	return p.mainReaders.acquire()
 }
 
 // Put save a value into db
 func (p *DBRepo) Put(key string, value []byte) error {
-	if p.onBackUp {
-		return p.tempDB.Put([]byte(key), value, wo)
+	p.schedule.wrote()
+	if p.changes == nil {
+		return p.put(key, value)
+	}
+	p.logMu.RLock()
+	defer p.logMu.RUnlock()
+	seq, err := p.changes.appendPut([]byte(key), value)
+	if err != nil {
+		return err
 	}
+	return p.changes.abortOnError(seq, p.put(key, value))
+}
 
-	return p.mainDB.Put([]byte(key), value, wo)
+func (p *DBRepo) put(key string, value []byte) error {
+	state := p.state.enter()
+	defer p.state.exit()
+	switch state {
+	case StateClosed:
+		return leveldb.ErrClosed
+	case StateBackingUp:
+		p.tempWriteMu.RLock()
+		defer p.tempWriteMu.RUnlock()
+		return p.tempDB.Put([]byte(key), encodeRecord(record{kind: recordValue, version: versions.next(), value: value}), wo)
+	}
+
+	if p.versioned {
+		value = encodeEnvelope(envelope{version: versions.next(), value: value})
+	}
+	p.mainWriteMu.RLock()
+	defer p.mainWriteMu.RUnlock()
+	if err := p.mainDB.Put([]byte(key), value, wo); err != nil {
+		return err
+	}
+	return p.dropTemp(state, []byte(key))
 }
 
 // Delete a value from db
-func (p *DBRepo) Del(key string) error {
-	if p.onMerging {
-		if err := p.tempDB.Delete([]byte(key), wo); err != nil {
-			return err
-		}
-		if err := p.mainDB.Delete([]byte(key), wo); err != nil {
+func (p *DBRepo) Delete(key string) error {
+	p.schedule.wrote()
+	if p.changes == nil {
+		return p.delete(key)
+	}
+	p.logMu.RLock()
+	defer p.logMu.RUnlock()
+	seq, err := p.changes.appendDelete([]byte(key))
+	if err != nil {
+		return err
+	}
+	return p.changes.abortOnError(seq, p.delete(key))
+}
+
+func (p *DBRepo) delete(key string) error {
+	state := p.state.enter()
+	defer p.state.exit()
+	switch state {
+	case StateClosed:
+		return leveldb.ErrClosed
+	case StateBackingUp:
+		// keep a tombstone so the key stays hidden until the merge deletes it from mainDB
+		p.tempWriteMu.RLock()
+		defer p.tempWriteMu.RUnlock()
+		return p.tempDB.Put([]byte(key), encodeRecord(record{kind: recordTombstone, version: versions.next()}), wo)
+	}
+	return p.deleteMain([]byte(key), state)
+}
+
+// dropTemp deletes from tempDB the keys just written to mainDB while merging.
+// mainWriteMu must be held
+func (p *DBRepo) dropTemp(state EngineState, keys ...[]byte) error {
+	if !state.merging() {
+		return nil
+	}
+	return dropTemp(p.tempDB, &p.tempWriteMu, keys...)
+}
+
+func (p *DBRepo) deleteMain(key []byte, state EngineState) error {
+	p.mainWriteMu.RLock()
+	defer p.mainWriteMu.RUnlock()
+
+	var err error
+	if p.versioned && state.merging() {
+		// a tombstone keeps the merge from bringing back an older tempDB value
+		err = p.mainDB.Put(key, encodeEnvelope(envelope{version: versions.next(), tombstone: true}), wo)
+	} else {
+		err = p.mainDB.Delete(key, wo)
+	}
+	if err != nil {
+		return err
+	}
+	return p.dropTemp(state, key)
+}
+
+// Merge combines operand into the value of key with the MergeOperator of its
+// prefix in Options.MergePolicies, ErrNoMergeOperator if it has none
+func (p *DBRepo) Merge(key string, operand []byte) error {
+	op, err := p.policies.mergeOperator([]byte(key))
+	if err != nil {
+		return err
+	}
+	p.schedule.wrote()
+	if p.changes == nil {
+		return p.merge(op, key, operand)
+	}
+	p.logMu.RLock()
+	defer p.logMu.RUnlock()
+	seq, err := p.changes.appendOperand(op, []byte(key), operand)
+	if err != nil {
+		return err
+	}
+	return p.changes.abortOnError(seq, p.merge(op, key, operand))
+}
+
+func (p *DBRepo) merge(op MergeOperator, key string, operand []byte) error {
+	state := p.state.enter()
+	defer p.state.exit()
+	switch state {
+	case StateClosed:
+		return leveldb.ErrClosed
+	case StateBackingUp:
+		return mergeTempOperand(p.tempDB, &p.tempWriteMu, op, []byte(key), operand)
+	}
+	if state.merging() {
+		if err := mergeKey(p.mainDB, p.tempDB, &p.mainWriteMu, p.versioned, p.policies, []byte(key)); err != nil {
 			return err
 		}
+	}
+	return mergeMainOperand(p.mainDB, &p.mainWriteMu, p.versioned, op, []byte(key), operand)
+}
 
-		return nil
+// Iterator get an iterator over the keys starting with prefix
+func (p *DBRepo) Iterator(prefix string) iterator.Iterator {
+	return p.NewIterator(util.BytesPrefix([]byte(prefix)))
+}
+
+// Has reports whether key exists in tempDB or mainDB
+func (p *DBRepo) Has(key string) (bool, error) {
+	_, err := p.Get(key)
+	if err == leveldb.ErrNotFound {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	if p.onBackUp {
-		return p.tempDB.Delete([]byte(key), wo)
+// NewIterator iterates over slice in key order, records written to tempDB
+// during the backup window are resolved against mainDB by their MergePolicy
+func (p *DBRepo) NewIterator(slice *util.Range) iterator.Iterator {
+	if p.state.get() == StateClosed {
+		return iterator.NewEmptyIterator(leveldb.ErrClosed)
+	}
+	temp := p.tempDB.NewIterator(slice, nil)
+	return newOverlayIterator(temp, p.mainReaders.newIterator(slice), p.policies, p.versioned)
+}
+
+// Write applies batch to the DB currently receiving writes
+func (p *DBRepo) Write(batch *leveldb.Batch) error {
+	p.schedule.wrote()
+	if p.changes == nil {
+		return p.write(batch)
+	}
+	p.logMu.RLock()
+	defer p.logMu.RUnlock()
+	seq, err := p.changes.append(batch)
+	if err != nil {
+		return err
 	}
-	return p.mainDB.Delete([]byte(key), wo)
+	return p.changes.abortOnError(seq, p.write(batch))
 }
 
-// Iterator get an iterator of a key
-func (p *DBRepo) Iterator(key string) []iterator.Iterator {
-	for p.onMerging {
-		time.Sleep(50 * time.Millisecond)
+func (p *DBRepo) write(batch *leveldb.Batch) error {
+	state := p.state.enter()
+	defer p.state.exit()
+	switch state {
+	case StateClosed:
+		return leveldb.ErrClosed
+	case StateBackingUp:
+		p.tempWriteMu.RLock()
+		defer p.tempWriteMu.RUnlock()
+		return p.tempDB.Write(newTempBatch(batch), wo)
 	}
 
-	if p.onBackUp {
-		return []iterator.Iterator{
-			p.tempDB.NewIterator(util.BytesPrefix([]byte(key)), nil),
-			p.mainDB.NewIterator(util.BytesPrefix([]byte(key)), nil),
+	var keys batchKeys
+	if state.merging() {
+		batch.Replay(&keys)
+	}
+	if p.versioned {
+		main := &leveldb.Batch{}
+		batch.Replay(mainBatchReplay{batch: main, version: versions.next(), tombstones: state.merging()})
+		batch = main
+	}
+	p.mainWriteMu.RLock()
+	defer p.mainWriteMu.RUnlock()
+	if err := p.mainDB.Write(batch, wo); err != nil {
+		return err
+	}
+	return p.dropTemp(state, keys...)
+}
+
+// Close cancels the running backup and merge, stops the backup loop and closes
+// both DBs. What is left in tempDB is merged at the next start
+func (p *DBRepo) Close() error {
+	p.backups.close()
+	if err := p.state.transition(StateClosed, nil); err != nil {
+		return err
+	}
+	close(p.quit)
+	<-p.done
+
+	p.Lock()
+	defer p.Unlock()
+
+	err := p.tempDB.Close()
+	p.mainReaders.close()
+	// mainDB is nil when it failed to reopen after a backup
+	if p.mainDB != nil {
+		if mainErr := p.mainDB.Close(); mainErr != nil {
+			err = mainErr
 		}
 	}
+	p.mainDB = nil
+	if p.changes != nil {
+		if logErr := p.changes.close(); logErr != nil {
+			err = logErr
+		}
+	}
+	return err
+}
+
+func (p *DBRepo) Stats() (*Stats, error) {
+	p.Lock()
+	defer p.Unlock()
 
-	return []iterator.Iterator{
-		p.mainDB.NewIterator(util.BytesPrefix([]byte(key)), nil),
+	if p.mainDB == nil {
+		return nil, leveldb.ErrClosed
+	}
+	mainStats := &leveldb.DBStats{}
+	if err := p.mainDB.Stats(mainStats); err != nil {
+		return nil, err
 	}
+	tempStats := &leveldb.DBStats{}
+	if err := p.tempDB.Stats(tempStats); err != nil {
+		return nil, err
+	}
+
+	return &Stats{
+		Engine:    EngineRepo,
+		Path:      p.dbFilePath,
+		OnBackup:  p.state.get() == StateBackingUp,
+		State:     p.state.status(),
+		Backup:    p.backups.progress(),
+		ReadWaits: p.mainReaders.readWaits(),
+		DBs: map[string]*leveldb.DBStats{
+			"main": mainStats,
+			"temp": tempStats,
+		},
+	}, nil
 }
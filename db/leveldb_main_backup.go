@@ -3,6 +3,10 @@ package db
 import (
 	"log"
 	"path"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type LevelDBManagerAddBackup struct {
@@ -10,6 +14,7 @@ type LevelDBManagerAddBackup struct {
 	mainDB             *LevelDBNormal
 	backupDB           *LevelDBManager
 	backupAsyncChannel chan message
+	backupAsyncDone    chan struct{}
 
 	waitForBackup bool
 }
@@ -17,9 +22,18 @@ type LevelDBManagerAddBackup struct {
 type message struct {
 	key   string
 	value []byte
+
+	delete bool
+	batch  *leveldb.Batch
 }
 
 func NewLevelDBManagerAddBackup(dbPath string, waitForBackup bool) (*LevelDBManagerAddBackup, error) {
+	return NewLevelDBManagerAddBackupWithOptions(dbPath, waitForBackup, nil)
+}
+
+// NewLevelDBManagerAddBackupWithOptions opens the live DB and a backup
+// LevelDBManager configured by o
+func NewLevelDBManagerAddBackupWithOptions(dbPath string, waitForBackup bool, o *Options) (*LevelDBManagerAddBackup, error) {
 	mainPath := path.Join(dbPath, "live")
 	backupPath := path.Join(dbPath, "backup")
 	mainDB, err := NewLevelDBNormal(mainPath)
@@ -27,7 +41,7 @@ func NewLevelDBManagerAddBackup(dbPath string, waitForBackup bool) (*LevelDBMana
 		return nil, err
 	}
 
-	backupDB, err := NewDB(backupPath)
+	backupDB, err := NewDBWithOptions(backupPath, o)
 	if err != nil {
 		return nil, err
 	}
@@ -37,6 +51,7 @@ func NewLevelDBManagerAddBackup(dbPath string, waitForBackup bool) (*LevelDBMana
 		backupDB:           backupDB,
 		waitForBackup:      waitForBackup,
 		backupAsyncChannel: make(chan message, 10000),
+		backupAsyncDone:    make(chan struct{}),
 	}
 	if !waitForBackup {
 		go dbManager.startAsyncWriteBackup()
@@ -46,9 +61,10 @@ func NewLevelDBManagerAddBackup(dbPath string, waitForBackup bool) (*LevelDBMana
 
 func (dm *LevelDBManagerAddBackup) Put(key string, value []byte) error {
 	if !dm.waitForBackup {
+		// the caller may reuse value once Put returns
 		dm.backupAsyncChannel <- message{
 			key:   key,
-			value: value,
+			value: append([]byte{}, value...),
 		}
 	} else {
 		err := dm.backupDB.Put(key, value)
@@ -63,12 +79,99 @@ func (dm *LevelDBManagerAddBackup) Get(key string) ([]byte, error) {
 	return dm.mainDB.Get(key)
 }
 
+func (dm *LevelDBManagerAddBackup) Delete(key string) error {
+	if !dm.waitForBackup {
+		dm.backupAsyncChannel <- message{
+			key:    key,
+			delete: true,
+		}
+	} else {
+		err := dm.backupDB.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return dm.mainDB.Delete(key)
+}
+
+func (dm *LevelDBManagerAddBackup) Has(key string) (bool, error) {
+	return dm.mainDB.Has(key)
+}
+
+func (dm *LevelDBManagerAddBackup) NewIterator(slice *util.Range) iterator.Iterator {
+	return dm.mainDB.NewIterator(slice)
+}
+
+func (dm *LevelDBManagerAddBackup) Write(batch *leveldb.Batch) error {
+	if !dm.waitForBackup {
+		// the caller may reuse batch once Write returns, Load does not copy
+		b := new(leveldb.Batch)
+		if err := b.Load(append([]byte{}, batch.Dump()...)); err != nil {
+			return err
+		}
+		dm.backupAsyncChannel <- message{
+			batch: b,
+		}
+	} else {
+		err := dm.backupDB.Write(batch)
+		if err != nil {
+			return err
+		}
+	}
+	return dm.mainDB.Write(batch)
+}
+
+// Close flushes pending async writes to the backup DB then closes both DBs
+func (dm *LevelDBManagerAddBackup) Close() error {
+	if !dm.waitForBackup {
+		close(dm.backupAsyncChannel)
+		<-dm.backupAsyncDone
+	}
+
+	err := dm.backupDB.Close()
+	if mainErr := dm.mainDB.Close(); mainErr != nil {
+		err = mainErr
+	}
+	return err
+}
+
+func (dm *LevelDBManagerAddBackup) Stats() (*Stats, error) {
+	mainStats, err := dm.mainDB.Stats()
+	if err != nil {
+		return nil, err
+	}
+	backupStats, err := dm.backupDB.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stats{
+		Engine:   EngineLiveBackup,
+		Path:     dm.path,
+		OnBackup: backupStats.OnBackup,
+		DBs: map[string]*leveldb.DBStats{
+			"live":   mainStats.DBs["main"],
+			"backup": backupStats.DBs["main"],
+		},
+	}, nil
+}
+
 func (dm *LevelDBManagerAddBackup) startAsyncWriteBackup() {
+	defer close(dm.backupAsyncDone)
+
 	for task := range dm.backupAsyncChannel {
 		msg := task
-		err := dm.backupDB.Put(msg.key, msg.value)
+		var err error
+		switch {
+		case msg.batch != nil:
+			err = dm.backupDB.Write(msg.batch)
+		case msg.delete:
+			err = dm.backupDB.Delete(msg.key)
+		default:
+			err = dm.backupDB.Put(msg.key, msg.value)
+		}
 		if err != nil {
-			log.Printf("[catch me] error when put in backup db %s: %s", msg.key, err.Error())
+			log.Printf("[catch me] error when write in backup db %s: %s", msg.key, err.Error())
 		}
 	}
 }
@@ -3,6 +3,10 @@ package db
 import (
 	"log"
 	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type LevelDBNormal struct {
@@ -30,3 +34,36 @@ func (dm *LevelDBNormal) Put(key string, value []byte) error {
 func (dm *LevelDBNormal) Get(key string) ([]byte, error) {
 	return dm.db.db.Get([]byte(key), nil)
 }
+
+func (dm *LevelDBNormal) Delete(key string) error {
+	return dm.db.delete([]byte(key))
+}
+
+func (dm *LevelDBNormal) Has(key string) (bool, error) {
+	return dm.db.db.Has([]byte(key), nil)
+}
+
+func (dm *LevelDBNormal) NewIterator(slice *util.Range) iterator.Iterator {
+	return dm.db.db.NewIterator(slice, nil)
+}
+
+func (dm *LevelDBNormal) Write(batch *leveldb.Batch) error {
+	return dm.db.db.Write(batch, wo)
+}
+
+func (dm *LevelDBNormal) Close() error {
+	return dm.db.close()
+}
+
+func (dm *LevelDBNormal) Stats() (*Stats, error) {
+	s, err := dm.db.stats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stats{
+		Engine: EngineNormal,
+		Path:   dm.db.path,
+		DBs:    map[string]*leveldb.DBStats{"main": s},
+	}, nil
+}
@@ -1 +1,2529 @@
 package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cp "github.com/otiai10/copy"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestStoreEngines(t *testing.T) {
+	for _, engine := range []string{EngineNormal, EngineMainTemp, EngineRepo, EngineLiveBackup, EngineSharded} {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewStoreWithOptions(engine, path.Join(dir, engine), &Options{BackupRoot: path.Join(dir, "backup")})
+			if err != nil {
+				t.Fatalf("NewStore: %s", err.Error())
+			}
+
+			if err := store.Put("a", []byte("1")); err != nil {
+				t.Fatalf("Put: %s", err.Error())
+			}
+			batch := &leveldb.Batch{}
+			batch.Put([]byte("b"), []byte("2"))
+			batch.Put([]byte("c"), []byte("3"))
+			batch.Delete([]byte("a"))
+			if err := store.Write(batch); err != nil {
+				t.Fatalf("Write: %s", err.Error())
+			}
+			if err := store.Delete("c"); err != nil {
+				t.Fatalf("Delete: %s", err.Error())
+			}
+
+			if ok, err := store.Has("a"); err != nil || ok {
+				t.Fatalf("Has(a) = %t, %v", ok, err)
+			}
+			value, err := store.Get("b")
+			if err != nil || string(value) != "2" {
+				t.Fatalf("Get(b) = %q, %v", value, err)
+			}
+
+			iter := store.NewIterator(nil)
+			var keys []string
+			for iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			iter.Release()
+			if len(keys) != 1 || keys[0] != "b" {
+				t.Fatalf("iterated keys %v, want [b]", keys)
+			}
+
+			stats, err := store.Stats()
+			if err != nil || stats.Engine != engine {
+				t.Fatalf("Stats = %+v, %v", stats, err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestLiveBackupAsyncReuse(t *testing.T) {
+	dir := t.TempDir()
+	dm, err := NewLevelDBManagerAddBackupWithOptions(dir, false, &Options{BackupRoot: path.Join(dir, "backups")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch and the value are reused as soon as the write returns
+	batch := &leveldb.Batch{}
+	value := make([]byte, 8)
+	for i := 0; i < 200; i++ {
+		batch.Reset()
+		copy(value, fmt.Sprintf("b%07d", i))
+		batch.Put([]byte(fmt.Sprintf("b%03d", i)), value)
+		if err := dm.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		copy(value, fmt.Sprintf("p%07d", i))
+		if err := dm.Put(fmt.Sprintf("p%03d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backupDB, err := NewDBWithOptions(path.Join(dir, "backup"), &Options{BackupRoot: path.Join(dir, "backups")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backupDB.Close()
+	for i := 0; i < 200; i++ {
+		for _, prefix := range []string{"b", "p"} {
+			key := fmt.Sprintf("%s%03d", prefix, i)
+			if got, err := backupDB.Get(key); err != nil || string(got) != fmt.Sprintf("%s%07d", prefix, i) {
+				t.Fatalf("backup DB %s = %q, %v", key, got, err)
+			}
+		}
+	}
+}
+
+func TestLevelDBManagerTombstone(t *testing.T) {
+	dbPath := t.TempDir()
+	o := &Options{BackupRoot: path.Join(dbPath, "backup")}
+	dm, err := NewDBWithOptions(dbPath, o)
+	if err != nil {
+		t.Fatalf("NewDB: %s", err.Error())
+	}
+	if err := dm.Put("k", []byte("v")); err != nil {
+		t.Fatalf("Put: %s", err.Error())
+	}
+
+	// a delete issued while tempDB is the working DB
+	if err := dm.tempDB.delete([]byte("k")); err != nil {
+		t.Fatalf("delete on tempDB: %s", err.Error())
+	}
+	if _, err := dm.Get("k"); err != leveldb.ErrNotFound {
+		t.Fatalf("Get after tombstone = %v, want ErrNotFound", err)
+	}
+	if err := dm.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+
+	// the merge at startup applies the tombstone to mainDB
+	dm, err = NewDBWithOptions(dbPath, o)
+	if err != nil {
+		t.Fatalf("reopen NewDB: %s", err.Error())
+	}
+	defer dm.Close()
+	waitTempDrained(t, dm.tempDB)
+
+	if _, err := dm.Get("k"); err != leveldb.ErrNotFound {
+		t.Fatalf("Get after merge = %v, want ErrNotFound", err)
+	}
+	if ok, _ := dm.mainDB.db.Has([]byte("k"), nil); ok {
+		t.Fatalf("key still present in mainDB after merge")
+	}
+}
+
+func waitTempDrained(t *testing.T, tempDB *levelDBWrapper) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		iter := tempDB.db.NewIterator(nil, nil)
+		empty := !iter.Next()
+		iter.Release()
+		if empty {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("tempDB not drained by merge")
+}
+
+func TestLegacyTempDB(t *testing.T) {
+	for _, engine := range []string{EngineMainTemp, EngineRepo} {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+			// raw values left in tempDB by a version before records
+			for name, value := range map[string]string{"main": "old", "temp": "legacy"} {
+				db, err := leveldb.OpenFile(path.Join(dir, name), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.Put([]byte("k"), []byte(value), nil)
+				db.Put([]byte(name), []byte{recordTombstone, 'x'}, nil)
+				db.Close()
+			}
+
+			store, err := NewStoreWithOptions(engine, dir, &Options{
+				BackupRoot: path.Join(dir, "backup"),
+				Schedule:   &BackupSchedule{Manual: true},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			for key, want := range map[string]string{"k": "legacy", "main": "\x01x", "temp": "\x01x"} {
+				if value, err := store.Get(key); err != nil || string(value) != want {
+					t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+				}
+			}
+			if _, err := os.Stat(path.Join(dir, "temp", tempFormatFileName)); err != nil {
+				t.Fatalf("no format marker: %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeTempMovesBatches(t *testing.T) {
+	dbPath := t.TempDir()
+	mainDB, err := leveldb.OpenFile(path.Join(dbPath, "main"), nil)
+	if err != nil {
+		t.Fatalf("open mainDB: %s", err.Error())
+	}
+	defer mainDB.Close()
+	tempDB := &levelDBWrapper{path: path.Join(dbPath, "temp"), temp: true}
+	if err := tempDB.open(); err != nil {
+		t.Fatalf("open tempDB: %s", err.Error())
+	}
+	defer tempDB.close()
+
+	mainDB.Put([]byte("b"), []byte("old"), nil)
+	mainDB.Put([]byte("gone"), []byte("old"), nil)
+	batch := &leveldb.Batch{}
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Delete([]byte("gone"))
+	if err := tempDB.write(batch); err != nil {
+		t.Fatalf("write batch: %s", err.Error())
+	}
+	if err := tempDB.put([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("put: %s", err.Error())
+	}
+
+	report, err := mergeTemp(context.Background(), mainDB, tempDB.db, &sync.RWMutex{}, false, nil, nil, "")
+	if err != nil || report.Moved != 4 {
+		t.Fatalf("mergeTemp = %+v, %v, want 4 records", report, err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if value, err := mainDB.Get([]byte(key), nil); err != nil || string(value) != want {
+			t.Fatalf("mainDB[%s] = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	if ok, _ := mainDB.Has([]byte("gone"), nil); ok {
+		t.Fatalf("deleted key still present in mainDB")
+	}
+	waitTempDrained(t, tempDB)
+
+	// records changed in tempDB after they were read are left alone
+	tempDB.put([]byte("d"), []byte("temp"))
+	tempDB.put([]byte("e"), []byte("temp"))
+	var chunk []mergeRecord
+	for _, key := range []string{"d", "e"} {
+		raw, _ := tempDB.db.Get([]byte(key), nil)
+		chunk = append(chunk, mergeRecord{key: []byte(key), raw: raw, record: decodeRecord(raw)})
+	}
+	tempDB.db.Delete([]byte("d"), nil)
+	mainDB.Put([]byte("d"), []byte("main"), nil)
+	tempDB.put([]byte("e"), []byte("newer"))
+	if skipped, err := applyMerge(mainDB, tempDB.db, &sync.RWMutex{}, false, nil, chunk); err != nil || skipped != 2 {
+		t.Fatalf("applyMerge = %d, %v, want 2 skipped", skipped, err)
+	}
+	if value, _ := mainDB.Get([]byte("d"), nil); string(value) != "main" {
+		t.Fatalf("mainDB[d] = %q, overwritten by merge", value)
+	}
+	if ok, _ := mainDB.Has([]byte("e"), nil); ok {
+		t.Fatalf("stale record e moved to mainDB")
+	}
+	if ok, _ := tempDB.db.Has([]byte("e"), nil); !ok {
+		t.Fatalf("newer record e removed from tempDB")
+	}
+}
+
+func TestOverlayIterator(t *testing.T) {
+	dbPath := t.TempDir()
+	mainDB := &levelDBWrapper{path: path.Join(dbPath, "main")}
+	tempDB := &levelDBWrapper{path: path.Join(dbPath, "temp"), temp: true}
+	for _, dw := range []*levelDBWrapper{mainDB, tempDB} {
+		if err := dw.open(); err != nil {
+			t.Fatalf("open %s: %s", dw.path, err.Error())
+		}
+		defer dw.close()
+	}
+
+	for _, key := range []string{"a", "b", "c", "e"} {
+		mainDB.put([]byte(key), []byte("main-"+key))
+	}
+	tempDB.put([]byte("b"), []byte("temp-b"))
+	tempDB.put([]byte("d"), []byte("temp-d"))
+	tempDB.delete([]byte("c"))
+	tempDB.delete([]byte("x"))
+
+	newIter := func(slice *util.Range) iterator.Iterator {
+		return newOverlayIterator(tempDB.db.NewIterator(slice, nil), mainDB.db.NewIterator(slice, nil), nil, false)
+	}
+	collect := func(iter iterator.Iterator, next func() bool) []string {
+		var kvs []string
+		for next() {
+			kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+		}
+		return kvs
+	}
+
+	iter := newIter(nil)
+	forward := collect(iter, iter.Next)
+	want := []string{"a=main-a", "b=temp-b", "d=temp-d", "e=main-e"}
+	if !reflect.DeepEqual(forward, want) {
+		t.Fatalf("forward = %v, want %v", forward, want)
+	}
+	backward := collect(iter, iter.Prev)
+	if len(backward) != 4 || backward[0] != "e=main-e" || backward[3] != "a=main-a" {
+		t.Fatalf("backward = %v", backward)
+	}
+
+	// direction switches around a shadowed key
+	if !iter.Seek([]byte("c")) || string(iter.Key()) != "d" {
+		t.Fatalf("Seek(c) landed on %q", iter.Key())
+	}
+	if !iter.Prev() || string(iter.Value()) != "temp-b" {
+		t.Fatalf("Prev after Seek = %q", iter.Value())
+	}
+	if !iter.Next() || string(iter.Key()) != "d" {
+		t.Fatalf("Next after Prev = %q", iter.Key())
+	}
+	iter.Release()
+
+	iter = newIter(&util.Range{Start: []byte("b"), Limit: []byte("e")})
+	if got := collect(iter, iter.Next); !reflect.DeepEqual(got, want[1:3]) {
+		t.Fatalf("range = %v, want %v", got, want[1:3])
+	}
+	iter.Release()
+
+	iter = newIter(util.BytesPrefix([]byte("c")))
+	if iter.First() {
+		t.Fatalf("prefix of a deleted key yielded %q", iter.Key())
+	}
+	iter.Release()
+}
+
+func TestVersionedMerge(t *testing.T) {
+	dbPath := t.TempDir()
+	mainDB := &levelDBWrapper{path: path.Join(dbPath, "main"), versioned: true}
+	tempDB := &levelDBWrapper{path: path.Join(dbPath, "temp"), temp: true}
+	for _, dw := range []*levelDBWrapper{mainDB, tempDB} {
+		if err := dw.open(); err != nil {
+			t.Fatalf("open %s: %s", dw.path, err.Error())
+		}
+		defer dw.close()
+	}
+	dm := &LevelDBManager{mainDB: mainDB, tempDB: tempDB, state: newStateMachine()}
+
+	// a raw value from before versioning was enabled
+	mainDB.db.Put([]byte("legacy"), []byte("raw"), nil)
+	tempDB.put([]byte("legacy"), []byte("temp"))
+	// written to tempDB during the backup, then to mainDB during the merge
+	tempDB.put([]byte("k"), []byte("old"))
+	mainDB.put([]byte("k"), []byte("new"))
+	atomic.StoreInt32(&mainDB.merging, 1)
+	tempDB.put([]byte("del"), []byte("old"))
+	mainDB.delete([]byte("del"))
+
+	check := func(stage string) {
+		for key, want := range map[string]string{"legacy": "temp", "k": "new", "del": ""} {
+			value, err := dm.Get(key)
+			if want == "" {
+				if err != leveldb.ErrNotFound {
+					t.Fatalf("%s: Get(%s) = %q, %v, want ErrNotFound", stage, key, value, err)
+				}
+				continue
+			}
+			if err != nil || string(value) != want {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key, value, err, want)
+			}
+		}
+	}
+
+	check("before merge")
+	report, err := mergeTemp(context.Background(), mainDB.db, tempDB.db, &mainDB.writeMu, true, nil, nil, "")
+	if err != nil {
+		t.Fatalf("mergeTemp: %s", err.Error())
+	}
+	check("after merge")
+	waitTempDrained(t, tempDB)
+	// the tombstone has nothing left to hide
+	if ok, _ := mainDB.db.Has([]byte("del"), nil); ok || report.Purged != 1 {
+		t.Fatalf("tombstone left in mainDB, %d purged", report.Purged)
+	}
+}
+
+func TestBackupOnline(t *testing.T) {
+	dir := t.TempDir()
+	mainDB, err := leveldb.OpenFile(path.Join(dir, "main"), nil)
+	if err != nil {
+		t.Fatalf("open mainDB: %s", err.Error())
+	}
+	defer mainDB.Close()
+	for _, key := range []string{"b", "a", "c"} {
+		mainDB.Put([]byte(key), []byte("value-"+key), nil)
+	}
+
+	snap, err := mainDB.GetSnapshot()
+	if err != nil {
+		t.Fatalf("GetSnapshot: %s", err.Error())
+	}
+	defer snap.Release()
+	// written after the snapshot, not part of the backup
+	mainDB.Put([]byte("d"), []byte("value-d"), nil)
+
+	if count, err := backupOnline(context.Background(), BackupSnapshot, snap, path.Join(dir, "snapshot"), nil); err != nil || count != 3 {
+		t.Fatalf("snapshot backup = %d, %v", count, err)
+	}
+	backupDB, err := leveldb.OpenFile(path.Join(dir, "snapshot"), nil)
+	if err != nil {
+		t.Fatalf("open snapshot backup: %s", err.Error())
+	}
+	if value, err := backupDB.Get([]byte("c"), nil); err != nil || string(value) != "value-c" {
+		t.Fatalf("snapshot backup c = %q, %v", value, err)
+	}
+	if ok, _ := backupDB.Has([]byte("d"), nil); ok {
+		t.Fatalf("snapshot backup holds a key written after the snapshot")
+	}
+	backupDB.Close()
+
+	if count, err := backupOnline(context.Background(), BackupDump, snap, path.Join(dir, "dump"), nil); err != nil || count != 3 {
+		t.Fatalf("dump backup = %d, %v", count, err)
+	}
+	var keys []string
+	err = readDump(path.Join(dir, "dump", dumpFileName), func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("dump keys = %v, %v", keys, err)
+	}
+}
+
+func TestCheckpointSharesTables(t *testing.T) {
+	dir := t.TempDir()
+	src := path.Join(dir, "main")
+	mainDB, err := leveldb.OpenFile(src, nil)
+	if err != nil {
+		t.Fatalf("open mainDB: %s", err.Error())
+	}
+	for i := 0; i < 1000; i++ {
+		mainDB.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value"), nil)
+	}
+	// flush the memtable into a table file
+	if err := mainDB.CompactRange(util.Range{}); err != nil {
+		t.Fatalf("CompactRange: %s", err.Error())
+	}
+	mainDB.Close()
+
+	for _, name := range []string{"cp1", "cp2"} {
+		if err := checkpoint(context.Background(), src, path.Join(dir, name), nil); err != nil {
+			t.Fatalf("checkpoint %s: %s", name, err.Error())
+		}
+	}
+
+	tables, _ := filepath.Glob(path.Join(dir, "cp1", "*.ldb"))
+	if len(tables) == 0 {
+		t.Fatalf("no table file in checkpoint")
+	}
+	for _, table := range tables {
+		first, _ := os.Stat(table)
+		second, err := os.Stat(path.Join(dir, "cp2", filepath.Base(table)))
+		if err != nil || !os.SameFile(first, second) {
+			t.Fatalf("table %s not shared between checkpoints", filepath.Base(table))
+		}
+	}
+
+	backupDB, err := leveldb.OpenFile(path.Join(dir, "cp2"), nil)
+	if err != nil {
+		t.Fatalf("open checkpoint: %s", err.Error())
+	}
+	defer backupDB.Close()
+	if value, err := backupDB.Get([]byte("key-0999"), nil); err != nil || string(value) != "value" {
+		t.Fatalf("checkpoint key-0999 = %q, %v", value, err)
+	}
+}
+
+func TestBackupCatalog(t *testing.T) {
+	dir := t.TempDir()
+	catalog, err := NewBackupCatalog(path.Join(dir, "backup"))
+	if err != nil {
+		t.Fatalf("NewBackupCatalog: %s", err.Error())
+	}
+
+	mainDB, err := leveldb.OpenFile(path.Join(dir, "main"), nil)
+	if err != nil {
+		t.Fatalf("open mainDB: %s", err.Error())
+	}
+	defer mainDB.Close()
+	mainDB.Put([]byte("a"), []byte("1"), nil)
+	mainDB.Put([]byte("b"), []byte("2"), nil)
+	snap, _ := mainDB.GetSnapshot()
+	defer snap.Release()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		b, err := catalog.begin(path.Join(dir, "main"), EngineMainTemp, BackupSnapshot)
+		if err != nil {
+			t.Fatalf("begin: %s", err.Error())
+		}
+		if _, err := backupOnline(context.Background(), BackupSnapshot, snap, b.dataPath(), nil); err != nil {
+			t.Fatalf("backupOnline: %s", err.Error())
+		}
+		// counted from the backup data
+		manifest, err := b.commit(-1)
+		if err != nil {
+			t.Fatalf("commit: %s", err.Error())
+		}
+		if manifest.KeyCount != 2 || len(manifest.Files) == 0 || manifest.Size == 0 {
+			t.Fatalf("manifest = %+v", manifest)
+		}
+		ids = append(ids, manifest.ID)
+	}
+	// a backup that never committed is not listed
+	if _, err := catalog.begin(path.Join(dir, "main"), EngineMainTemp, BackupSnapshot); err != nil {
+		t.Fatalf("begin: %s", err.Error())
+	}
+
+	manifests, err := catalog.List()
+	if err != nil || len(manifests) != 3 {
+		t.Fatalf("List = %d backups, %v", len(manifests), err)
+	}
+	for i, manifest := range manifests {
+		if manifest.ID != ids[i] {
+			t.Fatalf("List()[%d] = %s, want %s", i, manifest.ID, ids[i])
+		}
+	}
+
+	if err := catalog.Delete(ids[1]); err != nil {
+		t.Fatalf("Delete: %s", err.Error())
+	}
+	if _, err := catalog.Get(ids[1]); err != ErrBackupNotFound {
+		t.Fatalf("Get deleted backup = %v", err)
+	}
+	if manifests, _ := catalog.List(); len(manifests) != 2 {
+		t.Fatalf("List after Delete = %d backups", len(manifests))
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	var manifests []*BackupManifest
+	// one backup every 6 hours for 10 days
+	for i := 0; i < 40; i++ {
+		at := start.Add(time.Duration(i) * 6 * time.Hour)
+		manifests = append(manifests, &BackupManifest{
+			ID:        at.Format(backupIDLayout),
+			StartTime: at,
+			EndTime:   at.Add(time.Minute),
+			Size:      100,
+		})
+	}
+	kept := func(policy RetentionPolicy) []string {
+		pruned := map[string]bool{}
+		for _, manifest := range policy.prune(manifests) {
+			pruned[manifest.ID] = true
+		}
+		var ids []string
+		for _, manifest := range manifests {
+			if !pruned[manifest.ID] {
+				ids = append(ids, manifest.StartTime.Format("01-02T15"))
+			}
+		}
+		return ids
+	}
+
+	if got := kept(RetentionPolicy{}); len(got) != 40 {
+		t.Fatalf("empty policy kept %d backups, want 40", len(got))
+	}
+	if got := kept(RetentionPolicy{KeepLast: 2}); !reflect.DeepEqual(got, []string{"10-10T12", "10-10T18"}) {
+		t.Fatalf("KeepLast 2 kept %v", got)
+	}
+	want := []string{"10-08T18", "10-09T18", "10-10T12", "10-10T18"}
+	if got := kept(RetentionPolicy{KeepLast: 2, KeepDaily: 3}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("KeepLast 2, KeepDaily 3 kept %v, want %v", got, want)
+	}
+	// Oct 4 and Oct 11 2026 are Sundays, ISO weeks end there
+	want = []string{"10-04T18", "10-10T18"}
+	if got := kept(RetentionPolicy{KeepWeekly: 5}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("KeepWeekly 5 kept %v, want %v", got, want)
+	}
+	if got := kept(RetentionPolicy{KeepDaily: 10, MaxTotalSize: 250}); !reflect.DeepEqual(got, []string{"10-09T18", "10-10T18"}) {
+		t.Fatalf("MaxTotalSize 250 kept %v", got)
+	}
+	// the newest backup survives even a size limit below its own size
+	if got := kept(RetentionPolicy{KeepLast: 3, MaxTotalSize: 1}); !reflect.DeepEqual(got, []string{"10-10T18"}) {
+		t.Fatalf("MaxTotalSize 1 kept %v", got)
+	}
+
+	// the bases of the kept increments count in the size, the oldest chain
+	// is dropped whole
+	manifests = nil
+	for i, parent := range []int{-1, -1, 0, 1} {
+		at := start.Add(time.Duration(i) * time.Hour)
+		manifest := &BackupManifest{ID: at.Format(backupIDLayout), StartTime: at, EndTime: at.Add(time.Minute), Size: 100}
+		if parent >= 0 {
+			manifest.Parent, manifest.Size = manifests[parent].ID, 10
+		}
+		manifests = append(manifests, manifest)
+	}
+	want = []string{"10-01T01", "10-01T03"}
+	if got := kept(RetentionPolicy{KeepLast: 2, MaxTotalSize: 150}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("MaxTotalSize 150 over increments kept %v, want %v", got, want)
+	}
+}
+
+// newTestBackup writes keys into a LevelDB at dir/main and backs it up with
+// mode into the catalog at dir/backup
+func newTestBackup(t *testing.T, dir, mode string, keys int) (*BackupCatalog, *BackupManifest) {
+	t.Helper()
+	catalog, err := NewBackupCatalog(path.Join(dir, "backup"))
+	if err != nil {
+		t.Fatalf("NewBackupCatalog: %s", err.Error())
+	}
+	return catalog, writeTestBackup(t, catalog, path.Join(dir, "main"), mode, keys)
+}
+
+// writeTestBackup writes keys into the LevelDB at src and backs it up with
+// mode into catalog
+func writeTestBackup(t *testing.T, catalog *BackupCatalog, src, mode string, keys int) *BackupManifest {
+	t.Helper()
+	mainDB, err := leveldb.OpenFile(src, nil)
+	if err != nil {
+		t.Fatalf("open mainDB: %s", err.Error())
+	}
+	for i := 0; i < keys; i++ {
+		mainDB.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)), nil)
+	}
+
+	b, err := catalog.begin(src, EngineMainTemp, mode)
+	if err != nil {
+		t.Fatalf("begin: %s", err.Error())
+	}
+	if isOnlineBackup(mode) {
+		snap, _ := mainDB.GetSnapshot()
+		_, err = b.writeOnline(snap)
+		snap.Release()
+		mainDB.Close()
+	} else {
+		mainDB.Close()
+		err = b.writeClosed(src)
+	}
+	if err != nil {
+		t.Fatalf("backup: %s", err.Error())
+	}
+	manifest, err := b.commit(-1)
+	if err != nil {
+		t.Fatalf("commit: %s", err.Error())
+	}
+	return manifest
+}
+
+func TestRestore(t *testing.T) {
+	for _, mode := range []string{BackupCopy, BackupCheckpoint, BackupSnapshot, BackupDump} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			catalog, manifest := newTestBackup(t, dir, mode, 100)
+
+			target := path.Join(dir, "restored", "main")
+			if err := catalog.Restore(manifest.ID, target); err != nil {
+				t.Fatalf("Restore: %s", err.Error())
+			}
+			restored, err := NewLevelDBNormal(target)
+			if err != nil {
+				t.Fatalf("open restored: %s", err.Error())
+			}
+			if value, err := restored.Get("key-0042"); err != nil || string(value) != "value-42" {
+				t.Fatalf("restored key-0042 = %q, %v", value, err)
+			}
+
+			// the target is locked by the open DB
+			if err := catalog.Restore(manifest.ID, target); !errors.Is(err, ErrDBInUse) {
+				t.Fatalf("Restore over an open DB = %v, want ErrDBInUse", err)
+			}
+			restored.Close()
+			// only a held lock means in use
+			empty := path.Join(dir, "empty")
+			os.MkdirAll(empty, 0755)
+			if err := checkNotInUse(empty); err != nil {
+				t.Fatalf("checkNotInUse of a folder without LOCK = %v", err)
+			}
+			notDir := path.Join(dir, "file")
+			os.WriteFile(notDir, nil, 0644)
+			if err := checkNotInUse(notDir); err == nil || errors.Is(err, ErrDBInUse) {
+				t.Fatalf("checkNotInUse of a file = %v, want an error other than ErrDBInUse", err)
+			}
+
+			// the engine state of the replaced mainDB is moved aside
+			restoredDir := path.Join(dir, "restored")
+			tempDB, _ := leveldb.OpenFile(path.Join(restoredDir, "temp"), nil)
+			tempDB.Put([]byte("key-0042"), []byte("stale"), nil)
+			tempDB.Close()
+			os.WriteFile(path.Join(restoredDir, mergeStateFileName), []byte("{}"), 0644)
+			os.MkdirAll(path.Join(restoredDir, "changelog"), 0755)
+			if err := catalog.Restore(manifest.ID, target); err != nil {
+				t.Fatalf("Restore over an engine: %s", err.Error())
+			}
+			for _, name := range []string{"temp", mergeStateFileName, "changelog"} {
+				if _, err := os.Stat(path.Join(restoredDir, name)); !os.IsNotExist(err) {
+					t.Fatalf("%s left next to the restored mainDB: %v", name, err)
+				}
+				if _, err := os.Stat(path.Join(target+".before-restore-"+manifest.ID, name)); err != nil {
+					t.Fatalf("%s not moved aside: %v", name, err)
+				}
+			}
+
+			file := path.Join(catalog.DataPath(manifest.ID), manifest.Files[0].Path)
+			os.WriteFile(file, []byte("garbage"), 0644)
+			if err := catalog.Restore(manifest.ID, target); !errors.Is(err, ErrBackupCorrupted) {
+				t.Fatalf("Restore of a corrupted backup = %v, want ErrBackupCorrupted", err)
+			}
+		})
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewDBRepositoryWithOptions(dir, "main", &Options{
+		BackupMode: BackupIncremental,
+		BackupRoot: path.Join(dir, "backup"),
+	})
+	for i := 0; i < 10; i++ {
+		repo.Put(fmt.Sprintf("key-%02d", i), []byte("value"))
+	}
+	if _, err := repo.backupMainDB(nil); err != nil {
+		t.Fatalf("full backup: %s", err.Error())
+	}
+	for i := 10; i < 15; i++ {
+		repo.Put(fmt.Sprintf("key-%02d", i), []byte("value"))
+	}
+	repo.Delete("key-00")
+	if _, err := repo.backupMainDB(nil); err != nil {
+		t.Fatalf("first increment: %s", err.Error())
+	}
+	repo.Put("key-15", []byte("value"))
+	if _, err := repo.backupMainDB(nil); err != nil {
+		t.Fatalf("second increment: %s", err.Error())
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+
+	manifests, err := repo.catalog.List()
+	if err != nil || len(manifests) != 3 {
+		t.Fatalf("List = %d backups, %v", len(manifests), err)
+	}
+	base, first, last := manifests[0], manifests[1], manifests[2]
+	if base.Mode != BackupSnapshot || base.Seq != 10 {
+		t.Fatalf("base = %s at seq %d, want a snapshot at seq 10", base.Mode, base.Seq)
+	}
+	if first.Parent != base.ID || first.FromSeq != 11 || first.Seq != 16 || first.Changes != 6 {
+		t.Fatalf("first increment = %+v", first)
+	}
+	if last.Parent != first.ID || last.Seq != 17 {
+		t.Fatalf("second increment = %+v", last)
+	}
+
+	// an increment keeps its whole chain
+	if prune, err := repo.catalog.PrunePlan(RetentionPolicy{KeepLast: 1}); err != nil || len(prune) != 0 {
+		t.Fatalf("PrunePlan = %d backups, %v", len(prune), err)
+	}
+
+	changes, err := openChangeLog(path.Join(dir, "changelog"), false)
+	if err != nil {
+		t.Fatalf("reopen change log: %s", err.Error())
+	}
+	if seq := changes.last(); seq != 17 {
+		t.Fatalf("reopened change log at seq %d, want 17", seq)
+	}
+	changes.close()
+
+	countKeys := func(target string) (int, bool) {
+		restored, err := leveldb.OpenFile(target, nil)
+		if err != nil {
+			t.Fatalf("open restored: %s", err.Error())
+		}
+		defer restored.Close()
+		count := 0
+		iter := restored.NewIterator(nil, nil)
+		for iter.Next() {
+			count++
+		}
+		iter.Release()
+		has, _ := restored.Has([]byte("key-00"), nil)
+		return count, has
+	}
+
+	if err := repo.catalog.Restore(last.ID, path.Join(dir, "all")); err != nil {
+		t.Fatalf("Restore: %s", err.Error())
+	}
+	if count, has := countKeys(path.Join(dir, "all")); count != 15 || has {
+		t.Fatalf("restored %d keys, key-00 %t; want 15 keys without key-00", count, has)
+	}
+
+	// seq 15 is the put of key-14, before the delete of key-00
+	if err := repo.catalog.RestoreToSequence(last.ID, path.Join(dir, "seq15"), 15); err != nil {
+		t.Fatalf("RestoreToSequence: %s", err.Error())
+	}
+	if count, has := countKeys(path.Join(dir, "seq15")); count != 15 || !has {
+		t.Fatalf("restored %d keys, key-00 %t; want 15 keys with key-00", count, has)
+	}
+
+	if err := repo.catalog.RestoreToSequence(last.ID, path.Join(dir, "seq5"), 5); !errors.Is(err, ErrSeqNotCovered) {
+		t.Fatalf("RestoreToSequence before the base = %v, want ErrSeqNotCovered", err)
+	}
+}
+
+func TestChangeLogAbort(t *testing.T) {
+	for _, name := range []string{EngineMainTemp, EngineRepo} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewStoreWithOptions(name, dir, &Options{
+				ChangeLog:     true,
+				ChangeLogSync: true,
+				BackupRoot:    path.Join(dir, "backup"),
+				Schedule:      &BackupSchedule{Manual: true},
+				MergePolicies: MergePolicies{"cnt/": AddCounter},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := store.(interface {
+				Store
+				Merge(key string, operand []byte) error
+			})
+			e.Put("cnt/x", []byte("abc"))
+			// logged, then failed to apply
+			if err := e.Merge("cnt/x", []byte("1")); err == nil {
+				t.Fatalf("counter merged into %q", "abc")
+			}
+			e.Put("after", []byte("v"))
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var sizes []int
+			err = replayChangeDir(path.Join(dir, "changelog"), 1, 0, func(c *change) error {
+				if c.seq != uint64(len(sizes)+1) {
+					t.Fatalf("change %d after %d", c.seq, len(sizes))
+				}
+				sizes = append(sizes, c.batch.Len())
+				return nil
+			})
+			if err != nil || fmt.Sprint(sizes) != "[1 0 1]" {
+				t.Fatalf("replayed batch sizes %v, %v, want the failed merge empty", sizes, err)
+			}
+		})
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewDBRepositoryWithOptions(dir, "main", &Options{
+		BackupMode: BackupSnapshot,
+		BackupRoot: path.Join(dir, "backup"),
+		ChangeLog:  true,
+	})
+	for i := 0; i < 10; i++ {
+		repo.Put(fmt.Sprintf("key-%02d", i), []byte("value"))
+	}
+	if _, err := repo.backupMainDB(nil); err != nil {
+		t.Fatalf("backup: %s", err.Error())
+	}
+	repo.Put("key-10", []byte("value"))
+	repo.Delete("key-00")
+	time.Sleep(10 * time.Millisecond)
+	incident := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	repo.Put("key-11", []byte("bad"))
+	repo.Put("key-01", []byte("bad"))
+
+	catalog := repo.catalog
+	source := path.Join(dir, "main")
+	changeLog := path.Join(dir, "changelog")
+
+	// the change log of a running engine can be followed
+	report, err := catalog.Recover(source, changeLog, path.Join(dir, "time"), RecoveryTarget{Time: incident})
+	if err != nil {
+		t.Fatalf("Recover to time: %s", err.Error())
+	}
+	if report.BaseSeq != 10 || report.Seq != 12 || report.Changes != 2 || report.KeyCount != 10 {
+		t.Fatalf("Recover to time = %+v", report)
+	}
+	if count, sum, err := Checksum(path.Join(dir, "time")); err != nil || count != report.KeyCount || sum != report.SHA256 {
+		t.Fatalf("Checksum = %d %s, %v; report %d %s", count, sum, err, report.KeyCount, report.SHA256)
+	}
+
+	report, err = catalog.Recover(source, changeLog, path.Join(dir, "seq"), RecoveryTarget{Seq: 11})
+	if err != nil || report.Seq != 11 || report.KeyCount != 11 {
+		t.Fatalf("Recover to seq = %+v, %v", report, err)
+	}
+	if _, err := catalog.Recover(source, changeLog, path.Join(dir, "seq"), RecoveryTarget{Seq: 11}); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Recover into an existing folder = %v, want os.ErrExist", err)
+	}
+	if _, err := catalog.Recover(source, changeLog, path.Join(dir, "early"), RecoveryTarget{Seq: 5}); !errors.Is(err, ErrNoRecoveryPoint) {
+		t.Fatalf("Recover before the first backup = %v, want ErrNoRecoveryPoint", err)
+	}
+	if _, err := catalog.Recover(source, changeLog, path.Join(dir, "late"), RecoveryTarget{Seq: 100}); !errors.Is(err, ErrSeqNotCovered) {
+		t.Fatalf("Recover after the change log = %v, want ErrSeqNotCovered", err)
+	}
+
+	// the live DB matches a recovery up to its last change
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	report, err = catalog.Recover(source, changeLog, path.Join(dir, "latest"), RecoveryTarget{})
+	if err != nil {
+		t.Fatalf("Recover latest: %s", err.Error())
+	}
+	if count, sum, err := Checksum(source); err != nil || count != report.KeyCount || sum != report.SHA256 {
+		t.Fatalf("live Checksum = %d %s, %v; report %+v", count, sum, err, report)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	for _, mode := range []string{BackupCopy, BackupCheckpoint, BackupSnapshot, BackupDump} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			catalog, manifest := newTestBackup(t, dir, mode, 100)
+
+			// diff against the source DB after a put, a delete and an overwrite
+			liveDB, err := leveldb.OpenFile(path.Join(dir, "main"), nil)
+			if err != nil {
+				t.Fatalf("open mainDB: %s", err.Error())
+			}
+			liveDB.Put([]byte("key-9999"), []byte("new"), nil)
+			liveDB.Delete([]byte("key-0000"), nil)
+			liveDB.Put([]byte("key-0050"), []byte("changed"), nil)
+			result, err := catalog.Verify(manifest.ID, VerifyOptions{Live: liveDB})
+			liveDB.Close()
+			if err != nil {
+				t.Fatalf("Verify: %s", err.Error())
+			}
+			if result.OK || result.KeyCount != 100 {
+				t.Fatalf("Verify against a changed DB = ok %t, %d keys", result.OK, result.KeyCount)
+			}
+			if diff := result.Diff; diff.Missing != 1 || diff.Extra != 1 || diff.Changed != 1 {
+				t.Fatalf("Diff = %+v", diff)
+			}
+
+			result, err = catalog.Verify(manifest.ID, VerifyOptions{})
+			if err != nil || !result.OK {
+				t.Fatalf("Verify = %+v, %v", result, err)
+			}
+			if manifest, _ = catalog.Get(manifest.ID); manifest.Verification == nil || !manifest.Verification.OK {
+				t.Fatalf("Get does not load the verification: %+v", manifest.Verification)
+			}
+
+			file := path.Join(catalog.DataPath(manifest.ID), manifest.Files[len(manifest.Files)-1].Path)
+			os.WriteFile(file, []byte("garbage"), 0644)
+			if result, err := catalog.Verify(manifest.ID, VerifyOptions{}); err != nil || result.OK {
+				t.Fatalf("Verify of a corrupted backup = %+v, %v", result, err)
+			}
+			if manifest, _ = catalog.Get(manifest.ID); manifest.Verification.OK {
+				t.Fatalf("corrupted backup is not flagged")
+			}
+		})
+	}
+}
+
+func TestVerifyBackupsOption(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewDBRepositoryWithOptions(dir, "main", &Options{
+		BackupRoot:    path.Join(dir, "backup"),
+		VerifyBackups: true,
+	})
+	defer repo.Close()
+	for i := 0; i < 100; i++ {
+		repo.Put(fmt.Sprintf("key-%04d", i), []byte("value"))
+	}
+	if _, err := repo.backupMainDB(nil); err != nil {
+		t.Fatalf("backup: %s", err.Error())
+	}
+
+	manifests, err := repo.catalog.List()
+	if err != nil || len(manifests) != 1 {
+		t.Fatalf("List = %d backups, %v", len(manifests), err)
+	}
+	result := manifests[0].Verification
+	if result == nil || !result.OK || result.Diff == nil || result.KeyCount != 100 {
+		t.Fatalf("Verification = %+v", result)
+	}
+}
+
+func TestArchiveBackup(t *testing.T) {
+	archiveKDFIterations = 1000
+	dir := t.TempDir()
+	keyFile := path.Join(dir, "backup.key")
+	os.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+
+	archives := map[string]*ArchiveOptions{
+		"plain":      {},
+		"keyfile":    {KeyFile: keyFile},
+		"passphrase": {Passphrase: "secret"},
+	}
+	for name, o := range archives {
+		for _, mode := range []string{BackupCopy, BackupSnapshot, BackupDump} {
+			t.Run(name+"/"+mode, func(t *testing.T) {
+				dir := t.TempDir()
+				catalog, err := NewBackupCatalog(path.Join(dir, "backup"))
+				if err != nil {
+					t.Fatalf("NewBackupCatalog: %s", err.Error())
+				}
+				catalog.SetArchive(o)
+				manifest := writeTestBackup(t, catalog, path.Join(dir, "main"), mode, 100)
+				if manifest.Format != o.format() || len(manifest.Files) != 1 || manifest.KeyCount != 100 {
+					t.Fatalf("manifest = %s with %d files and %d keys", manifest.Format, len(manifest.Files), manifest.KeyCount)
+				}
+				if result, err := catalog.Verify(manifest.ID, VerifyOptions{}); err != nil || !result.OK {
+					t.Fatalf("Verify = %+v, %v", result, err)
+				}
+
+				target := path.Join(dir, "restored")
+				if err := catalog.Restore(manifest.ID, target); err != nil {
+					t.Fatalf("Restore: %s", err.Error())
+				}
+				restored, err := NewLevelDBNormal(target)
+				if err != nil {
+					t.Fatalf("open restored: %s", err.Error())
+				}
+				if value, err := restored.Get("key-0042"); err != nil || string(value) != "value-42" {
+					t.Fatalf("restored key-0042 = %q, %v", value, err)
+				}
+				restored.Close()
+			})
+		}
+	}
+
+	catalog, err := NewBackupCatalog(path.Join(dir, "backup"))
+	if err != nil {
+		t.Fatalf("NewBackupCatalog: %s", err.Error())
+	}
+	catalog.SetArchive(archives["passphrase"])
+	manifest := writeTestBackup(t, catalog, path.Join(dir, "main"), BackupCopy, 100)
+	archive := path.Join(catalog.DataPath(manifest.ID), manifest.Files[0].Path)
+
+	catalog.SetArchive(&ArchiveOptions{Passphrase: "wrong"})
+	if err := catalog.Restore(manifest.ID, path.Join(dir, "wrong")); !errors.Is(err, ErrArchiveAuth) {
+		t.Fatalf("Restore with a wrong passphrase = %v, want ErrArchiveAuth", err)
+	}
+	catalog.SetArchive(nil)
+	if err := catalog.Restore(manifest.ID, path.Join(dir, "nokey")); !errors.Is(err, ErrArchiveKeyRequired) {
+		t.Fatalf("Restore without key = %v, want ErrArchiveKeyRequired", err)
+	}
+
+	// two archives under one key file get their own key
+	var headers [2]bytes.Buffer
+	var keys [2][]byte
+	for i := range headers {
+		if _, err := newEncryptWriter(&headers[i], archives["keyfile"]); err != nil {
+			t.Fatal(err)
+		}
+		n := len(encryptedMagic)
+		header := headers[i].Bytes()
+		if keys[i], err = archives["keyfile"].key(header[n], header[n+1:n+1+kdfSaltSize], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Equal(keys[0], keys[1]) {
+		t.Fatalf("two archives sealed with the same key %x", keys[0])
+	}
+	// RFC 5869 test case 1
+	okm := hkdfSHA256(bytes.Repeat([]byte{0x0b}, 22), []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		[]byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9}, 42)
+	if hex.EncodeToString(okm) != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Fatalf("hkdfSHA256 = %x", okm)
+	}
+
+	// tamper with the archive and its manifest checksum
+	catalog.SetArchive(archives["passphrase"])
+	data, _ := os.ReadFile(archive)
+	data[len(data)/2] ^= 1
+	os.WriteFile(archive, data, 0644)
+	sum, _ := hashFile(archive)
+	manifest.Files[0].SHA256 = sum
+	manifest.Verification = nil
+	encoded, _ := json.Marshal(manifest)
+	os.WriteFile(filepath.Join(catalog.Root(), manifest.ID, manifestFileName), encoded, 0644)
+	err = catalog.Restore(manifest.ID, path.Join(dir, "tampered"))
+	if !errors.Is(err, ErrArchiveAuth) || !errors.Is(err, ErrBackupCorrupted) {
+		t.Fatalf("Restore of a tampered archive = %v, want ErrArchiveAuth", err)
+	}
+}
+
+// fakeS3 is an in-process S3-compatible object server keeping objects in
+// memory. failPart makes the upload of that part number fail once, pageSize
+// truncates the listings of uploads and parts
+type fakeS3 struct {
+	mu          sync.Mutex
+	objects     map[string][]byte
+	uploads     map[string]*fakeUpload
+	nextUpload  int
+	failPart    int
+	partUploads int
+	pageSize    int
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, uploads: map[string]*fakeUpload{}}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") ||
+		r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	bucketKey := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(bucketKey) == 2 {
+		key = bucketKey[1]
+	}
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	writeXML := func(v interface{}) {
+		data, _ := xml.Marshal(v)
+		w.Write(data)
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+		Size       int
+	}
+	etag := func(data []byte) string {
+		sum := md5.Sum(data)
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+
+	switch {
+	case key == "" && query.Has("uploads"):
+		type upload struct{ Key, UploadId string }
+		var result struct {
+			XMLName            xml.Name `xml:"ListMultipartUploadsResult"`
+			Uploads            []upload `xml:"Upload"`
+			IsTruncated        bool
+			NextKeyMarker      string
+			NextUploadIdMarker string
+		}
+		marker := upload{Key: query.Get("key-marker"), UploadId: query.Get("upload-id-marker")}
+		for id, u := range s.uploads {
+			if strings.HasPrefix(u.key, query.Get("prefix")) &&
+				(u.key > marker.Key || u.key == marker.Key && id > marker.UploadId) {
+				result.Uploads = append(result.Uploads, upload{Key: u.key, UploadId: id})
+			}
+		}
+		sort.Slice(result.Uploads, func(i, j int) bool {
+			a, b := result.Uploads[i], result.Uploads[j]
+			return a.Key < b.Key || a.Key == b.Key && a.UploadId < b.UploadId
+		})
+		if s.pageSize > 0 && len(result.Uploads) > s.pageSize {
+			result.Uploads = result.Uploads[:s.pageSize]
+			last := result.Uploads[s.pageSize-1]
+			result.IsTruncated, result.NextKeyMarker, result.NextUploadIdMarker = true, last.Key, last.UploadId
+		}
+		writeXML(result)
+	case key == "":
+		type content struct {
+			Key  string
+			Size int
+		}
+		var result struct {
+			XMLName  xml.Name  `xml:"ListBucketResult"`
+			Contents []content `xml:"Contents"`
+		}
+		for k, data := range s.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) {
+				result.Contents = append(result.Contents, content{Key: k, Size: len(data)})
+			}
+		}
+		writeXML(result)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextUpload++
+		id := fmt.Sprintf("upload-%d", s.nextUpload)
+		s.uploads[id] = &fakeUpload{key: key, parts: map[int][]byte{}}
+		writeXML(struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadId string
+		}{UploadId: id})
+	case r.Method == http.MethodPost:
+		u := s.uploads[query.Get("uploadId")]
+		var complete struct {
+			Parts []part `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, p := range complete.Parts {
+			if etag(u.parts[p.PartNumber]) != p.ETag {
+				http.Error(w, "<Error><Code>InvalidPart</Code></Error>", http.StatusBadRequest)
+				return
+			}
+			data = append(data, u.parts[p.PartNumber]...)
+		}
+		s.objects[key] = data
+		delete(s.uploads, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == s.failPart {
+			s.failPart = 0
+			http.Error(w, "<Error><Code>InternalError</Code></Error>", http.StatusInternalServerError)
+			return
+		}
+		s.partUploads++
+		s.uploads[query.Get("uploadId")].parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		var result struct {
+			XMLName              xml.Name `xml:"ListPartsResult"`
+			Parts                []part   `xml:"Part"`
+			IsTruncated          bool
+			NextPartNumberMarker int
+		}
+		marker, _ := strconv.Atoi(query.Get("part-number-marker"))
+		for number, data := range s.uploads[query.Get("uploadId")].parts {
+			if number > marker {
+				result.Parts = append(result.Parts, part{PartNumber: number, ETag: etag(data), Size: len(data)})
+			}
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		if s.pageSize > 0 && len(result.Parts) > s.pageSize {
+			result.Parts = result.Parts[:s.pageSize]
+			result.IsTruncated, result.NextPartNumberMarker = true, result.Parts[s.pageSize-1].PartNumber
+		}
+		writeXML(result)
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestBackupTargets(t *testing.T) {
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+
+	dir := t.TempDir()
+	local, err := NewLocalTarget(path.Join(dir, "mount"))
+	if err != nil {
+		t.Fatalf("NewLocalTarget: %s", err.Error())
+	}
+	s3 := NewS3Target(server.URL, "us-east-1", "backups", "leveldblab", "test", "secret")
+	s3.PartSize = 1024
+
+	for _, target := range []BackupTarget{local, s3} {
+		t.Run(fmt.Sprintf("%T", target), func(t *testing.T) {
+			dir := t.TempDir()
+			catalog, manifest := newTestBackup(t, dir, BackupCopy, 1000)
+			if err := catalog.Push(target, manifest.ID); err != nil {
+				t.Fatalf("Push: %s", err.Error())
+			}
+			manifests, err := ListTarget(target)
+			if err != nil || len(manifests) != 1 || manifests[0].ID != manifest.ID {
+				t.Fatalf("ListTarget = %d backups, %v", len(manifests), err)
+			}
+
+			other, err := NewBackupCatalog(path.Join(dir, "other"))
+			if err != nil {
+				t.Fatalf("NewBackupCatalog: %s", err.Error())
+			}
+			if err := other.Pull(target, manifest.ID); err != nil {
+				t.Fatalf("Pull: %s", err.Error())
+			}
+			if err := other.Restore(manifest.ID, path.Join(dir, "restored")); err != nil {
+				t.Fatalf("Restore of a pulled backup: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestBackupTargetResume(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 10*1024+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	file := path.Join(dir, "file")
+	os.WriteFile(file, data, 0644)
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s3 := NewS3Target(server.URL, "us-east-1", "backups", "", "test", "secret")
+	s3.PartSize = 1024
+
+	fake.pageSize = 1
+	fake.failPart = 4
+	if err := s3.Put("key", file); err == nil {
+		t.Fatalf("Put with a failing part succeeded")
+	}
+	// an older upload of key, abandoned before any part, listed on the page
+	// before the one to resume
+	fake.uploads["upload-0"] = &fakeUpload{key: "key", parts: map[int][]byte{}}
+	if err := s3.Put("key", file); err != nil {
+		t.Fatalf("resumed Put: %s", err.Error())
+	}
+	if fake.partUploads != 11 {
+		t.Fatalf("uploaded %d parts, want 11: the resumed Put sent parts again", fake.partUploads)
+	}
+	var got bytes.Buffer
+	if err := s3.Get("key", &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("Get = %d bytes, %v", got.Len(), err)
+	}
+	if err := s3.Get("missing", &got); !errors.Is(err, ErrTargetNotFound) {
+		t.Fatalf("Get of a missing key = %v, want ErrTargetNotFound", err)
+	}
+
+	// a target without PartSize nor Client takes the defaults
+	bare := &S3Target{Endpoint: server.URL, Region: "us-east-1", Bucket: "backups", AccessKey: "test", SecretKey: "secret"}
+	if err := bare.Put("bare", file); err != nil {
+		t.Fatalf("Put without PartSize nor Client: %s", err.Error())
+	}
+	got.Reset()
+	if err := bare.Get("bare", &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("Get without PartSize nor Client = %d bytes, %v", got.Len(), err)
+	}
+
+	// a stalled connection fails the Put
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+	s3 = NewS3Target(stalled.URL, "us-east-1", "backups", "", "test", "secret")
+	s3.Client.Timeout = 50 * time.Millisecond
+	if err := s3.Put("key", file); err == nil {
+		t.Fatalf("Put to a stalled server succeeded")
+	}
+
+	// a local copy interrupted after 100 bytes
+	local, _ := NewLocalTarget(path.Join(dir, "mount"))
+	os.WriteFile(path.Join(dir, "mount", "key"+partSuffix), data[:100], 0644)
+	if err := local.Put("key", file); err != nil {
+		t.Fatalf("resumed local Put: %s", err.Error())
+	}
+	if copied, _ := os.ReadFile(path.Join(dir, "mount", "key")); !bytes.Equal(copied, data) {
+		t.Fatalf("resumed local copy has %d bytes, want %d", len(copied), len(data))
+	}
+}
+
+func TestPullInvalidManifest(t *testing.T) {
+	dir := t.TempDir()
+	target, err := NewLocalTarget(path.Join(dir, "mount"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := NewBackupCatalog(path.Join(dir, "catalog", "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := time.Now().UTC().Format(backupIDLayout)
+	parent := time.Now().UTC().Add(-time.Hour).Format(backupIDLayout)
+	push := func(id string, manifest BackupManifest) {
+		data, _ := json.Marshal(manifest)
+		os.MkdirAll(path.Join(dir, "mount", id), 0755)
+		os.WriteFile(path.Join(dir, "mount", id, manifestFileName), data, 0644)
+	}
+	os.WriteFile(path.Join(dir, "evil"), []byte("keep"), 0644)
+
+	for name, manifest := range map[string]BackupManifest{
+		"file outside":  {ID: id, Files: []BackupFile{{Path: "../../../../evil"}}},
+		"absolute file": {ID: id, Files: []BackupFile{{Path: "/evil"}}},
+		"parent":        {ID: id, Parent: "../../evil"},
+		"other id":      {ID: parent},
+	} {
+		push(id, manifest)
+		if err := catalog.Pull(target, id); !errors.Is(err, ErrInvalidManifest) {
+			t.Fatalf("%s: Pull = %v, want ErrInvalidManifest", name, err)
+		}
+		if _, err := os.Stat(path.Join(dir, "catalog", "backups", id)); !os.IsNotExist(err) {
+			t.Fatalf("%s: Pull wrote the backup folder: %v", name, err)
+		}
+	}
+
+	// the parent is checked before its files are downloaded
+	push(id, BackupManifest{ID: id, Parent: parent})
+	push(parent, BackupManifest{ID: parent, Files: []BackupFile{{Path: "../../../../evil"}}})
+	if err := catalog.Pull(target, id); !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("Pull of an invalid parent = %v, want ErrInvalidManifest", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "catalog", "backups", parent)); !os.IsNotExist(err) {
+		t.Fatalf("Pull wrote the parent folder: %v", err)
+	}
+	if err := catalog.Pull(target, "../evil"); !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("Pull of a path = %v, want ErrInvalidManifest", err)
+	}
+	if data, _ := os.ReadFile(path.Join(dir, "evil")); string(data) != "keep" {
+		t.Fatalf("Pull overwrote a file outside the catalog: %q", data)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 7, 30, 0, time.UTC)
+	cases := map[string]time.Time{
+		"*/15 * * * *":  time.Date(2024, 1, 31, 10, 15, 0, 0, time.UTC),
+		"0 3 * * *":     time.Date(2024, 2, 1, 3, 0, 0, 0, time.UTC),
+		"30 2 29 2 *":   time.Date(2024, 2, 29, 2, 30, 0, 0, time.UTC),
+		"0 0 * * 1-5/2": time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC), // Friday
+		"0 12 15 * 0":   time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC),
+		"@monthly":      time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for spec, want := range cases {
+		cron, err := parseCron(spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %s", spec, err.Error())
+		}
+		if got := cron.next(from); !got.Equal(want) {
+			t.Fatalf("next of %q = %s, want %s", spec, got, want)
+		}
+	}
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Fatalf("parseCron(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestBackupSchedule(t *testing.T) {
+	backups := func(repo *DBRepo) int {
+		manifests, _ := repo.catalog.List()
+		return len(manifests)
+	}
+	waitBackups := func(repo *DBRepo, n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); backups(repo) < n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d backups, want %d", backups(repo), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	dir := t.TempDir()
+	manual := NewDBRepositoryWithOptions(dir, "main", &Options{
+		BackupMode: BackupSnapshot,
+		BackupRoot: path.Join(dir, "backup"),
+		Schedule:   &BackupSchedule{Manual: true},
+	})
+	manual.Put("key", []byte("value"))
+	manual.TriggerBackup()
+	waitBackups(manual, 1)
+	manual.Close()
+
+	dir = t.TempDir()
+	repo := NewDBRepositoryWithOptions(dir, "main", &Options{
+		BackupMode: BackupSnapshot,
+		BackupRoot: path.Join(dir, "backup"),
+		Schedule:   &BackupSchedule{Interval: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, MinWrites: 5},
+	})
+	defer repo.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := backups(repo); n != 0 {
+		t.Fatalf("%d backups without writes, want none", n)
+	}
+	for i := 0; i < 5; i++ {
+		repo.Put(fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+	waitBackups(repo, 1)
+}
+
+func TestBackupProgress(t *testing.T) {
+	dir := t.TempDir()
+	src := path.Join(dir, "main")
+	main, err := leveldb.OpenFile(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		main.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"), nil)
+	}
+	snap, err := main.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	catalog, err := NewBackupCatalog(path.Join(dir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := &backupControl{}
+	run := control.start(0)
+	b, err := catalog.begin(src, EngineMainTemp, BackupSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.track(b)
+	if _, err := b.writeOnline(snap); err != nil {
+		t.Fatal(err)
+	}
+	progress := control.progress()
+	if progress.ID != b.manifest.ID || progress.Records != 100 || progress.RecordsTotal != 100 ||
+		progress.Bytes != progress.BytesTotal || progress.Remaining() != 0 {
+		t.Fatalf("progress %+v after the backup", progress)
+	}
+	control.finish(run, b.manifest, nil)
+	if progress := control.progress(); progress != nil {
+		t.Fatalf("progress %+v without a running backup", progress)
+	}
+
+	// a cancelled run stops before copying anything
+	main.Close()
+	run = control.start(0)
+	b, err = catalog.begin(src, EngineMainTemp, BackupCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.track(b)
+	control.cancel()
+	if err := b.writeClosed(src); !errors.Is(err, context.Canceled) {
+		t.Fatalf("writeClosed after cancel: %v", err)
+	}
+	if progress := control.progress(); progress.Files != 0 || progress.FilesTotal == 0 || progress.Remaining() != -1 {
+		t.Fatalf("progress %+v of a cancelled backup", progress)
+	}
+}
+
+func TestBackupCancel(t *testing.T) {
+	dir := t.TempDir()
+	root := path.Join(dir, "backup")
+	dm, err := NewDBWithOptions(dir, &Options{
+		BackupMode: BackupCopy,
+		BackupRoot: root,
+		Schedule:   &BackupSchedule{Manual: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.Close()
+	dm.Put("key", bytes.Repeat([]byte("v"), 64<<10))
+
+	// the throttled backup copies until it is cancelled
+	slow := RateLimit{BytesPerSec: 1 << 10}
+	dm.SetBackupRate(slow)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := dm.Backup(ctx)
+		done <- err
+	}()
+	for dm.BackupProgress() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled backup returned %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Fatalf("%d entries left in the catalog", len(entries))
+	}
+
+	if _, err := dm.WaitState(context.Background(), StateNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := dm.Put("after", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	dm.SetBackupRate(RateLimit{})
+	manifest, err := dm.Backup(context.Background())
+	if err != nil || manifest == nil {
+		t.Fatalf("backup after cancel: %v %v", manifest, err)
+	}
+	if stats, _ := dm.Stats(); stats.Backup != nil {
+		t.Fatalf("progress %+v after the backup", stats.Backup)
+	}
+
+	// the throttled DBRepo backup runs past its deadline
+	dir = t.TempDir()
+	repo := NewDBRepositoryWithOptions(dir, "main", &Options{
+		BackupMode: BackupCopy,
+		BackupRoot: path.Join(dir, "backup"),
+		Schedule:   &BackupSchedule{Manual: true},
+		BackupRate: slow,
+	})
+	defer repo.Close()
+	repo.Put("key", bytes.Repeat([]byte("v"), 64<<10))
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		_, err := repo.Backup(ctx)
+		done <- err
+	}()
+	for repo.BackupProgress() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	repo.Put("during", []byte("value"))
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("backup past its deadline returned %v", err)
+	}
+	if manifests, _ := repo.catalog.List(); len(manifests) != 0 {
+		t.Fatalf("%d backups after cancel", len(manifests))
+	}
+	if stats, _ := repo.Stats(); stats.OnBackup {
+		t.Fatal("repo still on backup after cancel")
+	}
+	for _, key := range []string{"key", "during"} {
+		if _, err := repo.Get(key); err != nil {
+			t.Fatalf("get %s after cancel: %v", key, err)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	limit := newThrottle(RateLimit{BytesPerSec: 10000})
+	start := time.Now()
+	// the first second of tokens is free, the next 5000 bytes take 500ms
+	for i := 0; i < 15; i++ {
+		if err := limit.wait(ctx, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("15000 bytes at 10000 bytes/s took %s", elapsed)
+	}
+
+	// lifting the limit wakes up a sleeping caller
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limit.set(RateLimit{})
+	}()
+	start = time.Now()
+	limit.wait(ctx, 100000)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("wait took %s after the limit was lifted", elapsed)
+	}
+	if err := limit.wait(ctx, 1<<30); err != nil {
+		t.Fatalf("unlimited wait: %v", err)
+	}
+
+	limit.set(RateLimit{OpsPerSec: 1})
+	limit.wait(ctx, 0)
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := limit.wait(timeout, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait past the deadline returned %v", err)
+	}
+
+	// a paced backup copy
+	dir := t.TempDir()
+	src := path.Join(dir, "main")
+	main, err := leveldb.OpenFile(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		main.Put([]byte(fmt.Sprintf("key-%03d", i)), bytes.Repeat([]byte("v"), 1000), nil)
+	}
+	main.Close()
+	files, size, err := dirSize(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &backupProgress{limit: newThrottle(RateLimit{BytesPerSec: size / 2})}
+	start = time.Now()
+	if err := backupClosed(ctx, BackupCopy, src, path.Join(dir, "copy"), 1, p); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || p.files != files || p.bytes != size {
+		t.Fatalf("copy of %d bytes at %d bytes/s took %s, progress %+v", size, size/2, elapsed, p)
+	}
+}
+
+func TestParallelCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := path.Join(dir, "main")
+	main, err := leveldb.OpenFile(src, &opt.Options{WriteBuffer: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		main.Put([]byte(fmt.Sprintf("key-%05d", i)), bytes.Repeat([]byte{byte(i)}, 100), nil)
+	}
+	main.Close()
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	os.WriteFile(path.Join(src, "sub", "file"), []byte("nested"), 0644)
+
+	if err := cp.Copy(src, path.Join(dir, "sequential")); err != nil {
+		t.Fatal(err)
+	}
+	want, err := hashFiles(path.Join(dir, "sequential"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) < 4 {
+		t.Fatalf("only %d files to copy", len(want))
+	}
+	for _, workers := range []int{1, 8} {
+		dst := path.Join(dir, fmt.Sprintf("workers-%d", workers))
+		p := &backupProgress{}
+		if err := copyDir(context.Background(), src, dst, workers, p); err != nil {
+			t.Fatal(err)
+		}
+		files, err := hashFiles(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(files, want) {
+			t.Fatalf("%d workers copied %v, want %v", workers, files, want)
+		}
+		if count, size, _ := dirSize(src); p.files != count || p.bytes != size {
+			t.Fatalf("%d workers counted %d files %d bytes, want %d %d", workers, p.files, p.bytes, count, size)
+		}
+	}
+
+	// a cancelled copy stops every worker
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := copyDir(ctx, src, path.Join(dir, "cancelled"), 8, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled copy returned %v", err)
+	}
+}
+
+func TestMergeResume(t *testing.T) {
+	dir := t.TempDir()
+	statePath := path.Join(dir, mergeStateFileName)
+	mainDB, err := leveldb.OpenFile(path.Join(dir, "main"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempDB := &levelDBWrapper{path: path.Join(dir, "temp"), temp: true}
+	if err := tempDB.open(); err != nil {
+		t.Fatal(err)
+	}
+	tempDB.put([]byte("a"), []byte("1"))
+	tempDB.put([]byte("b"), []byte("2"))
+
+	// mainDB fails, the records stay in tempDB
+	mainDB.Close()
+	report, err := mergeTemp(context.Background(), mainDB, tempDB.db, &sync.RWMutex{}, false, nil, nil, statePath)
+	if err == nil || report.Failed != 2 || !reflect.DeepEqual(report.FailedKeys, []string{"a", "b"}) {
+		t.Fatalf("merge into a closed mainDB = %+v, %v", report, err)
+	}
+	if saved, err := readMergeState(statePath); err != nil || saved.Failed != 2 || saved.End.IsZero() {
+		t.Fatalf("saved state %+v, %v", saved, err)
+	}
+	if temp, _ := readRecord(tempDB.db, []byte("a")); temp == nil {
+		t.Fatal("failed record removed from tempDB")
+	}
+
+	// a crash after "a" reached mainDB and "gone" was deleted there, before
+	// tempDB was cleaned up and the merge finished
+	if mainDB, err = leveldb.OpenFile(path.Join(dir, "main"), nil); err != nil {
+		t.Fatal(err)
+	}
+	mainDB.Put([]byte("a"), []byte("1"), nil)
+	tempDB.delete([]byte("gone"))
+	mainDB.Close()
+	tempDB.close()
+	saveMergeState(statePath, &MergeReport{Start: time.Now().Add(-time.Minute), Moved: 1})
+
+	dm, err := NewDBWithOptions(dir, &Options{Schedule: &BackupSchedule{Manual: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.Close()
+	report = dm.LastMerge()
+	if report == nil || !report.Resumed || report.Moved != 4 || report.Failed != 0 || report.End.IsZero() {
+		t.Fatalf("resumed merge %+v", report)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if value, err := dm.Get(key); err != nil || string(value) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	if _, err := dm.Get("gone"); err != leveldb.ErrNotFound {
+		t.Fatalf("deleted key resurrected: %v", err)
+	}
+	if temp, _ := readRecord(dm.tempDB.db, []byte("a")); temp != nil {
+		t.Fatal("record left in tempDB after the resumed merge")
+	}
+}
+
+func TestMergeResumeOperand(t *testing.T) {
+	dir := t.TempDir()
+	mainDB, err := leveldb.OpenFile(path.Join(dir, "main"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainDB.Put([]byte("cnt/x"), []byte("1"), nil)
+	tempDB := &levelDBWrapper{path: path.Join(dir, "temp"), temp: true}
+	if err := tempDB.open(); err != nil {
+		t.Fatal(err)
+	}
+	tempDB.merge(AddCounter, []byte("cnt/x"), []byte("1"))
+
+	// a crash after the mainDB write, before the operand left tempDB
+	policies := MergePolicies{"cnt/": AddCounter}
+	raw, err := tempDB.db.Get([]byte("cnt/x"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := []mergeRecord{{key: []byte("cnt/x"), raw: raw, record: decodeRecord(raw)}}
+	mainBatch, _, _, err := resolveMerge(mainDB, tempDB.db, false, policies, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mainDB.Write(mainBatch, mergeWo); err != nil {
+		t.Fatal(err)
+	}
+	mainDB.Close()
+	tempDB.close()
+
+	dm, err := NewDBWithOptions(dir, &Options{Schedule: &BackupSchedule{Manual: true}, MergePolicies: policies})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.Close()
+	if value, err := dm.Get("cnt/x"); err != nil || string(value) != "2" {
+		t.Fatalf("counter after the resumed merge = %q, %v, want 2", value, err)
+	}
+}
+
+func TestMergePolicies(t *testing.T) {
+	dbPath := t.TempDir()
+	mainDB := &levelDBWrapper{path: path.Join(dbPath, "main"), versioned: true}
+	tempDB := &levelDBWrapper{path: path.Join(dbPath, "temp"), temp: true}
+	for _, dw := range []*levelDBWrapper{mainDB, tempDB} {
+		if err := dw.open(); err != nil {
+			t.Fatalf("open %s: %s", dw.path, err.Error())
+		}
+		defer dw.close()
+	}
+	policies := MergePolicies{
+		"cnt/":  AddCounter,
+		"set/":  SetUnion,
+		"keep/": KeepMain,
+		"max/": ResolverFunc(func(key []byte, main, temp MergeValue) MergeValue {
+			m, _ := strconv.Atoi(string(main.Value))
+			n, _ := strconv.Atoi(string(temp.Value))
+			if m > n {
+				return main
+			}
+			return temp
+		}),
+	}
+	dm := &LevelDBManager{mainDB: mainDB, tempDB: tempDB, policies: policies, state: newStateMachine()}
+
+	mainDB.put([]byte("cnt/a"), []byte("10"))
+	mainDB.put([]byte("set/s"), EncodeSet([]byte("a"), []byte("b")))
+	mainDB.put([]byte("keep/k"), []byte("main"))
+	mainDB.put([]byte("max/m"), []byte("7"))
+	mainDB.put([]byte("plain"), []byte("main"))
+
+	// written during the backup window
+	tempDB.merge(AddCounter, []byte("cnt/a"), []byte("5"))
+	tempDB.merge(AddCounter, []byte("cnt/a"), []byte("5"))
+	tempDB.merge(AddCounter, []byte("cnt/new"), []byte("3"))
+	tempDB.merge(SetUnion, []byte("set/s"), EncodeSet([]byte("c"), []byte("a")))
+	tempDB.put([]byte("keep/k"), []byte("temp"))
+	tempDB.put([]byte("keep/new"), []byte("temp"))
+	tempDB.put([]byte("max/m"), []byte("3"))
+	tempDB.put([]byte("plain"), []byte("temp"))
+	// written to mainDB while the merge runs
+	mainDB.merge(AddCounter, []byte("cnt/a"), []byte("1"))
+
+	want := map[string]string{
+		"cnt/a":    "21",
+		"cnt/new":  "3",
+		"set/s":    string(EncodeSet([]byte("a"), []byte("b"), []byte("c"))),
+		"keep/k":   "main",
+		"keep/new": "temp",
+		"max/m":    "7",
+		"plain":    "temp",
+	}
+	check := func(stage string) {
+		for key, want := range want {
+			if value, err := dm.Get(key); err != nil || string(value) != want {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key, value, err, want)
+			}
+		}
+		iter := dm.NewIterator(nil)
+		defer iter.Release()
+		count := 0
+		for iter.Next() {
+			if string(iter.Value()) != want[string(iter.Key())] {
+				t.Fatalf("%s: iterator %s = %q", stage, iter.Key(), iter.Value())
+			}
+			count++
+		}
+		if count != len(want) {
+			t.Fatalf("%s: iterated %d keys, want %d", stage, count, len(want))
+		}
+	}
+
+	check("before merge")
+	report, err := mergeTemp(context.Background(), mainDB.db, tempDB.db, &mainDB.writeMu, true, policies, nil, "")
+	if err != nil || report.Moved != 7 || report.Skipped != 2 {
+		t.Fatalf("mergeTemp = %+v, %v, want 7 records, 2 kept in mainDB", report, err)
+	}
+	check("after merge")
+	waitTempDrained(t, tempDB)
+
+	if _, err := policies.mergeOperator([]byte("plain")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("operator of a plain key: %v", err)
+	}
+
+	// a logged operand replays with the built-in operator of its name
+	batch := &leveldb.Batch{}
+	batch.Put([]byte("cnt/a"), encodeOperand(AddCounter.Name(), []byte("4")))
+	if err := replayChange(mainDB.db, batch, nil); err != nil {
+		t.Fatalf("replayChange: %s", err.Error())
+	}
+	if value, _ := mainDB.db.Get([]byte("cnt/a"), nil); string(value) != "25" {
+		t.Fatalf("replayed counter = %q, want 25", value)
+	}
+}
+
+func TestRawValueWithEnvelopeMagic(t *testing.T) {
+	dbPath := t.TempDir()
+	mainDB := &levelDBWrapper{path: path.Join(dbPath, "main")}
+	tempDB := &levelDBWrapper{path: path.Join(dbPath, "temp"), temp: true}
+	for _, dw := range []*levelDBWrapper{mainDB, tempDB} {
+		if err := dw.open(); err != nil {
+			t.Fatalf("open %s: %s", dw.path, err.Error())
+		}
+		defer dw.close()
+	}
+	policies := MergePolicies{"cnt/": AddCounter, "keep/": KeepMain}
+	dm := &LevelDBManager{mainDB: mainDB, tempDB: tempDB, policies: policies, state: newStateMachine()}
+
+	// raw values of a mainDB that is not versioned, read like envelopes they
+	// would be a tombstone and a value stripped of its first bytes
+	tombstone := string(append(append([]byte{}, envelopeMagic...), envelopeTombstone, 5, 'x'))
+	value := string(append(append([]byte{}, envelopeMagic...), 0, 7)) + "raw"
+	mainDB.put([]byte("keep/t"), []byte(tombstone))
+	mainDB.put([]byte("keep/v"), []byte(value))
+	mainDB.put([]byte("plain"), []byte(value))
+	tempDB.put([]byte("keep/t"), []byte("temp"))
+	tempDB.put([]byte("keep/v"), []byte("temp"))
+
+	want := map[string]string{"keep/t": tombstone, "keep/v": value, "plain": value}
+	check := func(stage string) {
+		for key, want := range want {
+			if value, err := dm.Get(key); err != nil || string(value) != want {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key, value, err, want)
+			}
+		}
+		iter := dm.NewIterator(nil)
+		defer iter.Release()
+		count := 0
+		for iter.Next() {
+			if string(iter.Value()) != want[string(iter.Key())] {
+				t.Fatalf("%s: iterator %s = %q", stage, iter.Key(), iter.Value())
+			}
+			count++
+		}
+		if count != len(want) {
+			t.Fatalf("%s: iterated %d keys, want %d", stage, count, len(want))
+		}
+	}
+
+	check("before merge")
+	report, err := mergeTemp(context.Background(), mainDB.db, tempDB.db, &mainDB.writeMu, false, policies, nil, "")
+	if err != nil || report.Moved != 2 {
+		t.Fatalf("mergeTemp = %+v, %v, want 2 records", report, err)
+	}
+	check("after merge")
+}
+
+// flakyCounter is AddCounter failing its first failures merges
+type flakyCounter struct {
+	MergeOperator
+	failures int32
+}
+
+func (c *flakyCounter) Merge(key, existing, operand []byte) ([]byte, error) {
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		return nil, errors.New("flaky")
+	}
+	return c.MergeOperator.Merge(key, existing, operand)
+}
+
+func TestEngineStates(t *testing.T) {
+	type engine interface {
+		Store
+		Merge(key string, operand []byte) error
+		Backup(ctx context.Context) (*BackupManifest, error)
+		State() EngineStatus
+		WaitState(ctx context.Context, states ...EngineState) (EngineState, error)
+		SubscribeState(buffer int) (<-chan StateTransition, func())
+	}
+	for _, name := range []string{EngineMainTemp, EngineRepo} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			tempPath := path.Join(dir, "temp")
+			// an operand left in tempDB by a crash, its first merge fails
+			tempDB := &levelDBWrapper{path: tempPath, temp: true}
+			if err := tempDB.open(); err != nil {
+				t.Fatal(err)
+			}
+			tempDB.merge(AddCounter, []byte("cnt/x"), []byte("1"))
+			tempDB.close()
+
+			counter := &flakyCounter{MergeOperator: AddCounter, failures: 1}
+			o := &Options{
+				BackupRoot:    path.Join(dir, "backup"),
+				Schedule:      &BackupSchedule{Manual: true},
+				MergePolicies: MergePolicies{"cnt/": counter},
+				Timeouts:      StateTimeouts{MergeRetry: 10 * time.Millisecond},
+			}
+			store, err := NewStoreWithOptions(name, dir, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := store.(engine)
+			transitions, _ := e.SubscribeState(64)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := e.WaitState(ctx, StateNormal); err != nil {
+				t.Fatalf("no recovery from the failed merge: %v, %+v", err, e.State())
+			}
+			if value, err := e.Get("cnt/x"); err != nil || string(value) != "1" {
+				t.Fatalf("counter after recovery = %q, %v", value, err)
+			}
+
+			// writers and readers keep going through two backups
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			var failed atomic.Value
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						key := fmt.Sprintf("k%d-%d", w, i%50)
+						check := func(err error) {
+							if err != nil && err != leveldb.ErrNotFound {
+								failed.Store(err)
+							}
+						}
+						check(e.Put(key, []byte("v")))
+						_, err := e.Get(key)
+						check(err)
+						check(e.Merge("cnt/y", []byte("1")))
+						if i%10 == 0 {
+							check(e.Delete(key))
+							iter := e.NewIterator(util.BytesPrefix([]byte("k")))
+							for iter.Next() {
+							}
+							check(iter.Error())
+							iter.Release()
+						}
+					}
+				}(w)
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := e.Backup(ctx); err != nil {
+					t.Fatalf("backup %d: %v", i, err)
+				}
+			}
+			// the merge after the last backup may still run
+			if _, err := e.WaitState(ctx, StateNormal); err != nil {
+				t.Fatalf("no merge after the backups: %v", err)
+			}
+			close(stop)
+			wg.Wait()
+			if err, _ := failed.Load().(error); err != nil {
+				t.Fatalf("operation failed under load: %v", err)
+			}
+
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// the failed merge at startup went degraded before the subscription
+			seen := []EngineState{StateDegraded}
+			count := map[EngineState]int{}
+			for tr := range transitions {
+				if tr.From != seen[len(seen)-1] {
+					t.Fatalf("transition %s -> %s after %v", tr.From, tr.To, seen)
+				}
+				seen = append(seen, tr.To)
+				count[tr.To]++
+			}
+			if seen[len(seen)-1] != StateClosed || count[StateBackingUp] != 2 || count[StateNormal] != 3 {
+				t.Fatalf("transitions %v", seen)
+			}
+			if _, err := e.Get("k0-0"); err != leveldb.ErrClosed {
+				t.Fatalf("Get after Close = %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteDuringMerge(t *testing.T) {
+	for _, name := range []string{EngineMainTemp, EngineRepo} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			// records left in tempDB by a crash, their first merge fails
+			tempDB := &levelDBWrapper{path: path.Join(dir, "temp"), temp: true}
+			if err := tempDB.open(); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"k", "gone", "b"} {
+				tempDB.put([]byte(key), []byte("old"))
+			}
+			tempDB.merge(AddCounter, []byte("cnt/x"), []byte("1"))
+			tempDB.close()
+
+			store, err := NewStoreWithOptions(name, dir, &Options{
+				BackupRoot:    path.Join(dir, "backup"),
+				Schedule:      &BackupSchedule{Manual: true},
+				MergePolicies: MergePolicies{"cnt/": &flakyCounter{MergeOperator: AddCounter, failures: 1}},
+				Timeouts:      StateTimeouts{MergeRetry: 500 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			e := store.(interface {
+				Store
+				Merge(key string, operand []byte) error
+				WaitState(ctx context.Context, states ...EngineState) (EngineState, error)
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := e.WaitState(ctx, StateDegraded); err != nil {
+				t.Fatal(err)
+			}
+
+			// mainDB writes while tempDB still holds older records
+			batch := &leveldb.Batch{}
+			batch.Put([]byte("b"), []byte("new"))
+			for _, err := range []error{
+				e.Put("k", []byte("new")),
+				e.Delete("gone"),
+				e.Write(batch),
+				e.Merge("cnt/x", []byte("2")),
+			} {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			check := func(when string) {
+				for key, want := range map[string]string{"k": "new", "b": "new", "cnt/x": "3"} {
+					if value, err := e.Get(key); err != nil || string(value) != want {
+						t.Fatalf("%s: Get(%s) = %q, %v, want %q", when, key, value, err, want)
+					}
+				}
+				if value, err := e.Get("gone"); err != leveldb.ErrNotFound {
+					t.Fatalf("%s: deleted key = %q, %v", when, value, err)
+				}
+			}
+			check("during merge")
+			if _, err := e.WaitState(ctx, StateNormal); err != nil {
+				t.Fatal(err)
+			}
+			check("after merge")
+		})
+	}
+}
+
+func TestDBHandle(t *testing.T) {
+	db, err := leveldb.OpenFile(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var h dbHandle
+	h.set(db)
+
+	// an iterator keeps the DB from being suspended until it is released
+	iter := h.newIterator(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.suspend(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("suspend with an open iterator = %v", err)
+	}
+	if got, err := h.acquire(); err != nil || got != db {
+		t.Fatalf("acquire after a cancelled suspend = %v, %v", got, err)
+	}
+	h.release()
+
+	suspended := make(chan *leveldb.DB)
+	go func() {
+		got, _ := h.suspend(context.Background())
+		suspended <- got
+	}()
+	time.Sleep(10 * time.Millisecond)
+	iter.Release()
+	if got := <-suspended; got != db {
+		t.Fatalf("suspend = %v", got)
+	}
+
+	// readers wait for the DB to be set again
+	acquired := make(chan error)
+	go func() {
+		_, err := h.acquire()
+		acquired <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	h.set(db)
+	if err := <-acquired; err != nil {
+		t.Fatalf("acquire while suspended = %v", err)
+	}
+	h.release()
+	waits := h.readWaits()
+	if waits.Count != 1 || waits.Max < 20*time.Millisecond || waits.Mean() != waits.Total {
+		t.Fatalf("read waits %+v", waits)
+	}
+
+	h.close()
+	if _, err := h.acquire(); err != leveldb.ErrClosed {
+		t.Fatalf("acquire after close = %v", err)
+	}
+}
+
+func TestBackupReadDrain(t *testing.T) {
+	for _, name := range []string{EngineMainTemp, EngineRepo} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewStoreWithOptions(name, dir, &Options{
+				BackupRoot: path.Join(dir, "backup"),
+				Schedule:   &BackupSchedule{Manual: true},
+				Timeouts:   StateTimeouts{ReadDrain: 50 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			e := store.(interface {
+				Store
+				Backup(ctx context.Context) (*BackupManifest, error)
+				WaitState(ctx context.Context, states ...EngineState) (EngineState, error)
+			})
+			e.Put("key", []byte("value"))
+
+			// a leaked iterator fails the backup instead of stalling it
+			iter := e.NewIterator(nil)
+			if _, err := e.Backup(context.Background()); !errors.Is(err, ErrReadDrain) {
+				t.Fatalf("backup with a leaked iterator = %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := e.WaitState(ctx, StateNormal); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := e.Get("key"); err != nil || string(value) != "value" {
+				t.Fatalf("Get after the failed backup = %q, %v", value, err)
+			}
+			iter.Release()
+			if _, err := e.Backup(ctx); err != nil {
+				t.Fatalf("backup after release: %v", err)
+			}
+		})
+	}
+}
+
+func TestReopenMainDB(t *testing.T) {
+	dir := t.TempDir()
+	mainDB := &levelDBWrapper{path: path.Join(dir, "main")}
+	if err := mainDB.open(); err != nil {
+		t.Fatal(err)
+	}
+	mainDB.suspend(context.Background(), time.Second)
+
+	// another handle holds the lock of the folder for a while
+	other, err := leveldb.OpenFile(mainDB.path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { other.Close() })
+	if err := mainDB.reopen(make(chan struct{}), 10*time.Millisecond); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer mainDB.close()
+	if err := mainDB.put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the engine stops the retries
+	mainDB.suspend(context.Background(), time.Second)
+	if other, err = leveldb.OpenFile(mainDB.path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	quit := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(quit) })
+	if err := mainDB.reopen(quit, 10*time.Millisecond); err == nil {
+		t.Fatalf("reopen succeeded with the folder locked")
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	dm, err := NewDBWithOptions(dir, &Options{
+		BackupRoot:  path.Join(dir, "backup"),
+		Schedule:    &BackupSchedule{Manual: true},
+		Versioned:   true,
+		GroupCommit: GroupCommit{MaxOps: 16, MaxDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.Close()
+
+	// writers keep going through a backup, every key of theirs ends up
+	// written then each fifth deleted
+	const writers, keys = 16, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				if err := dm.Put(key, []byte(key)); err != nil {
+					t.Errorf("Put(%s): %v", key, err)
+				}
+				if i%5 == 0 {
+					if err := dm.Delete(key); err != nil {
+						t.Errorf("Delete(%s): %v", key, err)
+					}
+				}
+			}
+		}(w)
+	}
+	if _, err := dm.Backup(context.Background()); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	wg.Wait()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			value, err := dm.Get(key)
+			if i%5 == 0 {
+				if err != leveldb.ErrNotFound {
+					t.Fatalf("Get(%s) after Delete = %q, %v", key, value, err)
+				}
+			} else if err != nil || string(value) != key {
+				t.Fatalf("Get(%s) = %q, %v", key, value, err)
+			}
+		}
+	}
+
+	stats, err := dm.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(writers * (keys + keys/5)); stats.GroupCommits.Ops != want {
+		t.Fatalf("group commits %+v, want %d ops", stats.GroupCommits, want)
+	}
+
+	// calls queued while a group is written form the next group, it waits
+	// for every call in progress
+	dw := &levelDBWrapper{path: path.Join(dir, "group"), wg: &sync.WaitGroup{}}
+	if err := dw.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dw.close()
+	c := newCommitter(GroupCommit{MaxOps: 64, MaxDelay: time.Minute})
+	queue := make(chan Message, writers)
+	var answers []chan error
+	for i := 0; i < writers; i++ {
+		c.enter()
+		res := make(chan error, 1)
+		answers = append(answers, res)
+		queue <- Message{action: MsgPut, key: fmt.Sprintf("g%d", i), value: []byte("v"), res: res}
+	}
+	for {
+		request, ok := c.receive(queue)
+		if !ok {
+			break
+		}
+		c.add(request)
+	}
+	c.commit(dw, func(request Message, err error) { request.res <- err })
+	for _, res := range answers {
+		if err := <-res; err != nil {
+			t.Fatalf("group write: %v", err)
+		}
+	}
+	if groups := c.getStats(); groups.Groups != 1 || groups.Ops != writers {
+		t.Fatalf("group commits %+v, want %d ops in one group", groups, writers)
+	}
+}
+
+func TestShardedEngine(t *testing.T) {
+	dir := t.TempDir()
+	root := path.Join(dir, "sharded")
+	o := &Options{
+		BackupRoot: path.Join(dir, "backup"),
+		Schedule:   &BackupSchedule{Manual: true},
+		Shards:     3,
+	}
+	s, err := NewLevelDBSharded(root, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keys = 200
+	var want []string
+	for i := 0; i < keys; i++ {
+		want = append(want, fmt.Sprintf("k%03d", i))
+	}
+	for _, key := range want[:keys/2] {
+		if err := s.Put(key, []byte(key)); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	// a batch across the shards
+	batch := &leveldb.Batch{}
+	for _, key := range want[keys/2:] {
+		batch.Put([]byte(key), []byte(key))
+	}
+	batch.Put([]byte("gone"), []byte("x"))
+	batch.Delete([]byte("gone"))
+	if err := s.Write(batch); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	checkKeys := func(s *LevelDBSharded) {
+		t.Helper()
+		iter := s.NewIterator(nil)
+		defer iter.Release()
+		var got []string
+		for iter.Next() {
+			if string(iter.Value()) != string(iter.Key()) {
+				t.Fatalf("value of %s = %q", iter.Key(), iter.Value())
+			}
+			got = append(got, string(iter.Key()))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("iterated %d keys, want %d in order: %v", len(got), len(want), got)
+		}
+	}
+	checkKeys(s)
+
+	// the shards back up one at a time, each merged back before the next
+	type window struct{ start, end time.Time }
+	windows := make([]window, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		transitions, stop := shard.(*LevelDBManager).SubscribeState(16)
+		defer stop()
+		wg.Add(1)
+		go func(w *window) {
+			defer wg.Done()
+			for tr := range transitions {
+				if tr.To == StateBackingUp {
+					w.start = tr.Time
+				}
+				// the merge of the open may still be running
+				if tr.To == StateNormal && !w.start.IsZero() {
+					w.end = tr.Time
+					return
+				}
+			}
+		}(&windows[i])
+	}
+	manifests, err := s.Backup(context.Background())
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	wg.Wait()
+	if len(manifests) != len(s.shards) {
+		t.Fatalf("%d manifests, want %d", len(manifests), len(s.shards))
+	}
+	for i, w := range windows {
+		if w.start.IsZero() || w.end.Before(w.start) {
+			t.Fatalf("shard %d backup window %+v", i, w)
+		}
+		if i > 0 && w.start.Before(windows[i-1].end) {
+			t.Fatalf("shard %d backed up from %v, before shard %d merged at %v", i, w.start, i-1, windows[i-1].end)
+		}
+	}
+	stats, err := s.Stats()
+	if err != nil || stats.Engine != EngineSharded || len(stats.DBs) != 2*len(s.shards) {
+		t.Fatalf("Stats = %+v, %v", stats, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shard count is kept with the data
+	if s, err = NewLevelDBSharded(root, o); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(s)
+	s.Close()
+	o.Shards = 5
+	if _, err := NewLevelDBSharded(root, o); !errors.Is(err, ErrShardCount) {
+		t.Fatalf("reopen with another count: %v, want ErrShardCount", err)
+	}
+
+	o.Reshard = true
+	if s, err = NewLevelDBSharded(root, o); err != nil {
+		t.Fatalf("reshard: %v", err)
+	}
+	defer s.Close()
+	if len(s.shards) != 5 {
+		t.Fatalf("%d shards after reshard", len(s.shards))
+	}
+	checkKeys(s)
+	if _, err := os.Stat(path.Join(root, "gen-1")); !os.IsNotExist(err) {
+		t.Fatalf("old shards left after reshard: %v", err)
+	}
+}
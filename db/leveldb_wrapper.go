@@ -1,14 +1,16 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"leveldblab/config"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	cp "github.com/otiai10/copy"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
@@ -18,6 +20,10 @@ const (
 	MsgMerge
 	MsgPut
 	MsgGet
+	MsgDelete
+	MsgWrite
+	MsgClose
+	MsgMergeOperand
 )
 
 type Message struct {
@@ -26,6 +32,9 @@ type Message struct {
 
 	key   string
 	value []byte
+	batch *leveldb.Batch
+	op    MergeOperator // of MsgMergeOperand
+	seq   uint64        // of the change logged for the request
 }
 
 type LevelDBManager struct {
@@ -34,17 +43,53 @@ type LevelDBManager struct {
 
 	mainDB *levelDBWrapper
 	tempDB *levelDBWrapper // use on Backup time
+
+	backupMode string
+	catalog    *BackupCatalog
+	retention  *RetentionPolicy
+	changes    *changeLog // nil without Options.ChangeLog
+	verify     bool
+	schedule   *scheduler
+	backups    backupControl
+	mergeRate  *throttle
+	lastMerge  atomic.Pointer[MergeReport]
+	policies   MergePolicies
+
+	// state follows the working DB of the message loop, which makes every
+	// transition but the retries of a failed merge
+	state    *stateMachine
+	timeouts StateTimeouts
+	// writes groups the Put and Delete calls of the message loop
+	writes *committer
+	jobs   sync.WaitGroup // backup and merge goroutines
+	quit   chan struct{}
 }
 
 type levelDBWrapper struct {
 	path string
 	db   *leveldb.DB
 	wg   *sync.WaitGroup
+	// readers hands db out to the readers outside of the message loop, mainDB
+	// is closed and reopened by backups
+	readers dbHandle
+
+	// temp stores values as records so deletes become tombstones
+	temp bool
+	// versioned wraps values in an envelope carrying their version
+	versioned bool
+	// merging is set while a merge runs: writes to mainDB then drop the older
+	// records of pending, tempDB, and deletes on a versioned mainDB leave a
+	// tombstone so the merge can't bring back an older tempDB value
+	merging  int32
+	pending  *levelDBWrapper
+	policies MergePolicies
+	// writeMu is held shared by writes and exclusively by a merge comparing
+	// versions
+	writeMu sync.RWMutex
 }
 
 var (
 	dbManagerInstance *LevelDBManager
-	backupInterval    = 30 * time.Second
 
 	wo = &opt.WriteOptions{
 		NoWriteMerge: false,
@@ -53,10 +98,31 @@ var (
 )
 
 func NewDB(path string) (*LevelDBManager, error) {
+	return NewDBWithOptions(path, nil)
+}
+
+func NewDBWithOptions(path string, o *Options) (*LevelDBManager, error) {
 	log.Printf("Create newDB at path: %s", path)
+	if !validBackupMode(o.GetBackupMode()) {
+		return nil, fmt.Errorf("unknown backup mode %q", o.GetBackupMode())
+	}
+	schedule, err := newScheduler(o.GetSchedule())
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := NewBackupCatalog(o.GetBackupRoot())
+	if err != nil {
+		return nil, err
+	}
+	catalog.SetArchive(o.GetArchive())
+	catalog.SetTargets(o.GetTargets())
+	catalog.SetCopyWorkers(o.GetCopyWorkers())
+	catalog.SetMergePolicies(o.GetMergePolicies())
 	mainDB := &levelDBWrapper{
-		path: path + "/main",
-		wg:   &sync.WaitGroup{},
+		path:      path + "/main",
+		wg:        &sync.WaitGroup{},
+		versioned: o.GetVersioned(),
+		policies:  o.GetMergePolicies(),
 	}
 	if err := mainDB.open(); err != nil {
 		return nil, err
@@ -64,177 +130,777 @@ func NewDB(path string) (*LevelDBManager, error) {
 	tempDB := &levelDBWrapper{
 		path: path + "/temp",
 		wg:   &sync.WaitGroup{},
+		temp: true,
 	}
 	if err := tempDB.open(); err != nil {
 		return nil, err
 	}
+	mainDB.pending = tempDB
+
+	var changes *changeLog
+	if o.GetChangeLog() {
+		if changes, err = openChangeLog(path+"/changelog", o.GetChangeLogSync()); err != nil {
+			return nil, err
+		}
+	}
 
 	db := &LevelDBManager{
-		path:     path,
-		msgQueue: make(chan Message),
-		mainDB:   mainDB,
-		tempDB:   tempDB,
+		path:       path,
+		msgQueue:   make(chan Message),
+		mainDB:     mainDB,
+		tempDB:     tempDB,
+		backupMode: o.GetBackupMode(),
+		catalog:    catalog,
+		retention:  o.GetRetention(),
+		changes:    changes,
+		verify:     o.GetVerifyBackups(),
+		schedule:   schedule,
+		backups:    backupControl{limit: newThrottle(o.GetBackupRate())},
+		mergeRate:  newThrottle(o.GetMergeRate()),
+		policies:   o.GetMergePolicies(),
+		state:      newStateMachine(),
+		timeouts:   o.GetTimeouts(),
+		writes:     newCommitter(o.GetGroupCommit()),
+		quit:       make(chan struct{}),
 	}
+	// tempDB is left over by a crash during a backup or a merge, it must be
+	// merged before mainDB takes writes again. A failed merge is retried by
+	// the message loop
+	atomic.StoreInt32(&mainDB.merging, 1)
+	db.state.transition(StateMerging, nil)
+	db.mergeTemp()
 	go db.start()
 
 	return db, nil
 }
 
 func (dw *levelDBWrapper) put(key, value []byte) error {
-	return dw.db.Put(key, value, wo)
+	value = dw.putValue(value)
+
+	dw.writeMu.RLock()
+	defer dw.writeMu.RUnlock()
+	if err := dw.db.Put(key, value, wo); err != nil {
+		return err
+	}
+	return dw.dropPending(key)
 }
 func (dw *levelDBWrapper) delete(key []byte) error {
-	return dw.db.Delete(key, wo)
+	dw.writeMu.RLock()
+	defer dw.writeMu.RUnlock()
+
+	var err error
+	if value := dw.deleteValue(); value != nil {
+		err = dw.db.Put(key, value, wo)
+	} else {
+		err = dw.db.Delete(key, wo)
+	}
+	if err != nil {
+		return err
+	}
+	return dw.dropPending(key)
+}
+
+// dropPending deletes from tempDB the keys just written to mainDB while
+// merging. writeMu must be held
+func (dw *levelDBWrapper) dropPending(keys ...[]byte) error {
+	if dw.pending == nil || atomic.LoadInt32(&dw.merging) == 0 {
+		return nil
+	}
+	return dropTemp(dw.pending.db, &dw.pending.writeMu, keys...)
+}
+
+// putValue returns value as stored in db
+func (dw *levelDBWrapper) putValue(value []byte) []byte {
+	switch {
+	case dw.temp:
+		return encodeRecord(record{kind: recordValue, version: versions.next(), value: value})
+	case dw.versioned:
+		return encodeEnvelope(envelope{version: versions.next(), value: value})
+	}
+	return value
+}
+
+// deleteValue returns the tombstone a delete leaves in db, nil when the key is
+// simply deleted. writeMu must be held
+func (dw *levelDBWrapper) deleteValue() []byte {
+	switch {
+	case dw.temp:
+		return encodeRecord(record{kind: recordTombstone, version: versions.next()})
+	case dw.versioned && atomic.LoadInt32(&dw.merging) == 1:
+		return encodeEnvelope(envelope{version: versions.next(), tombstone: true})
+	}
+	return nil
+}
+
+// merge combines operand into the value of key with op
+func (dw *levelDBWrapper) merge(op MergeOperator, key, operand []byte) error {
+	if dw.temp {
+		return mergeTempOperand(dw.db, &dw.writeMu, op, key, operand)
+	}
+	if dw.pending != nil && atomic.LoadInt32(&dw.merging) == 1 {
+		if err := mergeKey(dw.db, dw.pending.db, &dw.writeMu, dw.versioned, dw.policies, key); err != nil {
+			return err
+		}
+	}
+	return mergeMainOperand(dw.db, &dw.writeMu, dw.versioned, op, key, operand)
+}
+
+func (dw *levelDBWrapper) write(batch *leveldb.Batch) error {
+	var keys batchKeys
+	if atomic.LoadInt32(&dw.merging) == 1 {
+		batch.Replay(&keys)
+	}
+	switch {
+	case dw.temp:
+		batch = newTempBatch(batch)
+	case dw.versioned:
+		main := &leveldb.Batch{}
+		batch.Replay(mainBatchReplay{
+			batch:      main,
+			version:    versions.next(),
+			tombstones: atomic.LoadInt32(&dw.merging) == 1,
+		})
+		batch = main
+	}
+
+	dw.writeMu.RLock()
+	defer dw.writeMu.RUnlock()
+	if err := dw.db.Write(batch, wo); err != nil {
+		return err
+	}
+	return dw.dropPending(keys...)
 }
 
 func (dw *levelDBWrapper) close() error {
+	dw.readers.close()
 	return dw.db.Close()
 }
 
+// suspend closes db once the readers holding it are done, the next readers
+// wait for open. It fails without closing db once ctx is done or the readers
+// are not done after drain
+func (dw *levelDBWrapper) suspend(ctx context.Context, drain time.Duration) error {
+	if _, err := dw.readers.drain(ctx, drain); err != nil {
+		return err
+	}
+	if err := dw.db.Close(); err != nil {
+		dw.readers.set(dw.db)
+		return err
+	}
+	return nil
+}
+
 func (dw *levelDBWrapper) open() error {
-	db, err := leveldb.OpenFile(dw.path, nil)
+	var db *leveldb.DB
+	var err error
+	if dw.temp {
+		db, err = openTempDB(dw.path)
+	} else {
+		db, err = leveldb.OpenFile(dw.path, nil)
+	}
 	if err != nil {
-		log.Fatalf("Error load db folder %s: %v", dw.path, err)
 		return err
 	}
 
 	dw.db = db
+	dw.readers.set(db)
 	return nil
 }
+
+// reopen opens db again after a backup closed it, retrying after a delay
+// doubled after each failure. It gives up once quit is closed
+func (dw *levelDBWrapper) reopen(quit <-chan struct{}, retry time.Duration) error {
+	for {
+		err := dw.open()
+		if err == nil {
+			return nil
+		}
+		log.Printf("[catch me] error while reopen mainDB after backup %s: %s", dw.path, err.Error())
+		select {
+		case <-quit:
+			return err
+		case <-time.After(retry):
+		}
+		retry = nextMergeRetry(retry)
+	}
+}
+
+// view calls f with db, kept open until f returns. It waits while a backup has
+// db closed
+func (dw *levelDBWrapper) view(f func(db *leveldb.DB) error) error {
+	db, err := dw.readers.acquire()
+	if err != nil {
+		return err
+	}
+	defer dw.readers.release()
+	return f(db)
+}
 func (dw *levelDBWrapper) setReadOnly() error {
 	return dw.db.SetReadOnly()
 }
 
 func (dm *LevelDBManager) start() {
 	workingDB := dm.mainDB
-	go dm.triggerMergeDB()
+	dm.jobs.Add(1)
+	go func() {
+		defer dm.jobs.Done()
+		dm.triggerMergeDB()
+	}()
 
 	lastkey := ""
-	for msg := range dm.msgQueue {
-		request := msg
+	for {
+		request, ok := dm.writes.receive(dm.msgQueue)
+		if !ok {
+			dm.writes.commit(workingDB, dm.answer)
+			continue
+		}
+		seq, err := dm.logChange(request)
+		if err != nil {
+			log.Printf("[catch me] error while log change %s: %s", dm.changes.dir, err.Error())
+			request.res <- err
+			continue
+		}
+		request.seq = seq
+
 		switch request.action {
-		case MsgPut:
+		case MsgPut, MsgDelete, MsgWrite, MsgMergeOperand:
+			dm.schedule.wrote()
+		}
+
+		switch request.action {
+		case MsgPut, MsgDelete:
+			if request.action == MsgPut {
+				lastkey = request.key
+			}
+			dm.writes.add(request)
+			continue
+		}
+		// the other messages come after the writes of the open group, which
+		// must reach the working DB before it changes
+		dm.writes.commit(workingDB, dm.answer)
+
+		switch request.action {
+		case MsgWrite:
 			workingDB.wg.Add(1)
 			go func(db *levelDBWrapper, request Message) {
 				defer db.wg.Done()
-				lastkey = request.key
-				request.res <- db.put([]byte(request.key), request.value)
+				dm.answer(request, db.write(request.batch))
 			}(workingDB, request)
 
+		case MsgMergeOperand:
+			workingDB.wg.Add(1)
+			go func(db *levelDBWrapper, request Message) {
+				defer db.wg.Done()
+				dm.answer(request, db.merge(request.op, []byte(request.key), request.value))
+			}(workingDB, request)
+
+		case MsgClose:
+			dm.state.transition(StateClosed, nil)
+			close(dm.quit)
+			dm.mainDB.wg.Wait()
+			dm.tempDB.wg.Wait()
+			dm.jobs.Wait()
+
+			err := dm.tempDB.close()
+			if mainErr := dm.mainDB.close(); mainErr != nil {
+				err = mainErr
+			}
+			if dm.changes != nil {
+				if logErr := dm.changes.close(); logErr != nil {
+					err = logErr
+				}
+			}
+			request.res <- err
+			return
+
 		case MsgBackup:
+			dm.schedule.started()
+			run := dm.backups.start(dm.timeouts.Backup)
 			dm.mainDB.wg.Wait()
+			// every change up to seq is in mainDB
+			seq := dm.lastSeq()
+			if isOnlineBackup(dm.backupMode) {
+				// mainDB stays the working DB, the backup reads a snapshot
+				snap, err := dm.mainDB.db.GetSnapshot()
+				dm.jobs.Add(1)
+				go func() {
+					defer dm.jobs.Done()
+					var manifest *BackupManifest
+					if err != nil {
+						log.Printf("[catch me] error while snapshot mainDB %s: %s", dm.mainDB.path, err.Error())
+					} else {
+						manifest, err = dm.backupSnapshot(run, snap, seq)
+					}
+					dm.triggerMergeDB()
+					dm.backups.finish(run, manifest, err)
+				}()
+				break
+			}
+
+			if err := dm.state.transition(StateBackingUp, nil); err != nil {
+				log.Printf("[catch me] error while start Backup mainDB %s: %s", dm.mainDB.path, err.Error())
+				dm.backups.finish(run, nil, err)
+				go dm.triggerMergeDB()
+				break
+			}
 			workingDB = dm.tempDB
 
-			go func() {
-				// backup
-				// if err := dm.mainDB.setReadOnly(); err != nil {
-				// 	log.Printf("[catch me] error while SetReadOnly mainDB %s: %s", dm.mainDB.path, err.Error())
-				// 	return
-				// }
+			dm.jobs.Add(1)
+			go func(lastkey string) {
+				defer dm.jobs.Done()
+				manifest, err := dm.backupClosed(run, seq, lastkey)
+				dm.backups.finish(run, manifest, err)
+			}(lastkey)
 
-				if err := dm.mainDB.close(); err != nil {
-					log.Printf("[catch me] error while close mainDB %s: %s", dm.mainDB.path, err.Error())
+		case MsgMerge:
+			dm.tempDB.wg.Wait()
+			workingDB = dm.mainDB
+			atomic.StoreInt32(&dm.mainDB.merging, 1)
+			if err := dm.state.transition(StateMerging, nil); err != nil {
+				log.Printf("[catch me] error while start Merge %s: %s", dm.tempDB.path, err.Error())
+				break
+			}
+
+			dm.jobs.Add(1)
+			go func(lastkey string) {
+				defer dm.jobs.Done()
+				// merge, no backup until tempDB is empty
+				log.Printf("Start Merge. last key: %s", lastkey)
+				if dm.mergeTemp() != nil && !retryMerge(dm.quit, dm.timeouts.mergeRetry(), dm.remerge) {
 					return
 				}
 
-				start := time.Now()
-				backupName := fmt.Sprintf("./backup-%d/%s", time.Now().Nanosecond(), dm.mainDB.path)
-				log.Printf("Start Backup %s. last key: %s", backupName, lastkey)
-				defer func(backupName string, start time.Time) {
-					log.Printf("Backup %s done after %dms", backupName, time.Since(start).Milliseconds())
-				}(backupName, start)
-
-				if err := cp.Copy(dm.mainDB.path, backupName); err != nil {
-					log.Printf("[catch me] error while Backup mainDB %s: %s", dm.mainDB.path, err.Error())
-					return
-				}
-				if err := dm.mainDB.open(); err != nil {
-					log.Printf("[catch me] error while reopen mainDB after backup %s: %s", dm.mainDB.path, err.Error())
-					return
+				if dm.schedule.wait(dm.quit) {
+					dm.triggerBackupDB()
 				}
+			}(lastkey)
+		}
+	}
+}
 
-				dm.triggerMergeDB()
-			}()
+// mergeTemp moves tempDB into mainDB and records the report. The manager goes
+// from merging back to normal or, if the merge fails, degraded
+func (dm *LevelDBManager) mergeTemp() error {
+	start := time.Now()
+	ctx, cancel := quitContext(dm.quit, dm.timeouts.Merge)
+	defer cancel()
+	report, err := mergeTemp(ctx, dm.mainDB.db, dm.tempDB.db, &dm.mainDB.writeMu, dm.mainDB.versioned, dm.policies, dm.mergeRate, dm.path+"/"+mergeStateFileName)
+	if err != nil {
+		log.Printf("[catch me] error while merge tempDB into mainDB %s: %s", dm.mainDB.path, err.Error())
+	}
+	if report.Failed > 0 {
+		log.Printf("[catch me] %d keys left in tempDB %s, e.g. %q", report.Failed, dm.tempDB.path, report.FailedKeys)
+	}
+	dm.lastMerge.Store(report)
+	log.Printf("Merge %d keys done after %dms", report.Moved, time.Since(start).Milliseconds())
 
-		case MsgMerge:
-			dm.tempDB.wg.Wait()
-			workingDB = dm.mainDB
+	if err != nil {
+		dm.state.transition(StateDegraded, err)
+		return err
+	}
+	atomic.StoreInt32(&dm.mainDB.merging, 0)
+	return dm.state.transition(StateNormal, nil)
+}
 
-			go func() {
-				// merge
-				start := time.Now()
-				log.Printf("Start Merge. last key: %s", lastkey)
+// remerge retries the merge of a degraded manager
+func (dm *LevelDBManager) remerge() error {
+	if err := dm.state.transition(StateMerging, nil); err != nil {
+		return err
+	}
+	return dm.mergeTemp()
+}
 
-				iter := dm.tempDB.db.NewIterator(util.BytesPrefix([]byte("")), nil)
-				defer iter.Release()
-				count := 0
-				for iter.Next() {
-					count++
-					key := iter.Key()
-					value := iter.Value()
-
-					// TODO: check on state version before overwrite data
-					if err := dm.mainDB.put(key, value); err != nil {
-						continue
-					} else {
-						if err := dm.tempDB.delete(key); err != nil {
-							continue
-						}
-					}
-				}
-				log.Printf("Merge %d keys done after %dms", count, time.Since(start).Milliseconds())
+// State returns the state of the manager
+func (dm *LevelDBManager) State() EngineStatus {
+	return dm.state.status()
+}
 
-				if config.EnableBackup {
-					<-time.After(backupInterval)
-					dm.triggerBackupDB()
+// WaitState waits until the manager is in one of states, it fails once ctx is
+// done or the manager is closed
+func (dm *LevelDBManager) WaitState(ctx context.Context, states ...EngineState) (EngineState, error) {
+	return dm.state.wait(ctx, states...)
+}
+
+// SubscribeState returns the next state transitions, up to buffer of them are
+// kept while the reader lags behind, and a func to stop receiving them
+func (dm *LevelDBManager) SubscribeState(buffer int) (<-chan StateTransition, func()) {
+	return dm.state.subscribe(buffer)
+}
+
+// LastMerge returns the report of the last merge of tempDB into mainDB
+func (dm *LevelDBManager) LastMerge() *MergeReport {
+	return dm.lastMerge.Load()
+}
+
+// backupClosed closes mainDB, holding the changes up to seq, writes it into a
+// new backup and reopens it. The merge back to mainDB is triggered whether or
+// not the backup succeeds
+func (dm *LevelDBManager) backupClosed(run *backupRun, seq uint64, lastkey string) (*BackupManifest, error) {
+	// backup
+	// if err := dm.mainDB.setReadOnly(); err != nil {
+	// 	log.Printf("[catch me] error while SetReadOnly mainDB %s: %s", dm.mainDB.path, err.Error())
+	// 	return
+	// }
+
+	b, err := dm.catalog.begin(dm.mainDB.path, EngineMainTemp, dm.backupMode)
+	if err != nil {
+		log.Printf("[catch me] error while create backup of mainDB %s: %s", dm.mainDB.path, err.Error())
+		dm.triggerMergeDB()
+		return nil, err
+	}
+	run.track(b)
+	b.manifest.Seq = seq
+	// waits for the reads and iterators in flight, the next ones wait for the
+	// reopen
+	if err := dm.mainDB.suspend(run.ctx, dm.timeouts.readDrain()); err != nil {
+		log.Printf("[catch me] error while close mainDB %s: %s", dm.mainDB.path, err.Error())
+		b.abort()
+		dm.triggerMergeDB()
+		return nil, err
+	}
+
+	start := time.Now()
+	log.Printf("Start Backup %s. last key: %s", b.manifest.ID, lastkey)
+	err = b.writeClosed(dm.mainDB.path)
+	if err != nil {
+		dm.logBackupError(b, err)
+		b.abort()
+	}
+	// the readers wait for mainDB, the merge can't start without it
+	if err := dm.mainDB.reopen(dm.quit, dm.timeouts.mergeRetry()); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		dm.triggerMergeDB()
+		return nil, err
+	}
+	log.Printf("Backup %s done after %dms", b.manifest.ID, time.Since(start).Milliseconds())
+
+	// mainDB holds the backed up state until the merge starts
+	var snap *leveldb.Snapshot
+	if dm.verify {
+		if snap, err = dm.mainDB.db.GetSnapshot(); err != nil {
+			log.Printf("[catch me] error while snapshot mainDB %s: %s", dm.mainDB.path, err.Error())
+		}
+	}
+	dm.triggerMergeDB()
+	err = dm.commitBackup(b, -1, snap)
+	if snap != nil {
+		snap.Release()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.manifest, nil
+}
+
+// backupSnapshot writes snap, holding the changes up to seq, into a new backup
+// and releases it. The manifest is nil when an incremental backup finds no
+// change
+func (dm *LevelDBManager) backupSnapshot(run *backupRun, snap *leveldb.Snapshot, seq uint64) (*BackupManifest, error) {
+	defer snap.Release()
+
+	mode := dm.backupMode
+	if mode == BackupIncremental {
+		manifest, done, err := backupIncremental(run, dm.catalog, dm.changes, dm.mainDB.path, EngineMainTemp, seq)
+		if err != nil {
+			log.Printf("[catch me] error while incremental Backup mainDB %s: %s", dm.mainDB.path, err.Error())
+			return nil, err
+		}
+		if done {
+			id := ""
+			if manifest != nil {
+				id = manifest.ID
+				if dm.verify {
+					verifyBackup(dm.catalog, id, nil)
 				}
-			}()
+			}
+			afterBackup(dm.catalog, dm.retention, dm.changes, dm.mainDB.path, id)
+			return manifest, nil
+		}
+		// nothing to chain to yet
+		mode = BackupSnapshot
+	}
+
+	b, err := dm.catalog.begin(dm.mainDB.path, EngineMainTemp, mode)
+	if err != nil {
+		log.Printf("[catch me] error while create backup of mainDB %s: %s", dm.mainDB.path, err.Error())
+		return nil, err
+	}
+	run.track(b)
+	b.manifest.Seq = seq
+
+	start := time.Now()
+	log.Printf("Start %s Backup %s", mode, b.manifest.ID)
+	count, err := b.writeOnline(snap)
+	if err != nil {
+		dm.logBackupError(b, err)
+		b.abort()
+		return nil, err
+	}
+	log.Printf("Backup %s of %d keys done after %dms", b.manifest.ID, count, time.Since(start).Milliseconds())
+
+	if err := dm.commitBackup(b, int64(count), snap); err != nil {
+		return nil, err
+	}
+	return b.manifest, nil
+}
+
+// commitBackup records b in the catalog, the backup is removed if that fails.
+// With Options.VerifyBackups it is then verified against snap, the mainDB
+// state it was taken from
+func (dm *LevelDBManager) commitBackup(b *pendingBackup, keyCount int64, snap *leveldb.Snapshot) error {
+	if _, err := b.commit(keyCount); err != nil {
+		log.Printf("[catch me] error while write manifest of backup %s: %s", b.manifest.ID, err.Error())
+		b.abort()
+		return err
+	}
+	if dm.verify {
+		var live LiveReader
+		if snap != nil {
+			live = snap
 		}
+		verifyBackup(dm.catalog, b.manifest.ID, live)
 	}
+	afterBackup(dm.catalog, dm.retention, dm.changes, dm.mainDB.path, b.manifest.ID)
+	return nil
+}
+
+// logBackupError logs why writing b failed, a cancelled backup is no error
+func (dm *LevelDBManager) logBackupError(b *pendingBackup, err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Backup %s cancelled", b.manifest.ID)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("[catch me] Backup %s timed out after %s", b.manifest.ID, dm.timeouts.Backup)
+		return
+	}
+	log.Printf("[catch me] error while Backup mainDB %s: %s", dm.mainDB.path, err.Error())
+}
+
+// logChange records the change of request, it returns its sequence, zero when
+// nothing was recorded
+func (dm *LevelDBManager) logChange(request Message) (uint64, error) {
+	if dm.changes == nil {
+		return 0, nil
+	}
+
+	switch request.action {
+	case MsgPut:
+		return dm.changes.appendPut([]byte(request.key), request.value)
+	case MsgDelete:
+		return dm.changes.appendDelete([]byte(request.key))
+	case MsgWrite:
+		return dm.changes.append(request.batch)
+	case MsgMergeOperand:
+		return dm.changes.appendOperand(request.op, []byte(request.key), request.value)
+	}
+	return 0, nil
+}
+
+// answer replies err to request, the change logged for it is recorded as
+// aborted when its write failed
+func (dm *LevelDBManager) answer(request Message, err error) {
+	if request.seq != 0 {
+		err = dm.changes.abortOnError(request.seq, err)
+	}
+	request.res <- err
+}
+
+// lastSeq returns the sequence of the last logged change, zero without change
+// log. It syncs the log first, the changes held by a backup must outlive a crash
+func (dm *LevelDBManager) lastSeq() uint64 {
+	if dm.changes == nil {
+		return 0
+	}
+	if err := dm.changes.sync(); err != nil {
+		log.Printf("[catch me] error while sync change log %s: %s", dm.changes.dir, err.Error())
+	}
+	return dm.changes.last()
+}
+
+// TriggerBackup starts a backup now, or after the running backup and merge
+func (dm *LevelDBManager) TriggerBackup() {
+	dm.schedule.triggerNow()
+}
+
+// SetBackupRate limits the I/O of backups, the running one included
+func (dm *LevelDBManager) SetBackupRate(limit RateLimit) {
+	dm.backups.limit.set(limit)
+}
+
+// SetMergeRate limits the I/O of merges, the running one included
+func (dm *LevelDBManager) SetMergeRate(limit RateLimit) {
+	dm.mergeRate.set(limit)
+}
+
+// Backup starts a backup like TriggerBackup and waits for it. Once ctx is done
+// the backup stops, what it wrote is removed and the engine goes back to
+// writing mainDB. The manifest is nil when an incremental backup finds no
+// change
+func (dm *LevelDBManager) Backup(ctx context.Context) (*BackupManifest, error) {
+	return dm.backups.wait(ctx, dm.TriggerBackup)
+}
+
+// BackupProgress returns the progress of the running backup, nil if there is
+// none
+func (dm *LevelDBManager) BackupProgress() *BackupProgress {
+	return dm.backups.progress()
+}
+
+// CancelBackup stops the running backup like a cancelled Backup context, it
+// reports whether a backup was running
+func (dm *LevelDBManager) CancelBackup() bool {
+	return dm.backups.cancel()
 }
 
 func (dm *LevelDBManager) triggerMergeDB() {
-	dm.msgQueue <- Message{
+	dm.send(Message{
 		action: MsgMerge,
-	}
+	})
 }
 
 func (dm *LevelDBManager) triggerBackupDB() {
-	dm.msgQueue <- Message{
+	dm.send(Message{
 		action: MsgBackup,
+	})
+}
+
+// send queues msg for the message loop, it fails once the manager is closed
+func (dm *LevelDBManager) send(msg Message) error {
+	select {
+	case dm.msgQueue <- msg:
+		return nil
+	case <-dm.quit:
+		return leveldb.ErrClosed
+	}
+}
+
+// request queues msg and waits for the message loop to answer it
+func (dm *LevelDBManager) request(msg Message) error {
+	msg.res = make(chan error, 1)
+	if err := dm.send(msg); err != nil {
+		return err
 	}
+	return <-msg.res
 }
 
 func (dm *LevelDBManager) Put(key string, value []byte) error {
-	res := make(chan error)
-	dm.msgQueue <- Message{
+	dm.writes.enter()
+	defer dm.writes.exit()
+	return dm.request(Message{
 		action: MsgPut,
-		res:    res,
 		key:    key,
 		value:  value,
+	})
+}
+
+func (dm *LevelDBManager) Delete(key string) error {
+	dm.writes.enter()
+	defer dm.writes.exit()
+	return dm.request(Message{
+		action: MsgDelete,
+		key:    key,
+	})
+}
+
+// Write applies batch atomically to the working DB
+func (dm *LevelDBManager) Write(batch *leveldb.Batch) error {
+	return dm.request(Message{
+		action: MsgWrite,
+		batch:  batch,
+	})
+}
+
+// Merge combines operand into the value of key with the MergeOperator of its
+// prefix in Options.MergePolicies, ErrNoMergeOperator if it has none
+func (dm *LevelDBManager) Merge(key string, operand []byte) error {
+	op, err := dm.policies.mergeOperator([]byte(key))
+	if err != nil {
+		return err
 	}
-	return <-res
+	return dm.request(Message{
+		action: MsgMergeOperand,
+		key:    key,
+		value:  operand,
+		op:     op,
+	})
 }
 
-func (dm *LevelDBManager) Get(key string) ([]byte, error) {
-	value, err := dm.tempDB.db.Get([]byte(key), nil)
-	if err != nil && err != leveldb.ErrNotFound {
+// Close cancels the running backup, stops the message loop and closes both DBs
+func (dm *LevelDBManager) Close() error {
+	dm.backups.close()
+	return dm.request(Message{
+		action: MsgClose,
+	})
+}
+
+func (dm *LevelDBManager) Has(key string) (bool, error) {
+	_, err := dm.Get(key)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NewIterator iterates over slice in key order, records written to tempDB
+// during the backup window are resolved against mainDB by their MergePolicy
+func (dm *LevelDBManager) NewIterator(slice *util.Range) iterator.Iterator {
+	if dm.state.get() == StateClosed {
+		return iterator.NewEmptyIterator(leveldb.ErrClosed)
+	}
+	temp := dm.tempDB.readers.newIterator(slice)
+	return newOverlayIterator(temp, dm.mainDB.readers.newIterator(slice), dm.policies, dm.mainDB.versioned)
+}
+
+func (dm *LevelDBManager) Stats() (*Stats, error) {
+	mainStats, err := dm.mainDB.stats()
+	if err != nil {
+		return nil, err
+	}
+	tempStats, err := dm.tempDB.stats()
+	if err != nil {
 		return nil, err
 	}
 
-	if len(value) > 0 {
-		mainValue, mainErr := dm.mainDB.db.Get([]byte(key), nil)
-		if mainErr != nil && mainErr != leveldb.ErrNotFound {
-			return nil, mainErr
-		}
-		if len(mainValue) == 0 {
-			log.Printf("Found %s on temp", key)
-			return value, nil
-		}
+	return &Stats{
+		Engine:       EngineMainTemp,
+		Path:         dm.path,
+		OnBackup:     dm.state.get() == StateBackingUp,
+		State:        dm.state.status(),
+		Backup:       dm.backups.progress(),
+		ReadWaits:    dm.mainDB.readers.readWaits().add(dm.tempDB.readers.readWaits()),
+		GroupCommits: dm.writes.getStats(),
+		DBs: map[string]*leveldb.DBStats{
+			"main": mainStats,
+			"temp": tempStats,
+		},
+	}, nil
+}
 
-		// TODO: compare version of state to decide which one is the latest state
-		return mainValue, mainErr
+// Get returns the value of key across tempDB and mainDB, resolved by its
+// MergePolicy. While a backup has mainDB closed it waits for the reopen
+func (dm *LevelDBManager) Get(key string) ([]byte, error) {
+	if dm.state.get() == StateClosed {
+		return nil, leveldb.ErrClosed
+	}
+	var temp *record
+	var main *envelope
+	err := dm.tempDB.view(func(db *leveldb.DB) (err error) {
+		temp, err = readRecord(db, []byte(key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dm.mainDB.view(func(db *leveldb.DB) (err error) {
+		main, err = readEnvelope(db, []byte(key), dm.mainDB.versioned)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return dm.mainDB.db.Get([]byte(key), nil)
+	return dm.policies.resolve([]byte(key), temp, main)
 }
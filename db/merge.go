@@ -0,0 +1,403 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// mergeBatchSize and mergeBatchBytes bound the records moved to mainDB per
+// write, a batch written to tempDB is always moved whole
+const (
+	mergeBatchSize  = 1000
+	mergeBatchBytes = 4 << 20
+)
+
+// mergeStateFileName holds the MergeReport of the running or last merge, next
+// to the DBs
+const mergeStateFileName = "merge.json"
+
+// maxFailedKeys bounds the keys listed in MergeReport.FailedKeys
+const maxFailedKeys = 100
+
+// mergeWo syncs the mainDB writes of a merge: the records are deleted from
+// tempDB right after, so they must not be lost on a crash. The operands
+// rewritten in tempDB before are synced too
+var mergeWo = &opt.WriteOptions{Sync: true}
+
+// MergeReport describes a merge of tempDB into mainDB
+type MergeReport struct {
+	Start time.Time `json:"start"`
+	// End is zero while the merge runs, a merge interrupted by a crash is
+	// resumed at startup
+	End time.Time `json:"end,omitempty"`
+	// Resumed is set when the merge continued an interrupted one, its counts
+	// include the interrupted run
+	Resumed bool `json:"resumed,omitempty"`
+
+	// Moved counts the records removed from tempDB, Skipped the ones among
+	// them the mainDB value was kept over, newer or chosen by the MergePolicy
+	Moved   int `json:"moved"`
+	Skipped int `json:"skipped,omitempty"`
+	// Failed counts the records that could not be moved, they stay in tempDB
+	// until the next merge. FailedKeys lists up to maxFailedKeys of them
+	Failed     int      `json:"failed,omitempty"`
+	FailedKeys []string `json:"failed_keys,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	// Purged counts the tombstones deleted from a versioned mainDB once every
+	// record was moved
+	Purged int `json:"purged,omitempty"`
+}
+
+type mergeRecord struct {
+	key []byte
+	// raw is the tempDB value the record was decoded from
+	raw []byte
+	record
+}
+
+// mergeTemp moves every record of tempDB into mainDB. Records written by the
+// same batch are moved by a single mainDB write so a reader never sees half of
+// a batch.
+//
+// A record is resolved against the mainDB value by the policy of its key in
+// policies, merge operands are combined into it. When versioned, the default
+// LastWriterWins only overwrites mainDB with a newer record. writeMu is held
+// exclusively while resolving so foreground writes to mainDB can't slip in
+// between, a record they dropped from tempDB since it was read is not moved.
+//
+// Records are read at the pace allowed by limit, nil is unlimited. The merge
+// stops once ctx is done, what is left stays in tempDB for the next one.
+//
+// Each chunk is written to mainDB with a synced write before it is deleted from
+// tempDB, a crash in between leaves it in both. Its merge operands are first
+// rewritten in tempDB as the values they resolve to, so moving the chunk again
+// writes the same values instead of combining the operands twice. This holds
+// as long as no write reached mainDB since, which is why the engines merge
+// before serving writes at startup. A chunk that fails to move stays in
+// tempDB and is reported. The report is saved at statePath after every chunk,
+// an empty statePath saves nothing.
+func mergeTemp(ctx context.Context, mainDB, tempDB *leveldb.DB, writeMu *sync.RWMutex, versioned bool, policies MergePolicies, limit *throttle, statePath string) (*MergeReport, error) {
+	report := &MergeReport{Start: time.Now()}
+	if statePath != "" {
+		if last, err := readMergeState(statePath); err == nil && last.End.IsZero() {
+			log.Printf("Resume merge interrupted after %d records", last.Moved)
+			report.Start = last.Start
+			report.Moved = last.Moved
+			report.Skipped = last.Skipped
+			report.Resumed = true
+		}
+	}
+	save := func() {
+		if statePath == "" {
+			return
+		}
+		if err := saveMergeState(statePath, report); err != nil {
+			log.Printf("[catch me] error while save merge state %s: %s", statePath, err.Error())
+		}
+	}
+	save()
+	// stop ends the merge early, the records not moved stay in tempDB
+	stop := func(err error) (*MergeReport, error) {
+		report.End = time.Now()
+		report.Error = err.Error()
+		save()
+		return report, err
+	}
+
+	iter := tempDB.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var chunk []mergeRecord
+	size := 0
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		skipped, err := applyMerge(mainDB, tempDB, writeMu, versioned, policies, chunk)
+		if err != nil {
+			log.Printf("[catch me] error while merge %d records into mainDB: %s", len(chunk), err.Error())
+			report.Failed += len(chunk)
+			report.Error = err.Error()
+			for _, r := range chunk {
+				if len(report.FailedKeys) < maxFailedKeys {
+					report.FailedKeys = append(report.FailedKeys, string(r.key))
+				}
+			}
+		} else {
+			report.Moved += len(chunk)
+			report.Skipped += skipped
+		}
+		chunk = chunk[:0]
+		size = 0
+		save()
+	}
+
+	groups := map[uint64][]mergeRecord{}
+	for iter.Next() {
+		if err := limit.wait(ctx, len(iter.Key())+len(iter.Value())); err != nil {
+			return stop(err)
+		}
+		raw := append([]byte{}, iter.Value()...)
+		r := mergeRecord{
+			key:    append([]byte{}, iter.Key()...),
+			raw:    raw,
+			record: decodeRecord(raw),
+		}
+
+		if r.batchID != 0 {
+			groups[r.batchID] = append(groups[r.batchID], r)
+			continue
+		}
+
+		chunk = append(chunk, r)
+		size += len(r.key) + len(r.value)
+		if len(chunk) >= mergeBatchSize || size >= mergeBatchBytes {
+			flush()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stop(err)
+	}
+	flush()
+
+	// batches are moved whole, in the order they were written
+	batchIDs := make([]uint64, 0, len(groups))
+	for id := range groups {
+		batchIDs = append(batchIDs, id)
+	}
+	sort.Slice(batchIDs, func(i, j int) bool { return batchIDs[i] < batchIDs[j] })
+	for _, id := range batchIDs {
+		if err := ctx.Err(); err != nil {
+			return stop(err)
+		}
+		chunk = append(chunk, groups[id]...)
+		flush()
+	}
+
+	if versioned && report.Failed == 0 {
+		purged, err := purgeTombstones(ctx, mainDB, tempDB, writeMu)
+		if err != nil {
+			log.Printf("[catch me] error while purge tombstones of mainDB: %s", err.Error())
+		}
+		report.Purged = purged
+	}
+
+	report.End = time.Now()
+	save()
+	if report.Failed > 0 {
+		return report, fmt.Errorf("%d records failed to move: %s", report.Failed, report.Error)
+	}
+	return report, nil
+}
+
+// applyMerge writes chunk to mainDB with one batch then removes it from
+// tempDB. A record no longer in tempDB as it was read, dropped by a mainDB
+// write since the merge began, is left out. It returns how many records left
+// the mainDB value as it was
+func applyMerge(mainDB, tempDB *leveldb.DB, writeMu *sync.RWMutex, versioned bool, policies MergePolicies, chunk []mergeRecord) (int, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	mainBatch, tempBatch, skipped, err := resolveMerge(mainDB, tempDB, versioned, policies, chunk)
+	if err != nil {
+		return 0, err
+	}
+	if err := mainDB.Write(mainBatch, mergeWo); err != nil {
+		return 0, err
+	}
+	return skipped, tempDB.Write(tempBatch, wo)
+}
+
+// resolveMerge returns the mainDB batch writing chunk, the tempDB batch
+// removing it and how many records left the mainDB value as it was. The merge
+// operands of chunk are rewritten in tempDB as the values they resolve to
+// before it returns, writeMu must be held
+func resolveMerge(mainDB, tempDB *leveldb.DB, versioned bool, policies MergePolicies, chunk []mergeRecord) (*leveldb.Batch, *leveldb.Batch, int, error) {
+	skipped := 0
+	mainBatch := &leveldb.Batch{}
+	tempBatch := &leveldb.Batch{}
+	resolved := &leveldb.Batch{}
+	for _, r := range chunk {
+		current, err := tempDB.Get(r.key, nil)
+		if err == leveldb.ErrNotFound || err == nil && !bytes.Equal(current, r.raw) {
+			// mainDB was written after this record
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		tempBatch.Delete(r.key)
+
+		var main *envelope
+		if versioned || len(policies) > 0 || r.kind == recordOperand {
+			if main, err = readEnvelope(mainDB, r.key, versioned); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+		v, err := policies.merge(r.key, &r.record, main)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if r.kind == recordOperand {
+			resolved.Put(r.key, encodeRecord(record{kind: recordValue, batchID: r.batchID, version: v.Version, value: v.Value}))
+		}
+		if main != nil && v.Deleted == main.tombstone && v.Version == main.version && bytes.Equal(v.Value, main.value) {
+			// the policy kept mainDB, e.g. it was written after this record
+			skipped++
+			continue
+		}
+
+		switch {
+		case v.Deleted:
+			mainBatch.Delete(r.key)
+		case versioned:
+			mainBatch.Put(r.key, encodeEnvelope(envelope{version: v.Version, value: v.Value}))
+		default:
+			mainBatch.Put(r.key, v.Value)
+		}
+	}
+	if resolved.Len() > 0 {
+		if err := tempDB.Write(resolved, mergeWo); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	return mainBatch, tempBatch, skipped, nil
+}
+
+// purgeTombstones deletes the tombstones of a versioned mainDB whose key has no
+// record left in tempDB, they have nothing more to hide. A tombstone written
+// again or a record written to tempDB since the scan is left alone. It returns
+// how many were deleted
+func purgeTombstones(ctx context.Context, mainDB, tempDB *leveldb.DB, writeMu *sync.RWMutex) (int, error) {
+	iter := mainDB.NewIterator(nil, nil)
+	defer iter.Release()
+
+	purged := 0
+	var keys [][]byte
+	purge := func() error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		batch := &leveldb.Batch{}
+		for _, key := range keys {
+			main, err := readEnvelope(mainDB, key, true)
+			if err != nil {
+				return err
+			}
+			if main == nil || !main.tombstone {
+				continue
+			}
+			ok, err := tempDB.Has(key, nil)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				batch.Delete(key)
+			}
+		}
+		keys = keys[:0]
+		if err := mainDB.Write(batch, wo); err != nil {
+			return err
+		}
+		purged += batch.Len()
+		return nil
+	}
+
+	for iter.Next() {
+		if !decodeEnvelope(iter.Value(), true).tombstone {
+			continue
+		}
+		keys = append(keys, append([]byte{}, iter.Key()...))
+		if len(keys) < mergeBatchSize {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+		if err := purge(); err != nil {
+			return purged, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return purged, err
+	}
+	return purged, purge()
+}
+
+// mergeKey moves the tempDB record of key, if any, into mainDB like mergeTemp
+// does, so a merge operand written to mainDB during a merge applies on top of
+// it
+func mergeKey(mainDB, tempDB *leveldb.DB, writeMu *sync.RWMutex, versioned bool, policies MergePolicies, key []byte) error {
+	raw, err := tempDB.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = applyMerge(mainDB, tempDB, writeMu, versioned, policies, []mergeRecord{{key: key, raw: raw, record: decodeRecord(raw)}})
+	return err
+}
+
+// dropTemp deletes keys from tempDB once they were written to mainDB during a
+// merge, their older records would shadow the write and be merged over it.
+// The mainDB writeMu must be held so the merge can't move them in between
+func dropTemp(tempDB *leveldb.DB, tempWriteMu *sync.RWMutex, keys ...[]byte) error {
+	tempWriteMu.RLock()
+	defer tempWriteMu.RUnlock()
+	batch := &leveldb.Batch{}
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	return tempDB.Write(batch, wo)
+}
+
+// batchKeys lists the keys written by a batch
+type batchKeys [][]byte
+
+func (k *batchKeys) Put(key, value []byte) {
+	*k = append(*k, append([]byte{}, key...))
+}
+
+func (k *batchKeys) Delete(key []byte) {
+	*k = append(*k, append([]byte{}, key...))
+}
+
+// readMergeState reads the report saved at path
+func readMergeState(path string) (*MergeReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &MergeReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// saveMergeState replaces the report saved at path
+func saveMergeState(path string, report *MergeReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
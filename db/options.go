@@ -0,0 +1,205 @@
+package db
+
+// Options configures the LevelDBManager and DBRepo engines. A nil *Options
+// uses the defaults
+type Options struct {
+	// Versioned wraps mainDB values in an envelope carrying their version so
+	// reads and merges keep the newest value instead of trusting one DB.
+	// Raw values already in mainDB are read as version 0, no migration needed.
+	Versioned bool
+
+	// BackupMode is one of BackupCopy (default), BackupCheckpoint,
+	// BackupSnapshot, BackupDump or BackupIncremental
+	BackupMode string
+
+	// ChangeLog records every mutation in a sequence-numbered change log next
+	// to the DBs. Always on with BackupIncremental. ChangeLogSync syncs it to
+	// disk after every mutation, otherwise it is synced before each backup,
+	// when a segment is full and on Close
+	ChangeLog     bool
+	ChangeLogSync bool
+
+	// BackupRoot is the folder of the backup catalog, DefaultBackupRoot if empty
+	BackupRoot string
+
+	// VerifyBackups verifies each backup once taken and diffs it against the
+	// mainDB state it was taken from, see BackupCatalog.Verify
+	VerifyBackups bool
+
+	// Archive writes backups as tar.gz archives, encrypted when it holds a
+	// key. nil writes plain folders
+	Archive *ArchiveOptions
+
+	// Targets receive a copy of every backup once taken, see BackupTarget.
+	// Pruning the catalog leaves the copies in place
+	Targets []BackupTarget
+
+	// Schedule decides when backups run, nil uses the config package
+	// BackupInterval, BackupCron, BackupJitter and BackupMinWrites
+	Schedule *BackupSchedule
+
+	// CopyWorkers is the number of files a copy backup copies at once,
+	// DefaultCopyWorkers if zero
+	CopyWorkers int
+
+	// BackupRate and MergeRate limit the I/O of backups and of the merges of
+	// tempDB into mainDB, zero is unlimited. Both can be changed at runtime
+	BackupRate RateLimit
+	MergeRate  RateLimit
+
+	// Retention prunes the catalog after each successful backup, nil keeps
+	// every backup
+	Retention *RetentionPolicy
+
+	// Timeouts bounds the backups and merges, zero values are unbounded
+	Timeouts StateTimeouts
+
+	// MergePolicies resolves the keys written during the backup window
+	// against mainDB, per key prefix. nil uses LastWriterWins for every key
+	MergePolicies MergePolicies
+
+	// GroupCommit bounds the Put and Delete calls of the LevelDBManager
+	// written together, zero values use the defaults
+	GroupCommit GroupCommit
+
+	// Shards is the shard count of the LevelDBSharded, DefaultShards if zero.
+	// ShardEngine is the engine of its shards, EngineMainTemp (default) or
+	// EngineNormal. Reshard moves the keys of a root created with another
+	// count or engine instead of failing with ErrShardCount
+	Shards      int
+	ShardEngine string
+	Reshard     bool
+}
+
+func (o *Options) GetVersioned() bool {
+	if o == nil {
+		return false
+	}
+	return o.Versioned
+}
+
+func (o *Options) GetBackupMode() string {
+	if o == nil || o.BackupMode == "" {
+		return BackupCopy
+	}
+	return o.BackupMode
+}
+
+func (o *Options) GetBackupRoot() string {
+	if o == nil || o.BackupRoot == "" {
+		return DefaultBackupRoot
+	}
+	return o.BackupRoot
+}
+
+func (o *Options) GetRetention() *RetentionPolicy {
+	if o == nil {
+		return nil
+	}
+	return o.Retention
+}
+
+func (o *Options) GetChangeLog() bool {
+	if o == nil {
+		return false
+	}
+	return o.ChangeLog || o.BackupMode == BackupIncremental
+}
+
+func (o *Options) GetChangeLogSync() bool {
+	if o == nil {
+		return false
+	}
+	return o.ChangeLogSync
+}
+
+func (o *Options) GetVerifyBackups() bool {
+	if o == nil {
+		return false
+	}
+	return o.VerifyBackups
+}
+
+func (o *Options) GetArchive() *ArchiveOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Archive
+}
+
+func (o *Options) GetTargets() []BackupTarget {
+	if o == nil {
+		return nil
+	}
+	return o.Targets
+}
+
+func (o *Options) GetSchedule() BackupSchedule {
+	if o == nil || o.Schedule == nil {
+		return defaultSchedule()
+	}
+	return *o.Schedule
+}
+
+func (o *Options) GetBackupRate() RateLimit {
+	if o == nil {
+		return RateLimit{}
+	}
+	return o.BackupRate
+}
+
+func (o *Options) GetMergeRate() RateLimit {
+	if o == nil {
+		return RateLimit{}
+	}
+	return o.MergeRate
+}
+
+func (o *Options) GetCopyWorkers() int {
+	if o == nil {
+		return 0
+	}
+	return o.CopyWorkers
+}
+
+func (o *Options) GetMergePolicies() MergePolicies {
+	if o == nil {
+		return nil
+	}
+	return o.MergePolicies
+}
+
+func (o *Options) GetTimeouts() StateTimeouts {
+	if o == nil {
+		return StateTimeouts{}
+	}
+	return o.Timeouts
+}
+
+func (o *Options) GetGroupCommit() GroupCommit {
+	if o == nil {
+		return GroupCommit{}
+	}
+	return o.GroupCommit
+}
+
+func (o *Options) GetShards() int {
+	if o == nil || o.Shards <= 0 {
+		return DefaultShards
+	}
+	return o.Shards
+}
+
+func (o *Options) GetShardEngine() string {
+	if o == nil || o.ShardEngine == "" {
+		return EngineMainTemp
+	}
+	return o.ShardEngine
+}
+
+func (o *Options) GetReshard() bool {
+	if o == nil {
+		return false
+	}
+	return o.Reshard
+}
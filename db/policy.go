@@ -0,0 +1,433 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrNoMergeOperator = errors.New("db: no merge operator for key")
+
+// MergeValue is the state of a key in mainDB or tempDB as seen by a MergePolicy
+type MergeValue struct {
+	Value []byte
+	// Version is 0 for values written without a version. A zero Version
+	// returned by a policy is replaced by the newest of the two
+	Version uint64
+	// Deleted is set when the key is missing or deleted
+	Deleted bool
+}
+
+// MergePolicy decides what a key written to tempDB during the backup window
+// becomes once tempDB is merged into mainDB. Reads resolve the key the same
+// way before the merge, so they see what the merge will keep
+type MergePolicy interface {
+	Resolve(key []byte, main, temp MergeValue) MergeValue
+}
+
+// ResolverFunc adapts a function to a MergePolicy
+type ResolverFunc func(key []byte, main, temp MergeValue) MergeValue
+
+func (f ResolverFunc) Resolve(key []byte, main, temp MergeValue) MergeValue {
+	return f(key, main, temp)
+}
+
+var (
+	// LastWriterWins keeps the newest value, tempDB on a tie. Without
+	// Options.Versioned tempDB always wins. Keys matching no prefix of
+	// MergePolicies use it
+	LastWriterWins MergePolicy = ResolverFunc(lastWriterWins)
+	// KeepMain keeps the mainDB value, tempDB only fills in missing keys
+	KeepMain MergePolicy = ResolverFunc(keepMain)
+)
+
+func lastWriterWins(key []byte, main, temp MergeValue) MergeValue {
+	if temp.Version >= main.Version {
+		return temp
+	}
+	return main
+}
+
+func keepMain(key []byte, main, temp MergeValue) MergeValue {
+	if main.Deleted {
+		return temp
+	}
+	return main
+}
+
+// MergeOperator is a MergePolicy whose keys also take operands written with
+// Merge, in the style of RocksDB associative merge operators: an operand is
+// combined into the value instead of replacing it. Operands written during the
+// backup window are combined together in tempDB, then into the mainDB value by
+// the merge. Merge must therefore be associative, and should be commutative:
+// a Merge reaching mainDB while tempDB is merged in applies before the older
+// operands still in tempDB. Puts and Deletes resolve like LastWriterWins
+type MergeOperator interface {
+	MergePolicy
+	// Name identifies the operator in the change log, replaying a logged
+	// operand takes the operator of the same name
+	Name() string
+	// Merge combines operand into existing, nil when the key is missing.
+	// existing is an operand itself when two operands are combined
+	Merge(key, existing, operand []byte) ([]byte, error)
+}
+
+var (
+	// AddCounter adds operands to the value, both int64 in decimal
+	AddCounter MergeOperator = addCounter{}
+	// SetUnion adds the members of the operand to the value, both sets
+	// encoded by EncodeSet
+	SetUnion MergeOperator = setUnion{}
+)
+
+// builtinOperators are known to every replay of the change log
+var builtinOperators = []MergeOperator{AddCounter, SetUnion}
+
+type addCounter struct{}
+
+func (addCounter) Name() string { return "add" }
+
+func (addCounter) Resolve(key []byte, main, temp MergeValue) MergeValue {
+	return lastWriterWins(key, main, temp)
+}
+
+func (addCounter) Merge(key, existing, operand []byte) ([]byte, error) {
+	var sum int64
+	for _, value := range [][]byte{existing, operand} {
+		if value == nil {
+			continue
+		}
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("counter %q: %w", key, err)
+		}
+		sum += n
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+type setUnion struct{}
+
+func (setUnion) Name() string { return "union" }
+
+func (setUnion) Resolve(key []byte, main, temp MergeValue) MergeValue {
+	return lastWriterWins(key, main, temp)
+}
+
+func (setUnion) Merge(key, existing, operand []byte) ([]byte, error) {
+	members, err := DecodeSet(existing)
+	if err != nil {
+		return nil, fmt.Errorf("set %q: %w", key, err)
+	}
+	added, err := DecodeSet(operand)
+	if err != nil {
+		return nil, fmt.Errorf("set %q: %w", key, err)
+	}
+	return EncodeSet(append(members, added...)...), nil
+}
+
+// EncodeSet encodes members as a set value of SetUnion: sorted, without
+// duplicates, each prefixed with its uvarint length
+func EncodeSet(members ...[]byte) []byte {
+	sorted := append([][]byte{}, members...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	var buf []byte
+	var last []byte
+	for i, member := range sorted {
+		if i > 0 && bytes.Equal(member, last) {
+			continue
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(member)))
+		buf = append(buf, member...)
+		last = member
+	}
+	if buf == nil {
+		buf = []byte{}
+	}
+	return buf
+}
+
+// DecodeSet returns the members of a set value of SetUnion
+func DecodeSet(value []byte) ([][]byte, error) {
+	var members [][]byte
+	for len(value) > 0 {
+		size, n := binary.Uvarint(value)
+		if n <= 0 || uint64(len(value)-n) < size {
+			return nil, errors.New("corrupted set")
+		}
+		members = append(members, value[n:n+int(size)])
+		value = value[n+int(size):]
+	}
+	return members, nil
+}
+
+// MergePolicies selects the policy of a key by the longest prefix it starts
+// with, the empty prefix sets the default. It must not change once an engine
+// uses it
+type MergePolicies map[string]MergePolicy
+
+// policy returns the policy of key, LastWriterWins if no prefix matches
+func (p MergePolicies) policy(key []byte) MergePolicy {
+	var policy MergePolicy = LastWriterWins
+	best := -1
+	for prefix, candidate := range p {
+		if len(prefix) > best && strings.HasPrefix(string(key), prefix) {
+			policy, best = candidate, len(prefix)
+		}
+	}
+	return policy
+}
+
+// mergeOperator returns the operator of key, ErrNoMergeOperator when its
+// policy is none
+func (p MergePolicies) mergeOperator(key []byte) (MergeOperator, error) {
+	op, ok := p.policy(key).(MergeOperator)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrNoMergeOperator, key)
+	}
+	return op, nil
+}
+
+// operator returns the operator named name among p and the built-in ones
+func (p MergePolicies) operator(name string) (MergeOperator, error) {
+	for _, policy := range p {
+		if op, ok := policy.(MergeOperator); ok && op.Name() == name {
+			return op, nil
+		}
+	}
+	for _, op := range builtinOperators {
+		if op.Name() == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("%w named %q", ErrNoMergeOperator, name)
+}
+
+// SetMergePolicies sets the operators combining the merge operands of the
+// changes replayed by a restore, the built-in operators are always known
+func (c *BackupCatalog) SetMergePolicies(p MergePolicies) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mergePolicies = p
+}
+
+func (c *BackupCatalog) getMergePolicies() MergePolicies {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mergePolicies
+}
+
+func mainValue(main *envelope) MergeValue {
+	if main == nil {
+		return MergeValue{Deleted: true}
+	}
+	return MergeValue{Value: main.value, Version: main.version, Deleted: main.tombstone}
+}
+
+// merge returns the state of key once its tempDB record is merged into its
+// mainDB value, either may be nil
+func (p MergePolicies) merge(key []byte, temp *record, main *envelope) (MergeValue, error) {
+	m := mainValue(main)
+	if temp == nil {
+		return m, nil
+	}
+
+	var v MergeValue
+	if temp.kind == recordOperand {
+		op, err := p.mergeOperator(key)
+		if err != nil {
+			return m, err
+		}
+		var existing []byte
+		if !m.Deleted {
+			existing = m.Value
+		}
+		value, err := op.Merge(key, existing, temp.value)
+		if err != nil {
+			return m, err
+		}
+		v = MergeValue{Value: value}
+	} else {
+		v = p.policy(key).Resolve(key, m, MergeValue{
+			Value:   temp.value,
+			Version: temp.version,
+			Deleted: temp.kind == recordTombstone,
+		})
+	}
+	if v.Version == 0 {
+		v.Version = m.Version
+		if temp.version > v.Version {
+			v.Version = temp.version
+		}
+	}
+	return v, nil
+}
+
+// resolve returns the value of key across its tempDB record and mainDB value.
+// It returns leveldb.ErrNotFound when the key is missing or deleted
+func (p MergePolicies) resolve(key []byte, temp *record, main *envelope) ([]byte, error) {
+	v, err := p.merge(key, temp, main)
+	if err != nil {
+		return nil, err
+	}
+	if v.Deleted {
+		return nil, leveldb.ErrNotFound
+	}
+	return v.Value, nil
+}
+
+// mergeTempOperand combines operand into the tempDB record of key. writeMu is
+// held exclusively so no other write to tempDB slips in between
+func mergeTempOperand(db *leveldb.DB, writeMu *sync.RWMutex, op MergeOperator, key, operand []byte) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	current, err := readRecord(db, key)
+	if err != nil {
+		return err
+	}
+	r := record{kind: recordOperand, version: versions.next(), value: operand}
+	if current != nil {
+		var existing []byte
+		switch current.kind {
+		case recordOperand:
+			existing = current.value
+		case recordValue:
+			// a Put during the window, the result is a value again
+			existing = current.value
+			r.kind = recordValue
+		default:
+			r.kind = recordValue
+		}
+		if r.value, err = op.Merge(key, existing, operand); err != nil {
+			return err
+		}
+	}
+	return db.Put(key, encodeRecord(r), wo)
+}
+
+// mergeMainOperand combines operand into the mainDB value of key. writeMu is
+// held exclusively so no other write to mainDB slips in between
+func mergeMainOperand(db *leveldb.DB, writeMu *sync.RWMutex, versioned bool, op MergeOperator, key, operand []byte) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	main, err := readEnvelope(db, key, versioned)
+	if err != nil {
+		return err
+	}
+	var existing []byte
+	if main != nil && !main.tombstone {
+		existing = main.value
+	}
+	value, err := op.Merge(key, existing, operand)
+	if err != nil {
+		return err
+	}
+	if versioned {
+		value = encodeEnvelope(envelope{version: versions.next(), value: value})
+	}
+	return db.Put(key, value, wo)
+}
+
+// Merge operands are logged as a Put of their key with the value
+// magic | uvarint name length | operator name | operand
+var operandMagic = []byte{0xff, 'l', 'm', 0x01}
+
+func encodeOperand(name string, operand []byte) []byte {
+	buf := append([]byte{}, operandMagic...)
+	buf = binary.AppendUvarint(buf, uint64(len(name)))
+	buf = append(buf, name...)
+	return append(buf, operand...)
+}
+
+// decodeOperand returns the operator name and operand of a logged value, ok is
+// false for a plain value
+func decodeOperand(value []byte) (name string, operand []byte, ok bool) {
+	if !bytes.HasPrefix(value, operandMagic) {
+		return "", nil, false
+	}
+	rest := value[len(operandMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return "", nil, false
+	}
+	return string(rest[n : n+int(size)]), rest[n+int(size):], true
+}
+
+func (l *changeLog) appendOperand(op MergeOperator, key, operand []byte) (uint64, error) {
+	return l.appendPut(key, encodeOperand(op.Name(), operand))
+}
+
+// changeReplay splits a logged batch into its plain records and its merge
+// operands
+type changeReplay struct {
+	batch    *leveldb.Batch
+	operands []loggedOperand
+}
+
+type loggedOperand struct {
+	key, operand []byte
+	name         string
+}
+
+func (r *changeReplay) Put(key, value []byte) {
+	if name, operand, ok := decodeOperand(value); ok {
+		r.operands = append(r.operands, loggedOperand{key: append([]byte{}, key...), operand: append([]byte{}, operand...), name: name})
+		return
+	}
+	r.batch.Put(key, value)
+}
+
+func (r *changeReplay) Delete(key []byte) {
+	r.batch.Delete(key)
+}
+
+// replayChange applies a logged batch to db. Its merge operands are combined
+// into their key by the operator of the same name in policies or among the
+// built-in ones
+func replayChange(db *leveldb.DB, batch *leveldb.Batch, policies MergePolicies) error {
+	r := &changeReplay{batch: &leveldb.Batch{}}
+	if err := batch.Replay(r); err != nil {
+		return err
+	}
+	if len(r.operands) == 0 {
+		return db.Write(batch, nil)
+	}
+	if err := db.Write(r.batch, nil); err != nil {
+		return err
+	}
+
+	for _, o := range r.operands {
+		op, err := policies.operator(o.name)
+		if err != nil {
+			return err
+		}
+		// the backup replayed on may come from a versioned mainDB, the
+		// combined value is written raw like the other replayed values
+		main, err := readEnvelope(db, o.key, true)
+		if err != nil {
+			return err
+		}
+		var existing []byte
+		if main != nil && !main.tombstone {
+			existing = main.value
+		}
+		value, err := op.Merge(o.key, existing, o.operand)
+		if err != nil {
+			return err
+		}
+		if err := db.Put(o.key, value, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package db
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// BackupProgress is a point in time view of a running backup
+type BackupProgress struct {
+	// ID and Mode are empty until the backup folder is created
+	ID      string
+	Mode    string
+	Start   time.Time
+	Elapsed time.Duration
+
+	// Files counts the files of a copy or checkpoint backup done so far
+	Files, FilesTotal int64
+	// Records counts the keys of an online backup, or the changes of an
+	// incremental one, written so far
+	Records, RecordsTotal int64
+	// Bytes counts the file or key and value bytes written so far
+	Bytes, BytesTotal int64
+}
+
+// Remaining estimates the time left from the rate so far, -1 when unknown
+func (p *BackupProgress) Remaining() time.Duration {
+	var done float64
+	switch {
+	case p.BytesTotal > 0:
+		done = float64(p.Bytes) / float64(p.BytesTotal)
+	case p.RecordsTotal > 0:
+		done = float64(p.Records) / float64(p.RecordsTotal)
+	default:
+		return -1
+	}
+	if done <= 0 {
+		return -1
+	}
+	if done >= 1 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * (1 - done) / done)
+}
+
+// backupProgress counts the work of a pending backup and paces it to limit,
+// every method accepts a nil receiver
+type backupProgress struct {
+	files, filesTotal     int64
+	records, recordsTotal int64
+	bytes, bytesTotal     int64
+
+	limit *throttle
+}
+
+// wait checks ctx and holds the backup to its rate limit for n more bytes
+func (p *backupProgress) wait(ctx context.Context, n int) error {
+	if p == nil {
+		return ctx.Err()
+	}
+	return p.limit.wait(ctx, n)
+}
+
+// paced returns a progress sharing only the rate limit of p, for work that is
+// already counted
+func (p *backupProgress) paced() *backupProgress {
+	if p == nil {
+		return nil
+	}
+	return &backupProgress{limit: p.limit}
+}
+
+func (p *backupProgress) addFile() {
+	if p != nil {
+		atomic.AddInt64(&p.files, 1)
+	}
+}
+
+func (p *backupProgress) addRecord(bytes int) {
+	if p != nil {
+		atomic.AddInt64(&p.records, 1)
+		atomic.AddInt64(&p.bytes, int64(bytes))
+	}
+}
+
+func (p *backupProgress) addBytes(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, int64(n))
+	}
+}
+
+// total sets the expected amount of work, zero leaves a total unknown
+func (p *backupProgress) total(files, records, bytes int64) {
+	if p != nil {
+		atomic.StoreInt64(&p.filesTotal, files)
+		atomic.StoreInt64(&p.recordsTotal, records)
+		atomic.StoreInt64(&p.bytesTotal, bytes)
+	}
+}
+
+// progressReader counts the bytes read from a file into p, paced to its rate
+// limit, and stops once ctx is done
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress *backupProgress
+}
+
+func (r *progressReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(buf)
+	r.progress.addBytes(n)
+	if err == io.EOF {
+		r.progress.addFile()
+	}
+	if n > 0 {
+		if waitErr := r.progress.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// dirSize returns the number and size of the files under dir
+func dirSize(dir string) (files, bytes int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	return files, bytes, err
+}
+
+// snapshotSize is the size of a snapshot as written by an online backup
+type snapshotSize struct {
+	keys int64
+	// bytes sums the keys and values
+	bytes int64
+	// dump is the size of the dump file of the snapshot
+	dump int64
+}
+
+// sizeSnapshot reads snap once to size it
+func sizeSnapshot(ctx context.Context, snap *leveldb.Snapshot) (snapshotSize, error) {
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+
+	size := snapshotSize{dump: int64(len(dumpMagic))}
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return size, err
+		}
+		size.keys++
+		size.bytes += int64(len(iter.Key()) + len(iter.Value()))
+		size.dump += int64(uvarintSize(uint64(len(iter.Key()))) + len(iter.Key()))
+		size.dump += int64(uvarintSize(uint64(len(iter.Value()))) + len(iter.Value()))
+	}
+	return size, iter.Error()
+}
+
+func uvarintSize(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// backupRun is a backup an engine runs, it stops once ctx is done
+type backupRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  time.Time
+	limit  *throttle
+
+	mu      sync.Mutex
+	backup  *pendingBackup
+	waiters []*backupWaiter
+}
+
+// track publishes the progress of b as the progress of the run
+func (r *backupRun) track(b *pendingBackup) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.backup = b
+	r.mu.Unlock()
+	b.run = r
+	b.progress.limit = r.limit
+}
+
+func (r *backupRun) progress() *BackupProgress {
+	r.mu.Lock()
+	b := r.backup
+	r.mu.Unlock()
+
+	progress := &BackupProgress{Start: r.start, Elapsed: time.Since(r.start)}
+	if b == nil {
+		return progress
+	}
+	progress.ID = b.manifest.ID
+	progress.Mode = b.manifest.Mode
+	p := b.progress
+	progress.Files = atomic.LoadInt64(&p.files)
+	progress.FilesTotal = atomic.LoadInt64(&p.filesTotal)
+	progress.Records = atomic.LoadInt64(&p.records)
+	progress.RecordsTotal = atomic.LoadInt64(&p.recordsTotal)
+	progress.Bytes = atomic.LoadInt64(&p.bytes)
+	progress.BytesTotal = atomic.LoadInt64(&p.bytesTotal)
+	return progress
+}
+
+// backupWaiter is a Backup call waiting for the next backup to end
+type backupWaiter struct {
+	ctx  context.Context
+	done chan backupResult
+}
+
+type backupResult struct {
+	manifest *BackupManifest
+	err      error
+}
+
+// backupControl tracks the backup an engine is running so it can be
+// observed, cancelled and waited for
+type backupControl struct {
+	// limit paces every backup, nil is unlimited
+	limit *throttle
+
+	mu      sync.Mutex
+	running *backupRun
+	// pending Backup calls join the next backup to start
+	pending []*backupWaiter
+	closed  bool
+}
+
+// start registers a backup starting now, the pending Backup calls join it and
+// cancel it when their context is done. It is cancelled after timeout, zero
+// is unbounded
+func (c *backupControl) start(timeout time.Duration) *backupRun {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	run := &backupRun{ctx: ctx, cancel: cancel, start: time.Now(), limit: c.limit}
+
+	c.mu.Lock()
+	if c.closed {
+		cancel()
+	}
+	run.waiters, c.pending = c.pending, nil
+	c.running = run
+	c.mu.Unlock()
+
+	for _, w := range run.waiters {
+		go func(w *backupWaiter) {
+			select {
+			case <-w.ctx.Done():
+				run.cancel()
+			case <-run.ctx.Done():
+			}
+		}(w)
+	}
+	return run
+}
+
+// finish ends run, manifest is nil when there was nothing to back up
+func (c *backupControl) finish(run *backupRun, manifest *BackupManifest, err error) {
+	c.mu.Lock()
+	if c.running == run {
+		c.running = nil
+	}
+	c.mu.Unlock()
+
+	run.cancel()
+	for _, w := range run.waiters {
+		w.done <- backupResult{manifest: manifest, err: err}
+	}
+}
+
+// wait joins the next backup, started by trigger, and returns its result.
+// Once ctx is done a pending call returns at once, a running backup is
+// cancelled and its partial backup removed first
+func (c *backupControl) wait(ctx context.Context, trigger func()) (*BackupManifest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w := &backupWaiter{ctx: ctx, done: make(chan backupResult, 1)}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, leveldb.ErrClosed
+	}
+	c.pending = append(c.pending, w)
+	c.mu.Unlock()
+	trigger()
+
+	select {
+	case res := <-w.done:
+		return res.manifest, res.err
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	for i, pending := range c.pending {
+		if pending == w {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			c.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	c.mu.Unlock()
+	if res := <-w.done; res.err == nil {
+		return res.manifest, nil
+	}
+	return nil, ctx.Err()
+}
+
+// progress returns the progress of the running backup, nil if there is none
+func (c *backupControl) progress() *BackupProgress {
+	c.mu.Lock()
+	run := c.running
+	c.mu.Unlock()
+	if run == nil {
+		return nil
+	}
+	return run.progress()
+}
+
+// cancel stops the running backup and reports whether there was one
+func (c *backupControl) cancel() bool {
+	c.mu.Lock()
+	run := c.running
+	c.mu.Unlock()
+	if run == nil {
+		return false
+	}
+	run.cancel()
+	return true
+}
+
+// close cancels the running backup and fails the pending Backup calls
+func (c *backupControl) close() {
+	c.mu.Lock()
+	c.closed = true
+	run := c.running
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	if run != nil {
+		run.cancel()
+	}
+	for _, w := range pending {
+		w.done <- backupResult{err: leveldb.ErrClosed}
+	}
+}
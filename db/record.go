@@ -0,0 +1,165 @@
+package db
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Every value stored in tempDB is prefixed with a record kind so that a delete
+// issued during the backup window can shadow the value still in mainDB until
+// the merge applies it.
+const (
+	recordValue byte = iota
+	recordTombstone
+	// recordOperand holds merge operands to combine into the mainDB value,
+	// see MergeOperator
+	recordOperand
+
+	// recordVersioned is set on the kind of records carrying a version, the
+	// version follows the kind (and batch id)
+	recordVersioned byte = 0x40
+
+	// recordInBatch is set on the kind of records written by a batch, the
+	// batch id follows the kind so the merge can move them together
+	recordInBatch byte = 0x80
+)
+
+// tempFormatFileName marks, in the tempDB folder, a tempDB holding records. A
+// tempDB without it was written before records and holds raw values
+const tempFormatFileName = "RECORDS"
+
+// record is a decoded tempDB value
+type record struct {
+	kind    byte
+	batchID uint64 // 0 when not written by a batch
+	version uint64 // 0 for records written before versions were recorded
+	value   []byte
+}
+
+var lastBatchID = uint64(time.Now().UnixNano())
+
+// nextBatchID returns an id unique to this process and greater than the ids
+// used by previous runs
+func nextBatchID() uint64 {
+	return atomic.AddUint64(&lastBatchID, 1)
+}
+
+func encodeRecord(r record) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(r.value))
+	buf[0] = r.kind | recordVersioned
+	n := 1
+	if r.batchID != 0 {
+		buf[0] |= recordInBatch
+		n += binary.PutUvarint(buf[n:], r.batchID)
+	}
+	n += binary.PutUvarint(buf[n:], r.version)
+	n += copy(buf[n:], r.value)
+	return buf[:n]
+}
+
+func decodeRecord(buf []byte) record {
+	if len(buf) == 0 {
+		return record{kind: recordValue}
+	}
+
+	r := record{kind: buf[0], value: buf[1:]}
+	if r.kind&recordInBatch != 0 {
+		id, n := binary.Uvarint(r.value)
+		if n > 0 {
+			r.batchID, r.value = id, r.value[n:]
+		}
+	}
+	if r.kind&recordVersioned != 0 {
+		version, n := binary.Uvarint(r.value)
+		if n > 0 {
+			r.version, r.value = version, r.value[n:]
+		}
+	}
+	r.kind &^= recordInBatch | recordVersioned
+	return r
+}
+
+// openTempDB opens the tempDB at path. The raw values of a tempDB written
+// before records are rewritten as records first
+func openTempDB(path string) (*leveldb.DB, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateTempDB(db, path); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateTempDB rewrites the raw values of a tempDB without format marker as
+// records, then writes the marker. The values are rewritten by a single batch
+// so a crash can't leave some of them rewritten and the others raw: tempDB
+// only holds the writes of a backup window
+func migrateTempDB(db *leveldb.DB, path string) error {
+	marker := filepath.Join(path, tempFormatFileName)
+	if _, err := os.Stat(marker); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	batch := &leveldb.Batch{}
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		batch.Put(iter.Key(), encodeRecord(record{kind: recordValue, value: iter.Value()}))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() > 0 {
+		log.Printf("Rewrite %d raw values of tempDB %s as records", batch.Len(), path)
+		if err := db.Write(batch, mergeWo); err != nil {
+			return err
+		}
+	}
+	if err := writeFileSync(marker, []byte("1\n")); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// readRecord reads key from tempDB, it returns nil when the key is not found
+func readRecord(db *leveldb.DB, key []byte) (*record, error) {
+	value, err := db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := decodeRecord(value)
+	return &r, nil
+}
+
+// newTempBatch converts batch into the tempDB record format
+func newTempBatch(batch *leveldb.Batch) *leveldb.Batch {
+	temp := &leveldb.Batch{}
+	batch.Replay(tempBatchReplay{batch: temp, id: nextBatchID(), version: versions.next()})
+	return temp
+}
+
+type tempBatchReplay struct {
+	batch   *leveldb.Batch
+	id      uint64
+	version uint64
+}
+
+func (r tempBatchReplay) Put(key, value []byte) {
+	r.batch.Put(key, encodeRecord(record{kind: recordValue, batchID: r.id, version: r.version, value: value}))
+}
+
+func (r tempBatchReplay) Delete(key []byte) {
+	r.batch.Put(key, encodeRecord(record{kind: recordTombstone, batchID: r.id, version: r.version}))
+}
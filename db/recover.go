@@ -0,0 +1,187 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var ErrNoRecoveryPoint = errors.New("db: no backup taken before the recovery target")
+
+// RecoveryTarget is the point to recover to, a zero field is not a bound. The
+// recovery stops before the first change logged after Time or numbered after
+// Seq
+type RecoveryTarget struct {
+	Time time.Time
+	Seq  uint64
+}
+
+// RecoveryReport describes a recovered database
+type RecoveryReport struct {
+	BackupID string    `json:"backup_id"`
+	BaseSeq  uint64    `json:"base_seq"`
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time,omitempty"`
+	Changes  int64     `json:"changes"`
+
+	KeyCount int64  `json:"key_count"`
+	SHA256   string `json:"sha256"`
+}
+
+// Recover restores into the new folder dst the newest backup of source taken
+// before target, then replays the changes of the change log at changeLogDir up
+// to target. source is the mainDB path recorded in the manifests and the
+// change log may belong to a running engine.
+func (c *BackupCatalog) Recover(source, changeLogDir, dst string, target RecoveryTarget) (*RecoveryReport, error) {
+	if _, err := os.Stat(dst); err == nil {
+		return nil, fmt.Errorf("recover into %s: %w", dst, os.ErrExist)
+	}
+
+	manifest, err := c.recoveryPoint(source, target)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := c.chain(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range chain {
+		if err := c.verifyFiles(backup); err != nil {
+			return nil, err
+		}
+	}
+
+	report, err := c.recover(chain, changeLogDir, dst, target)
+	if err != nil {
+		os.RemoveAll(dst)
+		return nil, err
+	}
+	log.Printf("Recovered backup %s plus %d changes up to seq %d into %s", report.BackupID, report.Changes, report.Seq, dst)
+	return report, nil
+}
+
+// recoveryPoint returns the newest backup of source holding only changes
+// before target
+func (c *BackupCatalog) recoveryPoint(source string, target RecoveryTarget) (*BackupManifest, error) {
+	manifests, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(manifests) - 1; i >= 0; i-- {
+		manifest := manifests[i]
+		// the sequence of a backup is read before it starts, every change it
+		// holds is logged before StartTime
+		if manifest.Source != source || manifest.Seq == 0 {
+			continue
+		}
+		if target.Seq != 0 && manifest.Seq > target.Seq {
+			continue
+		}
+		if !target.Time.IsZero() && manifest.StartTime.After(target.Time) {
+			continue
+		}
+		return manifest, nil
+	}
+	return nil, ErrNoRecoveryPoint
+}
+
+func (c *BackupCatalog) recover(chain []*BackupManifest, changeLogDir, dst string, target RecoveryTarget) (*RecoveryReport, error) {
+	manifest := chain[len(chain)-1]
+	if err := c.restoreData(chain[0], dst); err != nil {
+		return nil, err
+	}
+	if err := validateRestore(dst, chain[0]); err != nil {
+		return nil, err
+	}
+	if err := c.replayChanges(chain[1:], 0, dst); err != nil {
+		return nil, err
+	}
+
+	report := &RecoveryReport{
+		BackupID: manifest.ID,
+		BaseSeq:  manifest.Seq,
+		Seq:      manifest.Seq,
+	}
+	recoverDB, err := leveldb.OpenFile(dst, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := c.getMergePolicies()
+	errStop := errors.New("stop")
+	err = replayChangeDir(changeLogDir, manifest.Seq+1, target.Seq, func(ch *change) error {
+		if !target.Time.IsZero() && ch.time.After(target.Time) {
+			return errStop
+		}
+		if ch.seq != report.Seq+1 {
+			return fmt.Errorf("%w: change log misses sequence %d", ErrSeqNotCovered, report.Seq+1)
+		}
+		if err := replayChange(recoverDB, ch.batch, policies); err != nil {
+			return err
+		}
+		report.Seq = ch.seq
+		report.Time = ch.time
+		report.Changes++
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	if closeErr := recoverDB.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if target.Seq != 0 && report.Seq < target.Seq && target.Time.IsZero() {
+		return nil, fmt.Errorf("%w: change log ends at %d", ErrSeqNotCovered, report.Seq)
+	}
+
+	report.KeyCount, report.SHA256, err = Checksum(dst)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Checksum opens the LevelDB at path read-only and returns its live key count
+// with a SHA-256 over its keys and values in key order. Versioned values are
+// hashed without their envelope so databases holding the same data match.
+func Checksum(path string) (int64, string, error) {
+	checkDB, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return 0, "", err
+	}
+	defer checkDB.Close()
+
+	h := sha256.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+	var count int64
+	iter := checkDB.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		value := decodeEnvelope(iter.Value(), true)
+		if value.tombstone {
+			continue
+		}
+
+		count++
+		h.Write(buf[:binary.PutUvarint(buf, uint64(len(iter.Key())))])
+		h.Write(iter.Key())
+		h.Write(buf[:binary.PutUvarint(buf, uint64(len(value.value)))])
+		h.Write(value.value)
+	}
+	if err := iter.Error(); err != nil {
+		return 0, "", err
+	}
+	return count, hex.EncodeToString(h.Sum(nil)), nil
+}
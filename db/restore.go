@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	cp "github.com/otiai10/copy"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var (
+	ErrBackupCorrupted = errors.New("db: backup does not match its manifest")
+	ErrDBInUse         = errors.New("db: database is locked by a running process")
+)
+
+// Restore restores backup backupID of the DefaultBackupRoot catalog into
+// targetPath, see BackupCatalog.Restore
+func Restore(backupID, targetPath string) error {
+	catalog, err := NewBackupCatalog(DefaultBackupRoot)
+	if err != nil {
+		return err
+	}
+	return catalog.Restore(backupID, targetPath)
+}
+
+// Restore verifies backup id against its manifest, restores it into a staging
+// folder next to targetPath, opens it to validate the key count and then swaps
+// it in place of targetPath. targetPath is the mainDB folder of a stopped
+// engine, Restore refuses to replace a database locked by a running process.
+// The tempDB, merge report and change log of the engine next to a replaced
+// mainDB are moved aside into targetPath.before-restore-<id>, they belong to
+// the replaced state. An incremental backup is restored from its full backup
+// plus every increment up to it.
+func (c *BackupCatalog) Restore(id, targetPath string) error {
+	return c.RestoreToSequence(id, targetPath, 0)
+}
+
+// RestoreToSequence works like Restore but replays the increments of the chain
+// of backup id only up to change seq, zero replays them all
+func (c *BackupCatalog) RestoreToSequence(id, targetPath string, seq uint64) error {
+	manifest, err := c.Get(id)
+	if err != nil {
+		return err
+	}
+	chain, err := c.chain(manifest)
+	if err != nil {
+		return err
+	}
+	base := chain[0]
+	if seq != 0 && (seq < base.Seq || seq > manifest.Seq) {
+		return fmt.Errorf("%w: %d not in [%d, %d]", ErrSeqNotCovered, seq, base.Seq, manifest.Seq)
+	}
+	for _, manifest := range chain {
+		if err := c.verifyFiles(manifest); err != nil {
+			return err
+		}
+	}
+	if err := checkNotInUse(targetPath); err != nil {
+		return err
+	}
+
+	staging := fmt.Sprintf("%s.restore-%s", targetPath, id)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := c.restoreData(base, staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := validateRestore(staging, base); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := c.replayChanges(chain[1:], seq, staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	aside := fmt.Sprintf("%s.before-restore-%s", targetPath, id)
+	moved, err := moveEngineState(targetPath, aside)
+	if err != nil {
+		putBackEngineState(targetPath, aside, moved)
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := swapDir(staging, targetPath, fmt.Sprintf("%s.old-%s", targetPath, id)); err != nil {
+		putBackEngineState(targetPath, aside, moved)
+		os.RemoveAll(staging)
+		return err
+	}
+	if len(moved) > 0 {
+		log.Printf("Moved %q of the replaced mainDB into %s", moved, aside)
+	}
+	log.Printf("Restored backup %s into %s", id, targetPath)
+	return nil
+}
+
+// engineStateFiles are kept by an engine next to its mainDB folder
+var engineStateFiles = []string{"temp", mergeStateFileName, mergeStateFileName + ".tmp", "changelog"}
+
+// moveEngineState moves the engine state next to the mainDB at targetPath into
+// aside, so the restored mainDB is neither merged with the tempDB of the
+// replaced one nor followed by its change log. Nothing is moved when
+// targetPath doesn't exist, the folder may hold another engine. It returns the
+// names moved
+func moveEngineState(targetPath, aside string) ([]string, error) {
+	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	dir := filepath.Dir(targetPath)
+	if err := checkNotInUse(filepath.Join(dir, "temp")); err != nil {
+		return nil, err
+	}
+
+	var moved []string
+	for _, name := range engineStateFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return moved, err
+		}
+		if len(moved) == 0 {
+			if err := os.RemoveAll(aside); err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(aside, 0755); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Rename(path, filepath.Join(aside, name)); err != nil {
+			return moved, err
+		}
+		moved = append(moved, name)
+	}
+	return moved, nil
+}
+
+// putBackEngineState undoes moveEngineState after a failed restore
+func putBackEngineState(targetPath, aside string, moved []string) {
+	for _, name := range moved {
+		if err := os.Rename(filepath.Join(aside, name), filepath.Join(filepath.Dir(targetPath), name)); err != nil {
+			log.Printf("[catch me] error while put back %s from %s: %s", name, aside, err.Error())
+		}
+	}
+	if len(moved) > 0 {
+		os.Remove(aside)
+	}
+}
+
+// verifyFiles checks every file of the backup against the manifest checksums
+func (c *BackupCatalog) verifyFiles(manifest *BackupManifest) error {
+	dataPath := c.DataPath(manifest.ID)
+	for _, file := range manifest.Files {
+		path := filepath.Join(dataPath, filepath.FromSlash(file.Path))
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrBackupCorrupted, err.Error())
+		}
+		if info.Size() != file.Size {
+			return fmt.Errorf("%w: %s has %d bytes, want %d", ErrBackupCorrupted, file.Path, info.Size(), file.Size)
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if sum != file.SHA256 {
+			return fmt.Errorf("%w: %s checksum mismatch", ErrBackupCorrupted, file.Path)
+		}
+	}
+	return nil
+}
+
+// restoreData writes the data of the backup as a LevelDB folder at dst
+func (c *BackupCatalog) restoreData(manifest *BackupManifest, dst string) error {
+	return c.withData(manifest, func(dataPath string) error {
+		if manifest.Mode == BackupDump {
+			return loadDump(filepath.Join(dataPath, dumpFileName), dst)
+		}
+		if manifest.Format != "" {
+			// the manifest lists the archive, not the files it holds
+			return cp.Copy(dataPath, dst)
+		}
+		return copyFiles(manifest, dataPath, dst)
+	})
+}
+
+// copyFiles copies the files of the manifest from dataPath into dst
+func copyFiles(manifest *BackupManifest, dataPath, dst string) error {
+	for _, file := range manifest.Files {
+		path := filepath.Join(dst, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(context.Background(), filepath.Join(dataPath, filepath.FromSlash(file.Path)), path, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDump writes every record of the dump file src into a new LevelDB at dst
+func loadDump(src, dst string) error {
+	restoreDB, err := leveldb.OpenFile(dst, nil)
+	if err != nil {
+		return err
+	}
+
+	batch := &leveldb.Batch{}
+	size := 0
+	err = readDump(src, func(key, value []byte) error {
+		batch.Put(key, value)
+		size += len(key) + len(value)
+		if size < snapshotBatchSize {
+			return nil
+		}
+		size = 0
+		err := restoreDB.Write(batch, nil)
+		batch.Reset()
+		return err
+	})
+	if err == nil {
+		err = restoreDB.Write(batch, nil)
+	}
+	if closeErr := restoreDB.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// validateRestore opens the restored LevelDB at path and checks its key count
+func validateRestore(path string, manifest *BackupManifest) error {
+	restoreDB, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBackupCorrupted, err.Error())
+	}
+	defer restoreDB.Close()
+
+	iter := restoreDB.NewIterator(nil, nil)
+	defer iter.Release()
+	var count int64
+	for iter.Next() {
+		count++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("%w: %s", ErrBackupCorrupted, err.Error())
+	}
+	if count != manifest.KeyCount {
+		return fmt.Errorf("%w: restored %d keys, want %d", ErrBackupCorrupted, count, manifest.KeyCount)
+	}
+	return nil
+}
+
+// checkNotInUse fails with ErrDBInUse when the LevelDB at path is opened. A
+// folder without LOCK file was never opened as a LevelDB
+func checkNotInUse(path string) error {
+	if _, err := os.Stat(filepath.Join(path, "LOCK")); os.IsNotExist(err) {
+		return nil
+	}
+
+	stor, err := storage.OpenFile(path, true)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return fmt.Errorf("%w: %s", ErrDBInUse, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return stor.Close()
+}
+
+// swapDir replaces target by src, the previous target is moved to old first and
+// put back if the swap fails
+func swapDir(src, target, old string) error {
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+
+	_, err := os.Stat(target)
+	exists := err == nil
+	if exists {
+		if err := os.Rename(target, old); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, target); err != nil {
+		if exists {
+			os.Rename(old, target)
+		}
+		return err
+	}
+	if exists {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
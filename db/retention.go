@@ -0,0 +1,202 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// RetentionPolicy decides which backups of a source are kept. Zero fields
+// disable their rule; when no keep rule is set every backup is kept before
+// MaxTotalSize applies. The newest verified backup is never pruned, nor the
+// backups an incremental backup kept is built on.
+type RetentionPolicy struct {
+	// KeepLast keeps the N newest backups
+	KeepLast int
+	// KeepHourly, KeepDaily and KeepWeekly keep the newest backup of each of
+	// the N latest hours, days and ISO weeks holding a backup
+	KeepHourly int
+	KeepDaily  int
+	KeepWeekly int
+
+	// MaxTotalSize drops the oldest kept backups, each with the incremental
+	// backups built on it, until the backups of a source take at most that
+	// many bytes
+	MaxTotalSize int64
+}
+
+func (p RetentionPolicy) hasKeepRule() bool {
+	return p.KeepLast > 0 || p.KeepHourly > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0
+}
+
+// PrunePlan returns the backups policy would delete, oldest first
+func (c *BackupCatalog) PrunePlan(policy RetentionPolicy) ([]*BackupManifest, error) {
+	manifests, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// backups of different sources are retained independently
+	bySource := map[string][]*BackupManifest{}
+	var sources []string
+	for _, manifest := range manifests {
+		if _, ok := bySource[manifest.Source]; !ok {
+			sources = append(sources, manifest.Source)
+		}
+		bySource[manifest.Source] = append(bySource[manifest.Source], manifest)
+	}
+
+	var prune []*BackupManifest
+	for _, source := range sources {
+		prune = append(prune, policy.prune(bySource[source])...)
+	}
+	return prune, nil
+}
+
+// Prune deletes the backups policy does not keep and returns their IDs
+func (c *BackupCatalog) Prune(policy RetentionPolicy) ([]string, error) {
+	prune, err := c.PrunePlan(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, manifest := range prune {
+		if err := c.Delete(manifest.ID); err != nil {
+			return deleted, fmt.Errorf("delete backup %s: %w", manifest.ID, err)
+		}
+		deleted = append(deleted, manifest.ID)
+	}
+	return deleted, nil
+}
+
+// prune returns the manifests, sorted oldest first, not kept by p
+func (p RetentionPolicy) prune(manifests []*BackupManifest) []*BackupManifest {
+	keep := make([]bool, len(manifests))
+	if !p.hasKeepRule() {
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+
+	for i := len(manifests) - 1; i >= 0 && i >= len(manifests)-p.KeepLast; i-- {
+		keep[i] = true
+	}
+	p.keepPeriods(manifests, keep, p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02T15") })
+	p.keepPeriods(manifests, keep, p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	p.keepPeriods(manifests, keep, p.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+
+	newest := newestVerified(manifests)
+	if newest >= 0 {
+		keep[newest] = true
+	}
+
+	// newest first so the whole chain of a kept increment is kept
+	index := map[string]int{}
+	for i, manifest := range manifests {
+		index[manifest.ID] = i
+	}
+	for i := len(manifests) - 1; i >= 0; i-- {
+		if parent, ok := index[manifests[i].Parent]; ok && keep[i] {
+			keep[parent] = true
+		}
+	}
+
+	if p.MaxTotalSize > 0 {
+		p.keepMaxTotalSize(manifests, keep, index, newest)
+	}
+
+	var prune []*BackupManifest
+	for i, manifest := range manifests {
+		if !keep[i] {
+			prune = append(prune, manifest)
+		}
+	}
+	return prune
+}
+
+// keepMaxTotalSize drops whole chains of kept backups, oldest first, until
+// they fit in MaxTotalSize. The chain of the newest verified backup is kept
+func (p RetentionPolicy) keepMaxTotalSize(manifests []*BackupManifest, keep []bool, index map[string]int, newest int) {
+	chained := make([]bool, len(manifests))
+	for i := newest; i >= 0; {
+		chained[i] = true
+		parent, ok := index[manifests[i].Parent]
+		if !ok {
+			break
+		}
+		i = parent
+	}
+
+	var total int64
+	for i, manifest := range manifests {
+		if keep[i] {
+			total += manifest.Size
+		}
+	}
+	for i := 0; i < len(manifests) && total > p.MaxTotalSize; i++ {
+		if !keep[i] || chained[i] {
+			continue
+		}
+		// the increments built on a dropped backup go with it, they are newer
+		dropped := map[int]bool{i: true}
+		for j := i; j < len(manifests); j++ {
+			parent, ok := index[manifests[j].Parent]
+			if j != i && !(ok && dropped[parent]) {
+				continue
+			}
+			dropped[j] = true
+			if keep[j] {
+				keep[j] = false
+				total -= manifests[j].Size
+			}
+		}
+	}
+}
+
+// keepPeriods keeps the newest backup of each of the n latest periods
+func (p RetentionPolicy) keepPeriods(manifests []*BackupManifest, keep []bool, n int, period func(time.Time) string) {
+	seen := map[string]bool{}
+	for i := len(manifests) - 1; i >= 0 && len(seen) < n; i-- {
+		key := period(manifests[i].StartTime.UTC())
+		if !seen[key] {
+			seen[key] = true
+			keep[i] = true
+		}
+	}
+}
+
+// newestVerified returns the index of the newest backup that passed
+// verification, or else of the newest complete backup not flagged as failing,
+// -1 if none
+func newestVerified(manifests []*BackupManifest) int {
+	for i := len(manifests) - 1; i >= 0; i-- {
+		if v := manifests[i].Verification; v != nil && v.OK {
+			return i
+		}
+	}
+	for i := len(manifests) - 1; i >= 0; i-- {
+		if !manifests[i].EndTime.IsZero() && manifests[i].Verification == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyRetention prunes the catalog after a successful backup
+func applyRetention(catalog *BackupCatalog, policy *RetentionPolicy) {
+	if policy == nil {
+		return
+	}
+
+	deleted, err := catalog.Prune(*policy)
+	if err != nil {
+		log.Printf("[catch me] error while prune backups in %s: %s", catalog.Root(), err.Error())
+	}
+	if len(deleted) > 0 {
+		log.Printf("Pruned %d backups: %v", len(deleted), deleted)
+	}
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultS3PartSize is the multipart upload part size of an S3Target
+const DefaultS3PartSize = 8 << 20
+
+// DefaultS3Timeout bounds each request of an S3Target, the upload of a part
+// or the download of an object, so a stalled connection fails the backup
+// upload instead of hanging it
+const DefaultS3Timeout = 5 * time.Minute
+
+const (
+	s3DateLayout = "20060102T150405Z"
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+)
+
+// S3Target stores backups in a bucket of an S3-compatible object store,
+// addressed path-style and signed with AWS Signature V4. Files larger than
+// PartSize are sent with a multipart upload that a later Put of the same key
+// resumes, skipping the parts already stored.
+type S3Target struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+
+	// PartSize defaults to DefaultS3PartSize
+	PartSize int64
+	// Client sends the requests, its Timeout bounds each of them. It defaults
+	// to http.DefaultClient
+	Client *http.Client
+}
+
+func NewS3Target(endpoint, region, bucket, prefix, accessKey, secretKey string) *S3Target {
+	return &S3Target{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		Prefix:    strings.Trim(prefix, "/"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PartSize:  DefaultS3PartSize,
+		Client:    &http.Client{Timeout: DefaultS3Timeout},
+	}
+}
+
+func (t *S3Target) String() string {
+	return fmt.Sprintf("s3://%s/%s", t.Bucket, t.Prefix)
+}
+
+func (t *S3Target) partSize() int64 {
+	if t.PartSize <= 0 {
+		return DefaultS3PartSize
+	}
+	return t.PartSize
+}
+
+func (t *S3Target) client() *http.Client {
+	if t.Client == nil {
+		return http.DefaultClient
+	}
+	return t.Client
+}
+
+func (t *S3Target) objectKey(key string) string {
+	if t.Prefix == "" {
+		return key
+	}
+	return t.Prefix + "/" + key
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (t *S3Target) Put(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() <= t.partSize() {
+		body, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		_, err = t.do(http.MethodPut, t.objectKey(key), nil, body, nil)
+		return err
+	}
+	return t.putMultipart(t.objectKey(key), f, info.Size())
+}
+
+func (t *S3Target) putMultipart(key string, f *os.File, size int64) error {
+	uploadID, stored, err := t.resumeUpload(key)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := t.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+			return err
+		}
+		uploadID = result.UploadID
+	}
+
+	var parts []s3Part
+	partSize := t.partSize()
+	buf := make([]byte, partSize)
+	for number := 1; int64(number-1)*partSize < size; number++ {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		sum := md5.Sum(buf[:n])
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if part, ok := stored[number]; ok && part.ETag == etag {
+			parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+			continue
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		header, err := t.do(http.MethodPut, key, query, buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("upload part %d: %w", number, err)
+		}
+		if header.Get("ETag") != etag {
+			return fmt.Errorf("upload part %d: etag %s, want %s", number, header.Get("ETag"), etag)
+		}
+		parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, err = t.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+	return err
+}
+
+// resumeUpload returns the newest unfinished multipart upload of key with its
+// stored parts by number, an empty uploadID when there is none
+func (t *S3Target) resumeUpload(key string) (string, map[int]s3Part, error) {
+	uploadID := ""
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		var result struct {
+			Uploads []struct {
+				Key      string `xml:"Key"`
+				UploadID string `xml:"UploadId"`
+			} `xml:"Upload"`
+			IsTruncated        bool   `xml:"IsTruncated"`
+			NextKeyMarker      string `xml:"NextKeyMarker"`
+			NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+		}
+		query := url.Values{"uploads": {""}, "prefix": {key}}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("upload-id-marker", uploadIDMarker)
+		}
+		if err := t.doXML(http.MethodGet, "", query, nil, &result); err != nil {
+			return "", nil, err
+		}
+		// uploads are listed by key then by initiation time
+		for _, upload := range result.Uploads {
+			if upload.Key == key {
+				uploadID = upload.UploadID
+			}
+		}
+		if !result.IsTruncated || result.NextKeyMarker == "" {
+			break
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+	if uploadID == "" {
+		return "", nil, nil
+	}
+
+	stored := map[int]s3Part{}
+	marker := ""
+	for {
+		var result struct {
+			Parts       []s3Part `xml:"Part"`
+			IsTruncated bool     `xml:"IsTruncated"`
+			NextMarker  string   `xml:"NextPartNumberMarker"`
+		}
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		if err := t.doXML(http.MethodGet, key, query, nil, &result); err != nil {
+			return "", nil, err
+		}
+		for _, part := range result.Parts {
+			stored[part.PartNumber] = part
+		}
+		if !result.IsTruncated || result.NextMarker == "" {
+			return uploadID, stored, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (t *S3Target) Get(key string, w io.Writer) error {
+	_, err := t.do(http.MethodGet, t.objectKey(key), nil, nil, w)
+	return err
+}
+
+func (t *S3Target) List(prefix string) ([]TargetObject, error) {
+	var objects []TargetObject
+	token := ""
+	for {
+		var result struct {
+			Contents []struct {
+				Key  string `xml:"Key"`
+				Size int64  `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated bool   `xml:"IsTruncated"`
+			NextToken   string `xml:"NextContinuationToken"`
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {t.objectKey(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		if err := t.doXML(http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			key := content.Key
+			if t.Prefix != "" {
+				key = strings.TrimPrefix(key, t.Prefix+"/")
+			}
+			objects = append(objects, TargetObject{Key: key, Size: content.Size})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (t *S3Target) Delete(key string) error {
+	_, err := t.do(http.MethodDelete, t.objectKey(key), nil, nil, nil)
+	return err
+}
+
+func (t *S3Target) doXML(method, key string, query url.Values, body []byte, result interface{}) error {
+	var buf bytes.Buffer
+	if _, err := t.do(method, key, query, body, &buf); err != nil {
+		return err
+	}
+	return xml.Unmarshal(buf.Bytes(), result)
+}
+
+// do sends a signed request for key of the bucket, the whole bucket when key
+// is empty, and copies the response body to w
+func (t *S3Target) do(method, key string, query url.Values, body []byte, w io.Writer) (http.Header, error) {
+	escaped := "/" + s3Escape(t.Bucket, false)
+	if key != "" {
+		escaped += "/" + s3Escape(key, true)
+	}
+	req, err := http.NewRequest(method, t.Endpoint+escaped, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = s3CanonicalQuery(query)
+	t.sign(req, body, time.Now().UTC())
+
+	resp, err := t.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" && query == nil {
+		return nil, ErrTargetNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		var s3Err s3Error
+		data, _ := io.ReadAll(resp.Body)
+		if xml.Unmarshal(data, &s3Err) != nil {
+			s3Err.Message = string(data)
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, escaped, resp.Status, s3Err.Code, s3Err.Message)
+	}
+	if w != nil {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+// sign adds the AWS Signature V4 headers to req
+func (t *S3Target) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	date := now.Format(s3DateLayout)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + date,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date[:8], t.Region, "s3", "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{s3Algorithm, date, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := []byte("AWS4" + t.SecretKey)
+	for _, part := range []string{date[:8], t.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, t.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query sorted by key as Signature V4 expects
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes every byte but the unreserved characters, and the
+// slashes when keepSlash is set
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"leveldblab/config"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// BackupSchedule decides when an engine takes its backups. Backups requested
+// with TriggerBackup run whatever the schedule.
+type BackupSchedule struct {
+	// Interval between the end of a backup cycle and the next backup
+	Interval time.Duration
+	// Cron, when set, replaces Interval by a 5 field cron expression in local
+	// time, e.g. "*/15 * * * *", or @hourly, @daily, @weekly, @monthly
+	Cron string
+	// Jitter delays each scheduled backup by a random duration up to Jitter
+	Jitter time.Duration
+	// MinWrites skips a scheduled backup until that many writes happened
+	// since the previous one
+	MinWrites int64
+	// Manual disables scheduled backups, only TriggerBackup starts one
+	Manual bool
+}
+
+// defaultSchedule is the schedule of the config package
+func defaultSchedule() BackupSchedule {
+	return BackupSchedule{
+		Interval:  config.BackupInterval,
+		Cron:      config.BackupCron,
+		Jitter:    config.BackupJitter,
+		MinWrites: config.BackupMinWrites,
+	}
+}
+
+// scheduler waits for the next backup of an engine
+type scheduler struct {
+	schedule BackupSchedule
+	cron     *cronExpr
+
+	writes  int64
+	trigger chan struct{}
+}
+
+func newScheduler(schedule BackupSchedule) (*scheduler, error) {
+	s := &scheduler{
+		schedule: schedule,
+		trigger:  make(chan struct{}, 1),
+	}
+	if schedule.Cron != "" {
+		cron, err := parseCron(schedule.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s.cron = cron
+	}
+	return s, nil
+}
+
+// next returns when the scheduled backup after now is due, zero if none
+func (s *scheduler) next(now time.Time) time.Time {
+	if s.schedule.Manual || !config.EnableBackup {
+		return time.Time{}
+	}
+
+	var next time.Time
+	switch {
+	case s.cron != nil:
+		if next = s.cron.next(now); next.IsZero() {
+			return next
+		}
+	case s.schedule.Interval > 0:
+		next = now.Add(s.schedule.Interval)
+	default:
+		return time.Time{}
+	}
+	if s.schedule.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.schedule.Jitter))))
+	}
+	return next
+}
+
+// wait blocks until the next backup should start and returns true, or false
+// once quit is closed
+func (s *scheduler) wait(quit <-chan struct{}) bool {
+	for {
+		if start, done := s.waitOnce(quit); done {
+			return start
+		}
+	}
+}
+
+// waitOnce waits for the next scheduled time, done is false when the backup
+// due then is skipped for lack of writes
+func (s *scheduler) waitOnce(quit <-chan struct{}) (start, done bool) {
+	var due <-chan time.Time
+	if next := s.next(time.Now()); !next.IsZero() {
+		timer := time.NewTimer(time.Until(next))
+		defer timer.Stop()
+		due = timer.C
+	}
+
+	select {
+	case <-s.trigger:
+		return true, true
+	case <-due:
+		return true, atomic.LoadInt64(&s.writes) >= s.schedule.MinWrites
+	case <-quit:
+		return false, true
+	}
+}
+
+// wrote counts a write toward MinWrites
+func (s *scheduler) wrote() {
+	atomic.AddInt64(&s.writes, 1)
+}
+
+// started resets the write count when a backup starts
+func (s *scheduler) started() {
+	atomic.StoreInt64(&s.writes, 0)
+}
+
+// triggerNow makes wait return, at once or when it is next called
+func (s *scheduler) triggerNow() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
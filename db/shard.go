@@ -0,0 +1,504 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// DefaultShards is the number of shards of a LevelDBSharded when
+// Options.Shards is zero
+const DefaultShards = 4
+
+// shardsFileName holds the shard layout, in the root folder
+const shardsFileName = "shards.json"
+
+// reshardBatchSize bounds the keys moved per write by a reshard
+const reshardBatchSize = 1000
+
+// ErrShardCount is returned when a sharded root is opened with another shard
+// count or engine than it was created with, and Options.Reshard is not set
+var ErrShardCount = errors.New("db: shard count mismatch")
+
+// shardLayout is the layout of a sharded root: the shards of a generation live
+// in gen-<generation>/shard-<i>, a reshard writes the next generation
+type shardLayout struct {
+	Shards     int    `json:"shards"`
+	Engine     string `json:"engine"`
+	Generation int    `json:"generation"`
+}
+
+func (l shardLayout) dir(root string) string {
+	return filepath.Join(root, fmt.Sprintf("gen-%d", l.Generation))
+}
+
+func shardName(i int) string {
+	return fmt.Sprintf("shard-%03d", i)
+}
+
+// backupShard is a shard engine taking backups
+type backupShard interface {
+	Store
+	Backup(ctx context.Context) (*BackupManifest, error)
+	WaitState(ctx context.Context, states ...EngineState) (EngineState, error)
+}
+
+// LevelDBSharded hashes keys across independent shards, each a LevelDBManager
+// or a LevelDBNormal. Its backup cycle backs the shards up one after the
+// other, each merged back before the next starts, so a single shard at a time
+// has writes going to its tempDB. A Write is atomic per shard only
+type LevelDBSharded struct {
+	root   string
+	layout shardLayout
+	shards []Store
+
+	schedule *scheduler
+	// cycleMu runs one backup cycle at a time
+	cycleMu sync.Mutex
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewLevelDBSharded opens the sharded root, creating Options.Shards shards of
+// Options.ShardEngine. A root created with another layout fails with
+// ErrShardCount, or is resharded with Options.Reshard
+func NewLevelDBSharded(root string, o *Options) (*LevelDBSharded, error) {
+	log.Printf("Create sharded DB at path: %s", root)
+	want := shardLayout{Shards: o.GetShards(), Engine: o.GetShardEngine(), Generation: 1}
+	if want.Engine != EngineMainTemp && want.Engine != EngineNormal {
+		return nil, fmt.Errorf("engine %q can't be sharded", want.Engine)
+	}
+	schedule, err := newScheduler(o.GetSchedule())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	layout, err := readShardLayout(root)
+	switch {
+	case os.IsNotExist(err):
+		layout = want
+		if err := saveShardLayout(root, layout); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case layout.Shards != want.Shards || layout.Engine != want.Engine:
+		if !o.GetReshard() {
+			return nil, fmt.Errorf("%w: %s holds %d %s shards, not %d %s", ErrShardCount, root, layout.Shards, layout.Engine, want.Shards, want.Engine)
+		}
+		want.Generation = layout.Generation + 1
+		if err := reshard(root, layout, want, o); err != nil {
+			return nil, err
+		}
+		layout = want
+	}
+	removeStaleGenerations(root, layout)
+
+	shards, err := openShards(root, layout, o)
+	if err != nil {
+		return nil, err
+	}
+	s := &LevelDBSharded{
+		root:     root,
+		layout:   layout,
+		shards:   shards,
+		schedule: schedule,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.backupLoop()
+	return s, nil
+}
+
+// openShards opens the shards of layout. Their backups are left to the cycle
+// of the sharded engine, each into its own folder of the backup root
+func openShards(root string, layout shardLayout, o *Options) ([]Store, error) {
+	shards := make([]Store, 0, layout.Shards)
+	for i := 0; i < layout.Shards; i++ {
+		path := filepath.Join(layout.dir(root), shardName(i))
+		var shard Store
+		var err error
+		if layout.Engine == EngineNormal {
+			shard, err = NewLevelDBNormal(path)
+		} else {
+			so := Options{}
+			if o != nil {
+				so = *o
+			}
+			so.Schedule = &BackupSchedule{Manual: true}
+			so.BackupRoot = filepath.Join(o.GetBackupRoot(), fmt.Sprintf("gen-%d", layout.Generation), shardName(i))
+			shard, err = NewDBWithOptions(path, &so)
+		}
+		if err != nil {
+			for _, opened := range shards {
+				opened.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// reshard moves every key of the shards of from into the shards of to, then
+// switches the root to to. A crash before the switch leaves from in use and
+// the partial generation is removed at the next open
+func reshard(root string, from, to shardLayout, o *Options) error {
+	log.Printf("Reshard %s from %d %s shards to %d %s shards", root, from.Shards, from.Engine, to.Shards, to.Engine)
+	if err := os.RemoveAll(to.dir(root)); err != nil {
+		return err
+	}
+	src, err := openShards(root, from, o)
+	if err != nil {
+		return err
+	}
+	dst, err := openShards(root, to, o)
+	if err != nil {
+		closeShards(src)
+		return err
+	}
+	moved, err := moveShards(src, dst)
+	srcErr := closeShards(src)
+	dstErr := closeShards(dst)
+	switch {
+	case err != nil:
+	case srcErr != nil:
+		err = srcErr
+	case dstErr != nil:
+		err = dstErr
+	}
+	if err != nil {
+		log.Printf("[catch me] error while reshard %s: %s", root, err.Error())
+		return err
+	}
+
+	if err := saveShardLayout(root, to); err != nil {
+		return err
+	}
+	log.Printf("Reshard %s done, %d keys moved", root, moved)
+	return os.RemoveAll(from.dir(root))
+}
+
+// moveShards writes every key of src into the shard of dst it hashes to
+func moveShards(src, dst []Store) (int, error) {
+	iter := newShardIterator(src, nil)
+	defer iter.Release()
+
+	moved := 0
+	batches := make([]*leveldb.Batch, len(dst))
+	flush := func(i int) error {
+		if batches[i] == nil || batches[i].Len() == 0 {
+			return nil
+		}
+		err := dst[i].Write(batches[i])
+		batches[i].Reset()
+		return err
+	}
+	for iter.Next() {
+		i := shardIndex(iter.Key(), len(dst))
+		if batches[i] == nil {
+			batches[i] = &leveldb.Batch{}
+		}
+		batches[i].Put(iter.Key(), iter.Value())
+		moved++
+		if batches[i].Len() >= reshardBatchSize {
+			if err := flush(i); err != nil {
+				return moved, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return moved, err
+	}
+	for i := range batches {
+		if err := flush(i); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+func closeShards(shards []Store) error {
+	var err error
+	for _, shard := range shards {
+		if closeErr := shard.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// removeStaleGenerations removes the generations left by a reshard, done or
+// interrupted
+func removeStaleGenerations(root string, layout shardLayout) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	current := filepath.Base(layout.dir(root))
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "gen-") && entry.Name() != current {
+			log.Printf("Remove stale shard generation %s", entry.Name())
+			if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+				log.Printf("[catch me] error while remove shard generation %s: %s", entry.Name(), err.Error())
+			}
+		}
+	}
+}
+
+func readShardLayout(root string) (shardLayout, error) {
+	var layout shardLayout
+	data, err := os.ReadFile(filepath.Join(root, shardsFileName))
+	if err != nil {
+		return layout, err
+	}
+	err = json.Unmarshal(data, &layout)
+	return layout, err
+}
+
+// saveShardLayout replaces the layout of root, the switch to a resharded
+// generation
+func saveShardLayout(root string, layout shardLayout) error {
+	data, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(root, shardsFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(root)
+}
+
+// shardIndex returns the shard of key among n
+func shardIndex(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+func (s *LevelDBSharded) shard(key string) Store {
+	return s.shards[shardIndex([]byte(key), len(s.shards))]
+}
+
+// backupLoop runs the scheduled backup cycles until Close
+func (s *LevelDBSharded) backupLoop() {
+	defer close(s.done)
+	if s.layout.Engine != EngineMainTemp {
+		return
+	}
+	ctx, cancel := quitContext(s.quit, 0)
+	defer cancel()
+	for s.schedule.wait(s.quit) {
+		if _, err := s.backupCycle(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("[catch me] error while backup shards %s: %s", s.root, err.Error())
+		}
+	}
+}
+
+// backupCycle backs up the shards one after the other, a shard is merged back
+// before the next one starts. It stops at the first error
+func (s *LevelDBSharded) backupCycle(ctx context.Context) ([]*BackupManifest, error) {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+	s.schedule.started()
+
+	var manifests []*BackupManifest
+	for i, shard := range s.shards {
+		shard, ok := shard.(backupShard)
+		if !ok {
+			continue
+		}
+		manifest, err := shard.Backup(ctx)
+		if err != nil {
+			return manifests, fmt.Errorf("%s: %w", shardName(i), err)
+		}
+		manifests = append(manifests, manifest)
+		// a degraded shard writes to mainDB, it retries its merge on its own
+		state, err := shard.WaitState(ctx, StateNormal, StateDegraded)
+		if err != nil {
+			return manifests, fmt.Errorf("%s: %w", shardName(i), err)
+		}
+		if state == StateDegraded {
+			log.Printf("[catch me] %s of %s degraded after backup", shardName(i), s.root)
+		}
+	}
+	return manifests, nil
+}
+
+// TriggerBackup starts a backup cycle now, or after the running one
+func (s *LevelDBSharded) TriggerBackup() {
+	s.schedule.triggerNow()
+}
+
+// Backup runs a backup cycle and returns the manifest of each shard backed
+// up, nil for an incremental backup finding no change. Once ctx is done the
+// running shard backup is cancelled and the cycle stops
+func (s *LevelDBSharded) Backup(ctx context.Context) ([]*BackupManifest, error) {
+	select {
+	case <-s.quit:
+		return nil, leveldb.ErrClosed
+	default:
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s.backupCycle(ctx)
+}
+
+// SetBackupRate and SetMergeRate limit the I/O of the backups and merges of
+// each shard
+func (s *LevelDBSharded) SetBackupRate(limit RateLimit) {
+	for _, shard := range s.shards {
+		if shard, ok := shard.(*LevelDBManager); ok {
+			shard.SetBackupRate(limit)
+		}
+	}
+}
+
+func (s *LevelDBSharded) SetMergeRate(limit RateLimit) {
+	for _, shard := range s.shards {
+		if shard, ok := shard.(*LevelDBManager); ok {
+			shard.SetMergeRate(limit)
+		}
+	}
+}
+
+func (s *LevelDBSharded) Get(key string) ([]byte, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *LevelDBSharded) Put(key string, value []byte) error {
+	s.schedule.wrote()
+	return s.shard(key).Put(key, value)
+}
+
+func (s *LevelDBSharded) Delete(key string) error {
+	s.schedule.wrote()
+	return s.shard(key).Delete(key)
+}
+
+func (s *LevelDBSharded) Has(key string) (bool, error) {
+	return s.shard(key).Has(key)
+}
+
+// Write splits batch by shard, each part is applied atomically to its shard
+// but a failure leaves the parts already written in place
+func (s *LevelDBSharded) Write(batch *leveldb.Batch) error {
+	s.schedule.wrote()
+	r := shardBatchReplay{batches: make([]*leveldb.Batch, len(s.shards))}
+	if err := batch.Replay(r); err != nil {
+		return err
+	}
+	for i, part := range r.batches {
+		if part == nil {
+			continue
+		}
+		if err := s.shards[i].Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type shardBatchReplay struct {
+	batches []*leveldb.Batch
+}
+
+func (r shardBatchReplay) batch(key []byte) *leveldb.Batch {
+	i := shardIndex(key, len(r.batches))
+	if r.batches[i] == nil {
+		r.batches[i] = &leveldb.Batch{}
+	}
+	return r.batches[i]
+}
+
+func (r shardBatchReplay) Put(key, value []byte) {
+	r.batch(key).Put(key, value)
+}
+
+func (r shardBatchReplay) Delete(key []byte) {
+	r.batch(key).Delete(key)
+}
+
+// NewIterator iterates over slice across the shards in key order
+func (s *LevelDBSharded) NewIterator(slice *util.Range) iterator.Iterator {
+	return newShardIterator(s.shards, slice)
+}
+
+func newShardIterator(shards []Store, slice *util.Range) iterator.Iterator {
+	iters := make([]iterator.Iterator, len(shards))
+	for i, shard := range shards {
+		iters[i] = shard.NewIterator(slice)
+	}
+	return iterator.NewMergedIterator(iters, comparer.DefaultComparer, true)
+}
+
+// Close stops the backup cycle and closes the shards
+func (s *LevelDBSharded) Close() error {
+	select {
+	case <-s.quit:
+		return leveldb.ErrClosed
+	default:
+	}
+	close(s.quit)
+	<-s.done
+	// a Backup call may still be cancelling its shard backup
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+	return closeShards(s.shards)
+}
+
+// Stats sums up the shards, their DBs are keyed by shard and role, e.g.
+// shard-000/main. State is the state of the shard out of normal, if any
+func (s *LevelDBSharded) Stats() (*Stats, error) {
+	stats := &Stats{
+		Engine: EngineSharded,
+		Path:   s.root,
+		DBs:    map[string]*leveldb.DBStats{},
+	}
+	for i, shard := range s.shards {
+		shardStats, err := shard.Stats()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 || shardStats.State.State != StateNormal {
+			stats.State = shardStats.State
+		}
+		if shardStats.OnBackup {
+			stats.OnBackup = true
+			stats.Backup = shardStats.Backup
+		}
+		stats.ReadWaits = stats.ReadWaits.add(shardStats.ReadWaits)
+		stats.GroupCommits.Groups += shardStats.GroupCommits.Groups
+		stats.GroupCommits.Ops += shardStats.GroupCommits.Ops
+		for role, db := range shardStats.DBs {
+			stats.DBs[shardName(i)+"/"+role] = db
+		}
+	}
+	return stats, nil
+}
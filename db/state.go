@@ -0,0 +1,291 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// EngineState is the state of a main/temp engine, it decides where writes go
+type EngineState int32
+
+const (
+	// StateNormal writes to mainDB
+	StateNormal EngineState = iota
+	// StateBackingUp writes to tempDB while mainDB is closed for a backup
+	StateBackingUp
+	// StateMerging writes to mainDB while tempDB is merged into it
+	StateMerging
+	// StateDegraded is left by a failed merge: tempDB still holds records, so
+	// writes go to mainDB as while merging until a retry succeeds. No backup
+	// runs meanwhile as mainDB lacks the records
+	StateDegraded
+	// StateClosed refuses every operation
+	StateClosed
+)
+
+var stateNames = []string{"normal", "backing-up", "merging", "degraded", "closed"}
+
+func (s EngineState) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("state(%d)", int32(s))
+	}
+	return stateNames[s]
+}
+
+// merging reports whether tempDB may hold records while writes go to mainDB
+func (s EngineState) merging() bool {
+	return s == StateMerging || s == StateDegraded
+}
+
+// stateTransitions lists the states each state can move to
+var stateTransitions = map[EngineState][]EngineState{
+	StateNormal:    {StateBackingUp, StateMerging, StateClosed},
+	StateBackingUp: {StateMerging, StateClosed},
+	StateMerging:   {StateNormal, StateDegraded, StateClosed},
+	StateDegraded:  {StateMerging, StateClosed},
+}
+
+var ErrBadTransition = errors.New("db: invalid state transition")
+
+// StateTransition is a change of state of an engine. Err is why the engine
+// went StateDegraded
+type StateTransition struct {
+	From, To EngineState
+	Time     time.Time
+	Err      error
+}
+
+// EngineStatus is the state of an engine, since when and, when degraded, why
+type EngineStatus struct {
+	State EngineState
+	Since time.Time
+	Err   error
+}
+
+// DefaultMergeRetry is the first delay before a degraded engine retries the
+// merge when StateTimeouts.MergeRetry is zero, it doubles after each failure
+// up to maxMergeRetry
+const DefaultMergeRetry = time.Second
+
+const maxMergeRetry = time.Minute
+
+// DefaultReadDrain bounds the wait of a closed backup for the readers of mainDB
+// when StateTimeouts.ReadDrain is zero
+const DefaultReadDrain = 30 * time.Second
+
+// StateTimeouts bounds the time an engine spends in a state, zero is
+// unbounded. A backup running longer than Backup is cancelled like by
+// CancelBackup, a merge running longer than Merge stops and leaves the engine
+// degraded until it is retried
+type StateTimeouts struct {
+	Backup time.Duration
+	Merge  time.Duration
+	// MergeRetry is the first delay before a failed merge is retried,
+	// DefaultMergeRetry if zero. A mainDB failing to reopen after a closed
+	// backup is retried likewise
+	MergeRetry time.Duration
+	// ReadDrain bounds the wait of a closed backup for the reads and
+	// iterators holding mainDB, DefaultReadDrain if zero. A leaked iterator
+	// fails the backup instead of stalling it
+	ReadDrain time.Duration
+}
+
+func (t StateTimeouts) readDrain() time.Duration {
+	if t.ReadDrain <= 0 {
+		return DefaultReadDrain
+	}
+	return t.ReadDrain
+}
+
+func (t StateTimeouts) mergeRetry() time.Duration {
+	if t.MergeRetry <= 0 {
+		return DefaultMergeRetry
+	}
+	return t.MergeRetry
+}
+
+func nextMergeRetry(retry time.Duration) time.Duration {
+	if retry *= 2; retry > maxMergeRetry {
+		return maxMergeRetry
+	}
+	return retry
+}
+
+// retryMerge calls merge after a delay, doubled after each failure, until it
+// succeeds. It returns false once quit is closed or merge finds the engine
+// closed
+func retryMerge(quit <-chan struct{}, retry time.Duration, merge func() error) bool {
+	for {
+		select {
+		case <-quit:
+			return false
+		case <-time.After(retry):
+		}
+		err := merge()
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, leveldb.ErrClosed) {
+			return false
+		}
+		retry = nextMergeRetry(retry)
+	}
+}
+
+// withTimeout bounds ctx by timeout, zero leaves it unbounded
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// quitContext returns a context done after timeout, zero is unbounded, or once
+// quit is closed
+func quitContext(quit <-chan struct{}, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stateMachine holds the state of an engine. Operations routed by the state
+// hold mu shared from enter to exit, transitions hold it exclusively so no
+// operation is in flight when the state changes
+type stateMachine struct {
+	mu    sync.RWMutex
+	state int32
+
+	// obsMu guards the observers of the transitions
+	obsMu       sync.Mutex
+	since       time.Time
+	lastErr     error
+	changed     chan struct{} // closed at every transition
+	subscribers map[chan StateTransition]struct{}
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		state:       int32(StateNormal),
+		since:       time.Now(),
+		changed:     make(chan struct{}),
+		subscribers: map[chan StateTransition]struct{}{},
+	}
+}
+
+// get returns the state without waiting for a transition
+func (m *stateMachine) get() EngineState {
+	return EngineState(atomic.LoadInt32(&m.state))
+}
+
+// enter returns the state and keeps it until exit
+func (m *stateMachine) enter() EngineState {
+	m.mu.RLock()
+	return m.get()
+}
+
+func (m *stateMachine) exit() {
+	m.mu.RUnlock()
+}
+
+// transition moves to state to once the operations in flight are done. err
+// records why the engine went degraded. It returns ErrBadTransition if to
+// can't follow the current state, leveldb.ErrClosed once closed
+func (m *stateMachine) transition(to EngineState, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from := m.get()
+	if from == StateClosed {
+		return leveldb.ErrClosed
+	}
+	allowed := false
+	for _, next := range stateTransitions[from] {
+		allowed = allowed || next == to
+	}
+	if !allowed {
+		return fmt.Errorf("%w from %s to %s", ErrBadTransition, from, to)
+	}
+	atomic.StoreInt32(&m.state, int32(to))
+
+	t := StateTransition{From: from, To: to, Time: time.Now(), Err: err}
+	m.obsMu.Lock()
+	m.since = t.Time
+	m.lastErr = err
+	close(m.changed)
+	m.changed = make(chan struct{})
+	for ch := range m.subscribers {
+		// a subscriber too slow to keep up misses transitions rather than
+		// blocking the engine
+		select {
+		case ch <- t:
+		default:
+		}
+		if to == StateClosed {
+			close(ch)
+			delete(m.subscribers, ch)
+		}
+	}
+	m.obsMu.Unlock()
+	return nil
+}
+
+func (m *stateMachine) status() EngineStatus {
+	m.obsMu.Lock()
+	defer m.obsMu.Unlock()
+	return EngineStatus{State: m.get(), Since: m.since, Err: m.lastErr}
+}
+
+// wait returns once the state is one of states, or with the error of ctx
+func (m *stateMachine) wait(ctx context.Context, states ...EngineState) (EngineState, error) {
+	for {
+		m.obsMu.Lock()
+		changed := m.changed
+		state := m.get()
+		m.obsMu.Unlock()
+		for _, s := range states {
+			if s == state {
+				return state, nil
+			}
+		}
+		if state == StateClosed {
+			return state, leveldb.ErrClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return state, ctx.Err()
+		}
+	}
+}
+
+// subscribe returns a channel receiving the next transitions, up to buffer of
+// them while the reader lags behind, and a func to stop receiving them. The
+// channel is closed after the transition to StateClosed
+func (m *stateMachine) subscribe(buffer int) (<-chan StateTransition, func()) {
+	ch := make(chan StateTransition, buffer)
+	m.obsMu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.obsMu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			m.obsMu.Lock()
+			delete(m.subscribers, ch)
+			m.obsMu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Engine names accepted by NewStore
+const (
+	EngineNormal     = "normal"     // LevelDBNormal: a single LevelDB
+	EngineMainTemp   = "maintemp"   // LevelDBManager: main/temp backup through the message loop
+	EngineRepo       = "repo"       // DBRepo: main/temp backup guarded by a mutex
+	EngineLiveBackup = "livebackup" // LevelDBManagerAddBackup: live DB plus a separate backup DB
+	EngineSharded    = "sharded"    // LevelDBSharded: keys hashed across shards of another engine
+)
+
+// Store is the common interface implemented by every engine in this package
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Has(key string) (bool, error)
+	NewIterator(slice *util.Range) iterator.Iterator
+	Write(batch *leveldb.Batch) error
+	Close() error
+	Stats() (*Stats, error)
+}
+
+// Stats describes an engine and the LevelDB instances behind it
+type Stats struct {
+	Engine string
+	Path   string
+
+	// OnBackup is true while writes are redirected away from the main DB
+	OnBackup bool
+	// State is the state of the main/temp engines, zero for the others
+	State EngineStatus
+	// Backup is the progress of the running backup, nil if there is none
+	Backup *BackupProgress
+	// ReadWaits counts the reads of the main/temp engines that waited for a
+	// backup to reopen mainDB
+	ReadWaits ReadWaitStats
+	// GroupCommits counts the writes of the Put and Delete calls of the
+	// LevelDBManager, see GroupCommit
+	GroupCommits GroupCommitStats
+
+	// DBs holds goleveldb statistics keyed by role (main, temp, live, backup),
+	// prefixed by the shard for the LevelDBSharded
+	DBs map[string]*leveldb.DBStats
+}
+
+var (
+	_ Store = (*LevelDBNormal)(nil)
+	_ Store = (*LevelDBManager)(nil)
+	_ Store = (*LevelDBManagerAddBackup)(nil)
+	_ Store = (*DBRepo)(nil)
+	_ Store = (*LevelDBSharded)(nil)
+)
+
+// NewStore opens the engine named by engine at path
+func NewStore(engine, path string) (Store, error) {
+	return NewStoreWithOptions(engine, path, nil)
+}
+
+// NewStoreWithOptions opens the engine named by engine at path, o applies to
+// the main/temp engines
+func NewStoreWithOptions(engine, path string, o *Options) (Store, error) {
+	switch engine {
+	case EngineNormal:
+		return NewLevelDBNormal(path)
+	case EngineMainTemp:
+		return NewDBWithOptions(path, o)
+	case EngineRepo:
+		return NewDBRepositoryWithOptions(path, "main", o), nil
+	case EngineLiveBackup:
+		return NewLevelDBManagerAddBackupWithOptions(path, false, o)
+	case EngineSharded:
+		return NewLevelDBSharded(path, o)
+	}
+
+	return nil, fmt.Errorf("unknown engine %q", engine)
+}
+
+func (dw *levelDBWrapper) stats() (*leveldb.DBStats, error) {
+	s := &leveldb.DBStats{}
+	if err := dw.view(func(db *leveldb.DB) error { return db.Stats(s) }); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
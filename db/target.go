@@ -0,0 +1,354 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupTarget stores backups away from the catalog, on a second mount or in
+// an object store. Keys are slash separated, a backup is stored as
+// <id>/data/<file> objects and then <id>/manifest.json, so a backup is only
+// listed once every file is stored.
+type BackupTarget interface {
+	// Put stores the local file at path as key. An interrupted Put of the same
+	// file resumes where it stopped
+	Put(key, path string) error
+	// Get writes object key to w
+	Get(key string, w io.Writer) error
+	// List returns the objects whose key starts with prefix, sorted by key
+	List(prefix string) ([]TargetObject, error)
+	Delete(key string) error
+	String() string
+}
+
+// TargetObject is an object stored in a BackupTarget
+type TargetObject struct {
+	Key  string
+	Size int64
+}
+
+var (
+	ErrTargetNotFound = errors.New("db: object not found in backup target")
+	// ErrInvalidManifest is returned by Pull for a manifest naming backups or
+	// files outside of the catalog
+	ErrInvalidManifest = errors.New("db: invalid backup manifest in target")
+)
+
+// ParseBackupTarget returns the target of spec, an s3://bucket/prefix URL or
+// a local folder. An s3 URL takes the endpoint and region query parameters and
+// the credentials of AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func ParseBackupTarget(spec string) (BackupTarget, error) {
+	if !strings.HasPrefix(spec, "s3://") {
+		return NewLocalTarget(strings.TrimPrefix(spec, "file://"))
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		return nil, fmt.Errorf("backup target %s: endpoint is required", spec)
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return NewS3Target(endpoint, region, u.Host, strings.Trim(u.Path, "/"),
+		os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")), nil
+}
+
+// LocalTarget stores backups in a folder, meant to be on another disk than
+// the catalog
+type LocalTarget struct {
+	root string
+}
+
+func NewLocalTarget(root string) (*LocalTarget, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalTarget{root: root}, nil
+}
+
+func (t *LocalTarget) String() string {
+	return t.root
+}
+
+// partSuffix marks a file of the LocalTarget being written
+const partSuffix = ".part"
+
+// Put copies path to key.part, appending to what an interrupted Put already
+// copied, then renames it to key
+func (t *LocalTarget) Put(key, path string) error {
+	dst := filepath.Join(t.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst+partSuffix, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	done, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if done > info.Size() {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		done = 0
+	}
+	if _, err := f.Seek(done, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := src.Seek(done, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, src); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+partSuffix, dst)
+}
+
+func (t *LocalTarget) Get(key string, w io.Writer) error {
+	f, err := os.Open(filepath.Join(t.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return ErrTargetNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (t *LocalTarget) List(prefix string) ([]TargetObject, error) {
+	var objects []TargetObject
+	err := filepath.Walk(t.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, partSuffix) {
+			return err
+		}
+		rel, err := filepath.Rel(t.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			objects = append(objects, TargetObject{Key: key, Size: info.Size()})
+		}
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+func (t *LocalTarget) Delete(key string) error {
+	err := os.Remove(filepath.Join(t.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// SetTargets makes the engines upload every backup they take to targets
+func (c *BackupCatalog) SetTargets(targets []BackupTarget) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.targets = targets
+}
+
+// replicate uploads backup id to every target of the catalog, a failed upload
+// is logged and can be resumed with Push
+func (c *BackupCatalog) replicate(id string) {
+	c.mu.Lock()
+	targets := c.targets
+	c.mu.Unlock()
+
+	for _, target := range targets {
+		if err := c.Push(target, id); err != nil {
+			log.Printf("[catch me] error while upload backup %s to %s: %s", id, target, err.Error())
+			continue
+		}
+		log.Printf("Uploaded backup %s to %s", id, target)
+	}
+}
+
+// Push uploads backup id to target. Files already stored with the same size
+// are skipped so an interrupted Push resumes, the manifest goes last.
+func (c *BackupCatalog) Push(target BackupTarget, id string) error {
+	manifest, err := c.Get(id)
+	if err != nil {
+		return err
+	}
+	stored, err := target.List(id + "/")
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{}
+	for _, object := range stored {
+		sizes[object.Key] = object.Size
+	}
+
+	for _, file := range manifest.Files {
+		key := path.Join(id, backupDataDir, file.Path)
+		if size, ok := sizes[key]; ok && size == file.Size {
+			continue
+		}
+		if err := target.Put(key, filepath.Join(c.DataPath(id), filepath.FromSlash(file.Path))); err != nil {
+			return fmt.Errorf("upload %s: %w", key, err)
+		}
+	}
+	return target.Put(path.Join(id, manifestFileName), filepath.Join(c.root, id, manifestFileName))
+}
+
+// Pull downloads backup id from target into the catalog, with the backups it
+// is built on when it is incremental
+func (c *BackupCatalog) Pull(target BackupTarget, id string) error {
+	for id != "" {
+		if !validBackupID(id) {
+			return fmt.Errorf("%w: backup id %q", ErrInvalidManifest, id)
+		}
+		if _, err := c.Get(id); err == nil {
+			return nil
+		}
+
+		manifest, err := targetManifest(target, id)
+		if err != nil {
+			return err
+		}
+		if err := checkManifest(manifest, id); err != nil {
+			return err
+		}
+		folder := filepath.Join(c.root, id)
+		for _, file := range manifest.Files {
+			dst := filepath.Join(folder, backupDataDir, filepath.FromSlash(file.Path))
+			if err := getFile(target, path.Join(id, backupDataDir, file.Path), dst); err != nil {
+				os.RemoveAll(folder)
+				return err
+			}
+		}
+		if err := c.verifyFiles(manifest); err != nil {
+			os.RemoveAll(folder)
+			return err
+		}
+		// the manifest last, as in a local backup
+		if err := getFile(target, path.Join(id, manifestFileName), filepath.Join(folder, manifestFileName)); err != nil {
+			os.RemoveAll(folder)
+			return err
+		}
+		log.Printf("Downloaded backup %s from %s", id, target)
+		id = manifest.Parent
+	}
+	return nil
+}
+
+// validBackupID reports whether id is named like the backups of a catalog
+func validBackupID(id string) bool {
+	_, err := time.Parse(backupIDLayout, id)
+	return err == nil
+}
+
+// checkManifest checks that the manifest of backup id, read from a target,
+// only names backups and files inside the catalog
+func checkManifest(manifest *BackupManifest, id string) error {
+	if manifest.ID != id {
+		return fmt.Errorf("%w: backup %s has id %q", ErrInvalidManifest, id, manifest.ID)
+	}
+	if manifest.Parent != "" && !validBackupID(manifest.Parent) {
+		return fmt.Errorf("%w: backup %s has parent %q", ErrInvalidManifest, id, manifest.Parent)
+	}
+	for _, file := range manifest.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Path)) {
+			return fmt.Errorf("%w: backup %s has file %q", ErrInvalidManifest, id, file.Path)
+		}
+	}
+	return nil
+}
+
+// ListTarget returns the manifest of every backup stored in target, oldest
+// first
+func ListTarget(target BackupTarget) ([]*BackupManifest, error) {
+	objects, err := target.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*BackupManifest
+	for _, object := range objects {
+		id, name := path.Split(object.Key)
+		if name != manifestFileName || strings.Count(id, "/") != 1 {
+			continue
+		}
+		manifest, err := targetManifest(target, strings.TrimSuffix(id, "/"))
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].ID < manifests[j].ID })
+	return manifests, nil
+}
+
+func targetManifest(target BackupTarget, id string) (*BackupManifest, error) {
+	var buf bytes.Buffer
+	if err := target.Get(path.Join(id, manifestFileName), &buf); err != nil {
+		if errors.Is(err, ErrTargetNotFound) {
+			return nil, ErrBackupNotFound
+		}
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(buf.Bytes(), manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func getFile(target BackupTarget, key, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := target.Get(key, f); err != nil {
+		f.Close()
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimit bounds the disk I/O of a backup or a merge so foreground reads
+// and writes keep their latency. An operation is one key or change record
+// written, or one read of up to 32KiB when files are copied. Zero is
+// unlimited
+type RateLimit struct {
+	BytesPerSec int64
+	OpsPerSec   int64
+}
+
+func (l RateLimit) unlimited() bool {
+	return l.BytesPerSec <= 0 && l.OpsPerSec <= 0
+}
+
+// throttle is a token bucket per limit holding up to one second of tokens. A
+// caller takes its tokens up front and sleeps off the debt, so a large read
+// is slowed down as a whole instead of being refused
+type throttle struct {
+	mu    sync.Mutex
+	limit RateLimit
+	bytes float64
+	ops   float64
+	last  time.Time
+	// changed is closed when the limit changes, waking up the sleepers
+	changed chan struct{}
+}
+
+func newThrottle(limit RateLimit) *throttle {
+	t := &throttle{changed: make(chan struct{})}
+	t.set(limit)
+	return t
+}
+
+// set changes the limit at once, callers sleeping on the old limit resume
+func (t *throttle) set(limit RateLimit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limit = limit
+	t.bytes = float64(limit.BytesPerSec)
+	t.ops = float64(limit.OpsPerSec)
+	t.last = time.Now()
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *throttle) get() RateLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit
+}
+
+// wait takes one operation of n bytes and sleeps until the limit allows it.
+// It returns early with the error of ctx once ctx is done. A nil throttle
+// only checks ctx
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t == nil {
+		return ctx.Err()
+	}
+
+	t.mu.Lock()
+	delay := t.reserve(n)
+	changed := t.changed
+	t.mu.Unlock()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-changed:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes the tokens of one operation of n bytes and returns how long
+// the caller owes, t.mu must be held
+func (t *throttle) reserve(n int) time.Duration {
+	if t.limit.unlimited() {
+		return 0
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(t.last).Seconds()
+	t.last = now
+
+	var delay time.Duration
+	take := func(tokens *float64, rate int64, n float64) {
+		if rate <= 0 {
+			return
+		}
+		*tokens += elapsed * float64(rate)
+		if *tokens > float64(rate) {
+			*tokens = float64(rate)
+		}
+		*tokens -= n
+		if *tokens < 0 {
+			if d := time.Duration(-*tokens / float64(rate) * float64(time.Second)); d > delay {
+				delay = d
+			}
+		}
+	}
+	take(&t.bytes, t.limit.BytesPerSec, float64(n))
+	take(&t.ops, t.limit.OpsPerSec, 1)
+	return delay
+}
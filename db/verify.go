@@ -0,0 +1,263 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// verifyFileName holds the last VerifyResult of a backup, next to its manifest
+const verifyFileName = "verify.json"
+
+// diffSamples bounds the keys listed by a BackupDiff
+const diffSamples = 10
+
+// LiveReader is the live DB a backup is diffed against, a *leveldb.DB or a
+// *leveldb.Snapshot
+type LiveReader interface {
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// VerifyOptions configures BackupCatalog.Verify
+type VerifyOptions struct {
+	// Live, when set, is diffed key by key against the backup. It should hold
+	// the mainDB state the backup was taken from
+	Live LiveReader
+}
+
+// VerifyResult is the outcome of verifying a backup
+type VerifyResult struct {
+	ID       string      `json:"id"`
+	Time     time.Time   `json:"time"`
+	OK       bool        `json:"ok"`
+	KeyCount int64       `json:"key_count"`
+	Errors   []string    `json:"errors,omitempty"`
+	Diff     *BackupDiff `json:"diff,omitempty"`
+}
+
+// BackupDiff counts the keys that differ between a backup and the live DB
+type BackupDiff struct {
+	// Missing keys are in the live DB only, Extra keys in the backup only
+	Missing int64    `json:"missing"`
+	Extra   int64    `json:"extra"`
+	Changed int64    `json:"changed"`
+	Samples []string `json:"samples,omitempty"`
+}
+
+func (d *BackupDiff) empty() bool {
+	return d.Missing == 0 && d.Extra == 0 && d.Changed == 0
+}
+
+func (d *BackupDiff) sample(kind string, key []byte) {
+	if len(d.Samples) < diffSamples {
+		d.Samples = append(d.Samples, fmt.Sprintf("%s %q", kind, key))
+	}
+}
+
+// Verify checks backup id: its files against the manifest checksums, then its
+// data read back in full with strict checksums, its key count against the
+// manifest and, with o.Live, its content against the live DB. The result is
+// saved next to the manifest, a failing backup is flagged by OK false. The
+// error is only set when the backup can't be checked at all.
+func (c *BackupCatalog) Verify(id string, o VerifyOptions) (*VerifyResult, error) {
+	manifest, err := c.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &VerifyResult{ID: id, Time: time.Now()}
+	if err := c.verifyFiles(manifest); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	var diff *differ
+	if o.Live != nil && manifest.Mode != BackupIncremental {
+		iter := o.Live.NewIterator(nil, nil)
+		defer iter.Release()
+		diff = &differ{live: iter, valid: iter.First()}
+	}
+	if err := c.verifyData(manifest, result, diff); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	if diff != nil {
+		diff.finish()
+		result.Diff = &diff.BackupDiff
+		if !diff.empty() {
+			result.Errors = append(result.Errors, fmt.Sprintf("%d missing, %d extra and %d changed keys against the live DB",
+				diff.Missing, diff.Extra, diff.Changed))
+		}
+	}
+	result.OK = len(result.Errors) == 0
+
+	if err := c.writeVerifyResult(result); err != nil {
+		return result, err
+	}
+	if !result.OK {
+		log.Printf("[catch me] backup %s failed verification: %v", id, result.Errors)
+	}
+	return result, nil
+}
+
+// verifyData reads every key of the backup in order
+func (c *BackupCatalog) verifyData(manifest *BackupManifest, result *VerifyResult, diff *differ) error {
+	return c.withData(manifest, func(dataPath string) error {
+		return verifyData(dataPath, manifest, result, diff)
+	})
+}
+
+func verifyData(dataPath string, manifest *BackupManifest, result *VerifyResult, diff *differ) error {
+	switch manifest.Mode {
+	case BackupIncremental:
+		return verifyChanges(filepath.Join(dataPath, changesFileName), manifest, result)
+	case BackupDump:
+		var last []byte
+		err := readDump(filepath.Join(dataPath, dumpFileName), func(key, value []byte) error {
+			if last != nil && bytes.Compare(key, last) <= 0 {
+				return fmt.Errorf("dump key %q out of order", key)
+			}
+			last = key
+			result.KeyCount++
+			diff.visit(key, value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		backupDB, err := leveldb.OpenFile(dataPath, &opt.Options{
+			ReadOnly:       true,
+			ErrorIfMissing: true,
+			Strict:         opt.StrictAll,
+		})
+		if err != nil {
+			return err
+		}
+		defer backupDB.Close()
+
+		iter := backupDB.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			result.KeyCount++
+			diff.visit(iter.Key(), iter.Value())
+		}
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	if result.KeyCount != manifest.KeyCount {
+		return fmt.Errorf("%d keys, manifest has %d", result.KeyCount, manifest.KeyCount)
+	}
+	return nil
+}
+
+// verifyChanges checks the change file of an incremental backup holds every
+// change of the manifest in sequence
+func verifyChanges(path string, manifest *BackupManifest, result *VerifyResult) error {
+	next := manifest.FromSeq
+	var count int64
+	err := readChangeFile(path, func(c *change, end int64) error {
+		if c.seq != next {
+			return fmt.Errorf("change %d out of sequence, want %d", c.seq, next)
+		}
+		next++
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count != manifest.Changes || next != manifest.Seq+1 {
+		return fmt.Errorf("%d changes up to %d, manifest has %d up to %d", count, next-1, manifest.Changes, manifest.Seq)
+	}
+	return nil
+}
+
+func (c *BackupCatalog) writeVerifyResult(result *VerifyResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	folder := filepath.Join(c.root, result.ID)
+	tmp := filepath.Join(folder, verifyFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(folder, verifyFileName))
+}
+
+// VerifyResult returns the last verification of backup id, nil if it was
+// never verified
+func (c *BackupCatalog) VerifyResult(id string) (*VerifyResult, error) {
+	data, err := os.ReadFile(filepath.Join(c.root, id, verifyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &VerifyResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// differ walks the live iterator along the sorted keys of a backup
+type differ struct {
+	BackupDiff
+	live  iterator.Iterator
+	valid bool
+}
+
+func (d *differ) visit(key, value []byte) {
+	if d == nil {
+		return
+	}
+	for d.valid && bytes.Compare(d.live.Key(), key) < 0 {
+		d.Missing++
+		d.sample("missing", d.live.Key())
+		d.valid = d.live.Next()
+	}
+	if !d.valid || !bytes.Equal(d.live.Key(), key) {
+		d.Extra++
+		d.sample("extra", key)
+		return
+	}
+	if !bytes.Equal(d.live.Value(), value) {
+		d.Changed++
+		d.sample("changed", key)
+	}
+	d.valid = d.live.Next()
+}
+
+func (d *differ) finish() {
+	for d.valid {
+		d.Missing++
+		d.sample("missing", d.live.Key())
+		d.valid = d.live.Next()
+	}
+}
+
+// verifyBackup verifies backup id right after an engine took it, live is nil
+// or the mainDB state the backup was taken from
+func verifyBackup(catalog *BackupCatalog, id string, live LiveReader) {
+	result, err := catalog.Verify(id, VerifyOptions{Live: live})
+	if err != nil {
+		log.Printf("[catch me] error while verify backup %s: %s", id, err.Error())
+		return
+	}
+	if result.OK {
+		log.Printf("Verified backup %s: %d keys", id, result.KeyCount)
+	}
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// versionClock hands out monotonic versions close to the wall clock in
+// nanoseconds (a hybrid logical clock), so versions keep growing across restarts
+type versionClock struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+var versions = &versionClock{}
+
+func (c *versionClock) next() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano())
+	if now <= c.last {
+		now = c.last + 1
+	}
+	c.last = now
+	return now
+}
+
+// Versioned mainDB values are wrapped in an envelope:
+// magic | flags | uvarint version | value. Values without the magic prefix are
+// raw values written before versioning was enabled and read as version 0.
+var envelopeMagic = []byte{0xff, 'l', 'v', 0x01}
+
+const envelopeTombstone byte = 1 << 0
+
+// envelope is a decoded mainDB value
+type envelope struct {
+	version   uint64
+	tombstone bool
+	value     []byte
+}
+
+func encodeEnvelope(e envelope) []byte {
+	buf := make([]byte, len(envelopeMagic)+1+binary.MaxVarintLen64+len(e.value))
+	n := copy(buf, envelopeMagic)
+	if e.tombstone {
+		buf[n] = envelopeTombstone
+	}
+	n++
+	n += binary.PutUvarint(buf[n:], e.version)
+	n += copy(buf[n:], e.value)
+	return buf[:n]
+}
+
+// decodeEnvelope decodes a mainDB value, the values of a mainDB that is not
+// versioned are raw whatever they start with
+func decodeEnvelope(buf []byte, versioned bool) envelope {
+	if !versioned || !bytes.HasPrefix(buf, envelopeMagic) || len(buf) < len(envelopeMagic)+2 {
+		return envelope{value: buf}
+	}
+
+	flags := buf[len(envelopeMagic)]
+	version, n := binary.Uvarint(buf[len(envelopeMagic)+1:])
+	if n <= 0 {
+		return envelope{value: buf}
+	}
+	return envelope{
+		version:   version,
+		tombstone: flags&envelopeTombstone != 0,
+		value:     buf[len(envelopeMagic)+1+n:],
+	}
+}
+
+// readEnvelope reads key from mainDB, it returns nil when the key is not found
+func readEnvelope(db *leveldb.DB, key []byte, versioned bool) (*envelope, error) {
+	value, err := db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := decodeEnvelope(value, versioned)
+	return &e, nil
+}
+
+// mainBatchReplay converts a batch into the mainDB value format
+type mainBatchReplay struct {
+	batch      *leveldb.Batch
+	version    uint64
+	tombstones bool // write deletes as tombstones instead of deleting
+}
+
+func (r mainBatchReplay) Put(key, value []byte) {
+	r.batch.Put(key, encodeEnvelope(envelope{version: r.version, value: value}))
+}
+
+func (r mainBatchReplay) Delete(key []byte) {
+	if r.tombstones {
+		r.batch.Put(key, encodeEnvelope(envelope{version: r.version, tombstone: true}))
+		return
+	}
+	r.batch.Delete(key)
+}
@@ -0,0 +1,71 @@
+package usecase1
+
+import (
+	"log"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// latencyRecorder keeps a histogram of operation durations, bucket i counts
+// durations in [2^(i-1), 2^i) microseconds
+type latencyRecorder struct {
+	sync.Mutex
+
+	count   int64
+	total   time.Duration
+	max     time.Duration
+	buckets [40]int64
+}
+
+func (l *latencyRecorder) record(d time.Duration) {
+	bucket := bits.Len64(uint64(d.Microseconds()))
+	if bucket >= len(l.buckets) {
+		bucket = len(l.buckets) - 1
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.count++
+	l.total += d
+	if d > l.max {
+		l.max = d
+	}
+	l.buckets[bucket]++
+}
+
+// percentile returns the upper bound of the bucket holding the p-th percentile
+func (l *latencyRecorder) percentile(p float64) time.Duration {
+	target := int64(float64(l.count) * p)
+	var seen int64
+	for i, n := range l.buckets {
+		seen += n
+		if seen > target {
+			return time.Duration(1<<uint(i)) * time.Microsecond
+		}
+	}
+	return l.max
+}
+
+func (l *latencyRecorder) report(name string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.count == 0 {
+		log.Printf("%s latency: no operation", name)
+		return
+	}
+
+	log.Printf("%s latency: count %d, avg %s, p50 < %s, p99 < %s, p99.9 < %s, max %s",
+		name, l.count, l.total/time.Duration(l.count),
+		l.percentile(0.5), l.percentile(0.99), l.percentile(0.999), l.max)
+}
+
+// throughput logs the operations per second recorded over elapsed
+func (l *latencyRecorder) throughput(name string, elapsed time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if elapsed <= 0 {
+		return
+	}
+	log.Printf("%s throughput: %.0f ops/s", name, float64(l.count)/elapsed.Seconds())
+}
@@ -9,6 +9,8 @@ import (
 	"strconv"
 	"sync"
 	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -16,7 +18,7 @@ const (
 )
 
 var (
-	myDB *db.LevelDBManager
+	myDB db.Store
 
 	rootFolder = "./data"
 )
@@ -28,7 +30,7 @@ func MainTempTesting() {
 	}
 
 	var err error
-	myDB, err = db.NewDB(rootFolder)
+	myDB, err = db.NewStore(db.EngineMainTemp, rootFolder)
 	if err != nil {
 		log.Fatalf("error while create NewDB on path %s: %s", rootFolder, err.Error())
 	}
@@ -62,19 +64,21 @@ func MainTempTesting() {
 		for i := 0; i < total; i++ {
 			currentValue++
 			newKey := fmt.Sprintf("_%d%s", index, strconv.Itoa(currentValue))
-			if err := myDB.Put(newKey, []byte(fmt.Sprintf("value of %d", currentValue))); err != nil {
-				log.Printf("error while put value: %s", err.Error())
-			}
 			newLastKey := fmt.Sprintf("%d%s", index, latestKey)
-			if err := myDB.Put(newLastKey, []byte(strconv.Itoa(currentValue))); err != nil {
-				log.Printf("error while put value: %s", err.Error())
+
+			// value key and latest key land together so a backup switch can't split them
+			batch := &leveldb.Batch{}
+			batch.Put([]byte(newKey), []byte(fmt.Sprintf("value of %d", currentValue)))
+			batch.Put([]byte(newLastKey), []byte(strconv.Itoa(currentValue)))
+			if err := myDB.Write(batch); err != nil {
+				log.Printf("error while write batch: %s", err.Error())
 			}
 		}
 	}
 	log.Printf("write %d keys done after %dms", total, time.Since(start).Milliseconds())
 }
 
-func getLatestKey(db *db.LevelDBManager, index int) int {
+func getLatestKey(db db.Store, index int) int {
 	value, err := db.Get(fmt.Sprintf("%d%s", index, latestKey))
 	if err != nil {
 		return 0
@@ -84,7 +88,7 @@ func getLatestKey(db *db.LevelDBManager, index int) int {
 	return latest
 }
 
-func checkKeysOnInit(db *db.LevelDBManager) bool {
+func checkKeysOnInit(db db.Store) bool {
 	wg := &sync.WaitGroup{}
 	for j := 0; j < 10; j++ {
 		wg.Add(1)
@@ -18,18 +18,59 @@ type message struct {
 	value string
 }
 
-func LevelDBMainTempTesting(read int, write int, duration time.Duration) {
+// throttledStore is an engine whose backup and merge I/O can be limited
+type throttledStore interface {
+	SetBackupRate(limit db.RateLimit)
+	SetMergeRate(limit db.RateLimit)
+	TriggerBackup()
+}
+
+// phase is a part of the run with its own backup and merge limits
+type phase struct {
+	name       string
+	backupRate db.RateLimit
+	mergeRate  db.RateLimit
+	duration   time.Duration
+	putLatency *latencyRecorder
+	elapsed    time.Duration
+}
+
+// LevelDBMainTempTesting writes and reads for duration. With compareThrottle
+// the first half runs without the backup and merge limits of opts and the
+// second half with them, each half starting with a backup
+func LevelDBMainTempTesting(read int, write int, duration time.Duration, opts *db.Options, compareThrottle bool) {
 
 	envRootFolder := os.Getenv("RootFolder")
 	if envRootFolder != "" {
 		rootFolder = envRootFolder + ""
 	}
-	dbFile, err := db.NewDB(path.Join(rootFolder, "usecase1"))
+	engine, dbPath := db.EngineMainTemp, path.Join(rootFolder, "usecase1")
+	if opts.Shards > 0 {
+		engine, dbPath = db.EngineSharded, path.Join(rootFolder, "usecase1-sharded")
+	}
+	dbFile, err := db.NewStoreWithOptions(engine, dbPath, opts)
 	if err != nil {
 		log.Fatalf("error while create NewDB on path %s: %s", rootFolder, err.Error())
 	}
 
-	startTime := time.Now()
+	phases := []*phase{{name: "Put", backupRate: opts.GetBackupRate(), mergeRate: opts.GetMergeRate(), duration: duration}}
+	if compareThrottle {
+		phases = []*phase{
+			{name: "Put unthrottled", duration: duration / 2},
+			{name: "Put throttled", backupRate: opts.GetBackupRate(), mergeRate: opts.GetMergeRate(), duration: duration / 2},
+		}
+	}
+	var phaseMu sync.Mutex
+	current := phases[0]
+	putLatency := func() *latencyRecorder {
+		phaseMu.Lock()
+		defer phaseMu.Unlock()
+		return current.putLatency
+	}
+	for _, p := range phases {
+		p.putLatency = &latencyRecorder{}
+	}
+
 	channelWrite := make(chan *message, 1000)
 	idx := 0
 	// write
@@ -46,6 +87,7 @@ func LevelDBMainTempTesting(read int, write int, duration time.Duration) {
 				if err != nil {
 					log.Printf("Error put key %s, err: %s\n", key, err.Error())
 				}
+				putLatency().record(time.Since(timePutStart))
 				durationPut := time.Since(timePutStart).Milliseconds()
 				if durationPut > 100 {
 					log.Printf("Put slow key %s, duration %dms\n", key, durationPut)
@@ -73,17 +115,41 @@ func LevelDBMainTempTesting(read int, write int, duration time.Duration) {
 		}()
 	}
 
-	for time.Since(startTime) < duration {
-		channelWrite <- &message{
-			key:   idx,
-			value: randStringBytes(60),
+	for _, p := range phases {
+		phaseMu.Lock()
+		current = p
+		phaseMu.Unlock()
+		if throttled, ok := dbFile.(throttledStore); ok {
+			throttled.SetBackupRate(p.backupRate)
+			throttled.SetMergeRate(p.mergeRate)
+			if compareThrottle {
+				throttled.TriggerBackup()
+			}
+		}
+		log.Printf("Start %s: backup %+v, merge %+v", p.name, p.backupRate, p.mergeRate)
+
+		startTime := time.Now()
+		for time.Since(startTime) < p.duration {
+			channelWrite <- &message{
+				key:   idx,
+				value: randStringBytes(60),
+			}
+			idx++
 		}
-		idx++
+		p.elapsed = time.Since(startTime)
 	}
 	close(channelWrite)
 	wg.Wait()
 	log.Printf("Key write number: %d\n", idx)
 	log.Printf("Key read number: %d\n", count)
+	for _, p := range phases {
+		p.putLatency.report(p.name)
+		p.putLatency.throughput(p.name, p.elapsed)
+	}
+	if stats, err := dbFile.Stats(); err == nil && stats.GroupCommits.Groups > 0 {
+		groups := stats.GroupCommits
+		log.Printf("Group commit: %d Put/Delete in %d writes, %.1f per write", groups.Ops, groups.Groups, float64(groups.Ops)/float64(groups.Groups))
+	}
 }
 
 func randStringBytes(n int) string {
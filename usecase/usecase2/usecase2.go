@@ -28,7 +28,7 @@ func LevelDBMainBackup(read int, write int, duration time.Duration) {
 	if envRootFolder != "" {
 		rootFolder = envRootFolder + ""
 	}
-	dbFile, err := db.NewLevelDBManagerAddBackup(path.Join(rootFolder, "usecase2"), false)
+	dbFile, err := db.NewStore(db.EngineLiveBackup, path.Join(rootFolder, "usecase2"))
 	if err != nil {
 		log.Fatalf("error while create NewDB on path %s: %s", rootFolder, err.Error())
 	}
@@ -28,7 +28,7 @@ func LevelDBNormalTesting(read int, write int, duration time.Duration) {
 	if envRootFolder != "" {
 		rootFolder = envRootFolder + ""
 	}
-	dbFile, err := db.NewLevelDBNormal(path.Join(rootFolder, "usecase3"))
+	dbFile, err := db.NewStore(db.EngineNormal, path.Join(rootFolder, "usecase3"))
 	if err != nil {
 		log.Fatalf("error while create NewDB on path %s: %s", rootFolder, err.Error())
 	}